@@ -2,9 +2,13 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cswilson90/goqueue/internal/data"
 )
@@ -14,13 +18,73 @@ const connType = "tcp"
 // Error returned when a request timees out
 var TimeoutError = errors.New("Request timed out")
 
+// Error returned when a peek finds no job
+var NotFoundError = errors.New("Job not found")
+
+// Error returned when a request is abandoned because the server is shutting down
+var ShutdownError = errors.New("Server is shutting down")
+
+// Error returned when a request is made after the client has been closed
+var ClosedError = errors.New("Client is closed")
+
+// Error returned when the server cancels a request
+var CancelledError = errors.New("Request cancelled")
+
 // GoQueueClient is a connection to a goqueue server and is used to manipulate jobs on the server.
 // By default the client will use the "default" queue for adding and reserving jobs.
+//
+// A client is safe to use from many goroutines at once. Requests are pipelined over the one connection:
+// each is sent as soon as it's made and responses are matched to requests in the order they were sent.
+// The server handles a connection's requests one at a time so a request waits for any sent before it,
+// including reserves waiting for a job. A client created with NewFramedGoQueueClient gives each request
+// an ID instead so the server handles its requests concurrently and answers each as soon as it can.
+//
+// The methods ending in Context take a context which bounds how long the request can take. If the context is
+// done before a reserve is answered the server is asked to cancel it, so the connection can carry on being used.
+// Other requests can't be cancelled once they're sent, so they return the context's error straight away but may
+// still take effect on the server.
 type GoQueueClient struct {
 	conn net.Conn
 
-	addQueue     string
-	reserveQueue string
+	// version is the protocol version negotiated with the server
+	version uint32
+
+	// writeMutex serialises requests so they are written in the order they're added to pending
+	writeMutex sync.Mutex
+
+	// pendingMutex protects the requests waiting for a response, oldest first, and err which is
+	// set once the connection has failed or been closed, after which no more requests are sent.
+	// It also protects framed, which is set once the connection is in framed mode, and the ID
+	// given to the last request sent in framed mode.
+	pendingMutex  sync.Mutex
+	pending       []*pendingRequest
+	err           error
+	framed        bool
+	lastRequestID uint32
+
+	// settingsMutex protects the queues used for adding and reserving jobs
+	settingsMutex sync.Mutex
+	addQueue      string
+	reserveQueues []string
+}
+
+// A pendingRequest is a request sent to the server which is waiting for its response.
+// parse reads the data of a successful response and done receives the result of the request.
+// Requests sent in framed mode have the ID their response will be given.
+type pendingRequest struct {
+	expectedResponse string
+	parse            func(*bufio.Reader) error
+	done             chan error
+
+	framed    bool
+	requestID uint32
+}
+
+// serverError is an error response sent by the server.
+type serverError string
+
+func (e serverError) Error() string {
+	return string(e)
 }
 
 // GoQueueJob represents a job on the go queue server.
@@ -33,79 +97,439 @@ type GoQueueJob struct {
 	Timeout  uint32
 }
 
+// GoQueueNewJob is a job to add to the go queue server in a batch.
+// If Queue is empty the job is added to the queue set with the AddQueue function.
+type GoQueueNewJob struct {
+	Data     []byte
+	Delay    uint32
+	Priority uint32
+	Queue    string
+	Timeout  uint32
+}
+
+// GoQueueStats are statistics about a single queue on the go queue server.
+// Added, Deleted and TimedOut count jobs added, jobs deleted and reservations which expired since the server started.
+// OldestReadyAge is how long the job which has been ready longest has been waiting.
+// Waiting is the number of clients waiting to reserve a job from the queue.
+type GoQueueStats struct {
+	Ready    uint64
+	Reserved uint64
+	Delayed  uint64
+	Buried   uint64
+
+	Added    uint64
+	Deleted  uint64
+	TimedOut uint64
+
+	OldestReadyAge time.Duration
+	Waiting        uint64
+}
+
+// GoQueueServerStats are statistics about the go queue server since it started.
+// Commands counts each command the server has handled by name e.g. "ADD" and Errors counts error responses.
+// LastJobID is the ID given to the most recently added job.
+// HeapBytes and SysBytes are the memory allocated on the heap and obtained from the operating system.
+type GoQueueServerStats struct {
+	Uptime time.Duration
+
+	CurrentConnections uint64
+	TotalConnections   uint64
+
+	Commands map[string]uint64
+	Errors   uint64
+
+	BytesIn  uint64
+	BytesOut uint64
+
+	LastJobID uint64
+
+	HeapBytes uint64
+	SysBytes  uint64
+}
+
 // NewGoQueueClient creates a new goqueue client connected to the goqueue server specified by the host and port.
 // Returns an error if the server can't be connected to.
 func NewGoQueueClient(connHost, connPort string) (*GoQueueClient, error) {
+	return newGoQueueClient(connHost, connPort, false)
+}
+
+// NewFramedGoQueueClient creates a new goqueue client connected to the goqueue server specified by the host
+// and port which uses framed mode, so a reserve waiting for a job doesn't hold up other requests.
+// Returns an error if the server can't be connected to or doesn't support framed mode.
+func NewFramedGoQueueClient(connHost, connPort string) (*GoQueueClient, error) {
+	return newGoQueueClient(connHost, connPort, true)
+}
+
+// newGoQueueClient creates a new goqueue client, switching it to framed mode if framed is set.
+func newGoQueueClient(connHost, connPort string, framed bool) (*GoQueueClient, error) {
 	conn, err := net.Dial(connType, connHost+":"+connPort)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &GoQueueClient{
-		conn:         conn,
-		addQueue:     "default",
-		reserveQueue: "default",
+		conn:          conn,
+		version:       1,
+		addQueue:      "default",
+		reserveQueues: []string{"default"},
 	}
+	go client.readResponses()
 
 	err = client.connect()
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
 
+	err = client.negotiateVersion()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if framed {
+		err = client.useFramed()
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
 	return client, nil
 }
 
+// Close closes the connection to the server.
+// Requests waiting for a response return a ClosedError and later requests fail with one.
+func (client *GoQueueClient) Close() error {
+	client.pendingMutex.Lock()
+	if client.err == ClosedError {
+		client.pendingMutex.Unlock()
+		return nil
+	}
+	client.err = ClosedError
+	client.pendingMutex.Unlock()
+
+	// Closing the connection stops the reader, which fails every pending request
+	return client.conn.Close()
+}
+
+// failed returns whether the client's connection has failed or been closed.
+func (client *GoQueueClient) failed() bool {
+	client.pendingMutex.Lock()
+	defer client.pendingMutex.Unlock()
+	return client.err != nil
+}
+
+// usesFramed returns whether the connection is in framed mode.
+func (client *GoQueueClient) usesFramed() bool {
+	client.pendingMutex.Lock()
+	defer client.pendingMutex.Unlock()
+	return client.framed
+}
+
 // AddToTube sets the tube that jobs will be added to.
 func (client *GoQueueClient) AddQueue(queue string) {
+	client.settingsMutex.Lock()
+	defer client.settingsMutex.Unlock()
 	client.addQueue = queue
 }
 
 // ReserveQueue sets the tube that jobs will be reserved from.
 func (client *GoQueueClient) ReserveQueue(queue string) {
-	client.reserveQueue = queue
+	client.settingsMutex.Lock()
+	defer client.settingsMutex.Unlock()
+	client.reserveQueues = []string{queue}
+}
+
+// ReserveQueues sets several queues that jobs will be reserved from.
+// ReserveJob then reserves the highest priority job ready in any of the queues.
+func (client *GoQueueClient) ReserveQueues(queues ...string) {
+	client.settingsMutex.Lock()
+	defer client.settingsMutex.Unlock()
+	client.reserveQueues = append([]string(nil), queues...)
+}
+
+// queues returns the queues that jobs are added to and reserved from.
+func (client *GoQueueClient) queues() (string, []string) {
+	client.settingsMutex.Lock()
+	defer client.settingsMutex.Unlock()
+	return client.addQueue, client.reserveQueues
 }
 
 // AddJob adds a job to the server.
 // Adds the job to the queue specfied with the AddQueue function or "default" if no queue has been set.
 func (client *GoQueueClient) AddJob(priority, ttp uint32, jobData []byte) (uint64, error) {
+	return client.AddJobDelayedContext(context.Background(), priority, ttp, 0, jobData)
+}
+
+// AddJobContext adds a job to the server like AddJob, giving up when the context is done.
+func (client *GoQueueClient) AddJobContext(ctx context.Context, priority, ttp uint32, jobData []byte) (uint64, error) {
+	return client.AddJobDelayedContext(ctx, priority, ttp, 0, jobData)
+}
+
+// AddJobDelayed adds a job to the server like AddJob which can't be reserved until delay seconds have passed.
+func (client *GoQueueClient) AddJobDelayed(priority, ttp, delay uint32, jobData []byte) (uint64, error) {
+	return client.AddJobDelayedContext(context.Background(), priority, ttp, delay, jobData)
+}
+
+// AddJobDelayedContext adds a delayed job to the server like AddJobDelayed, giving up when the context is done.
+func (client *GoQueueClient) AddJobDelayedContext(ctx context.Context, priority, ttp, delay uint32, jobData []byte) (uint64, error) {
+	addQueue, _ := client.queues()
+
 	request := data.PackString("ADD")
-	request = append(request, data.PackString(client.addQueue)...)
+	request = append(request, data.PackString(addQueue)...)
 	request = append(request, data.PackUint32(priority)...)
 	request = append(request, data.PackUint32(ttp)...)
 
+	if client.version >= 2 {
+		request = append(request, data.PackUint32(delay)...)
+	} else if delay > 0 {
+		return 0, fmt.Errorf("Server does not support delayed jobs")
+	}
+
 	packedJobData, err := data.PackJobData(jobData)
 	if err != nil {
 		return 0, err
 	}
 	request = append(request, packedJobData...)
 
-	cmdReader, err := client.makeRequest(request, "ADDED")
+	var jobID uint64
+	err = client.makeRequestContext(ctx, request, "ADDED", false, func(cmdReader *bufio.Reader) error {
+		var err error
+		jobID, err = data.ParseUint64(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to get ID of added job")
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	jobID, err := data.ParseUint64(cmdReader)
+	return jobID, nil
+}
+
+// AddJobs adds a batch of jobs to the server in a single request.
+// Either all of the jobs are added or none are. Returns the IDs of the added jobs in the order given.
+func (client *GoQueueClient) AddJobs(jobs []*GoQueueNewJob) ([]uint64, error) {
+	return client.AddJobsContext(context.Background(), jobs)
+}
+
+// AddJobsContext adds a batch of jobs to the server like AddJobs, giving up when the context is done.
+func (client *GoQueueClient) AddJobsContext(ctx context.Context, jobs []*GoQueueNewJob) ([]uint64, error) {
+	addQueue, _ := client.queues()
+
+	request := data.PackString("ADDBATCH")
+	request = append(request, data.PackUint32(uint32(len(jobs)))...)
+
+	for _, job := range jobs {
+		queue := job.Queue
+		if queue == "" {
+			queue = addQueue
+		}
+
+		request = append(request, data.PackString(queue)...)
+		request = append(request, data.PackUint32(job.Priority)...)
+		request = append(request, data.PackUint32(job.Timeout)...)
+		request = append(request, data.PackUint32(job.Delay)...)
+
+		packedJobData, err := data.PackJobData(job.Data)
+		if err != nil {
+			return nil, err
+		}
+		request = append(request, packedJobData...)
+	}
+
+	var jobIDs []uint64
+	err := client.makeRequestContext(ctx, request, "ADDED", false, func(cmdReader *bufio.Reader) error {
+		count, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to get number of added jobs")
+		}
+
+		jobIDs = make([]uint64, 0, count)
+		for i := uint32(0); i < count; i++ {
+			jobID, err := data.ParseUint64(cmdReader)
+			if err != nil {
+				return fmt.Errorf("Failed to get ID of added job")
+			}
+			jobIDs = append(jobIDs, jobID)
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, fmt.Errorf("Failed to get ID of added job")
+		return nil, err
 	}
 
-	return jobID, nil
+	return jobIDs, nil
 }
 
 // ReserveJob reserves a job from the server.
-// Reserves a job from the queue specfied with the ReserveQueue function or "default" if no queue has been set.
+// Reserves a job from the queues specfied with the ReserveQueue or ReserveQueues functions or "default" if no queue has been set.
 // Returns a TimeoutError if the request timed out.
 func (client *GoQueueClient) ReserveJob(timeout uint32) (*GoQueueJob, error) {
-	request := data.PackString("RESERVE")
-	request = append(request, data.PackString(client.reserveQueue)...)
+	return client.ReserveJobContext(context.Background(), timeout)
+}
+
+// ReserveJobContext reserves a job from the server like ReserveJob.
+// If the context is done first the reserve is cancelled and the context's error is returned.
+// A job reserved just as the context was done is released back to the server.
+func (client *GoQueueClient) ReserveJobContext(ctx context.Context, timeout uint32) (*GoQueueJob, error) {
+	_, reserveQueues := client.queues()
+
+	var request []byte
+	if len(reserveQueues) == 1 {
+		request = data.PackString("RESERVE")
+		request = append(request, data.PackString(reserveQueues[0])...)
+	} else {
+		request = data.PackString("RESERVEANY")
+		request = append(request, data.PackUint32(uint32(len(reserveQueues)))...)
+		for _, queue := range reserveQueues {
+			request = append(request, data.PackString(queue)...)
+		}
+	}
 	request = append(request, data.PackUint32(timeout)...)
 
-	cmdReader, err := client.makeRequest(request, "RESERVED")
+	job, err := client.requestJob(ctx, request, "RESERVED", true)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		client.ReleaseJob(job, job.Priority, 0)
+		return nil, ctx.Err()
+	}
+
+	return job, nil
+}
+
+// ReserveJobs reserves up to max jobs from the server in a single request.
+// Reserves from the queue specfied with the ReserveQueue function or "default" if no queue has been set.
+// If no job is ready it waits for one and returns it along with any others ready by then.
+// Returns a TimeoutError if the request timed out.
+func (client *GoQueueClient) ReserveJobs(max, timeout uint32) ([]*GoQueueJob, error) {
+	return client.ReserveJobsContext(context.Background(), max, timeout)
+}
+
+// ReserveJobsContext reserves up to max jobs from the server like ReserveJobs.
+// If the context is done first the reserve is cancelled and the context's error is returned.
+// Jobs reserved just as the context was done are released back to the server.
+func (client *GoQueueClient) ReserveJobsContext(ctx context.Context, max, timeout uint32) ([]*GoQueueJob, error) {
+	_, reserveQueues := client.queues()
+	if len(reserveQueues) != 1 {
+		return nil, fmt.Errorf("Can only reserve a batch of jobs from a single queue")
+	}
+
+	request := data.PackString("RESERVEBATCH")
+	request = append(request, data.PackString(reserveQueues[0])...)
+	request = append(request, data.PackUint32(max)...)
+	request = append(request, data.PackUint32(timeout)...)
+
+	var jobs []*GoQueueJob
+	err := client.makeRequestContext(ctx, request, "RESERVED", true, func(cmdReader *bufio.Reader) error {
+		count, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to get number of reserved jobs")
+		}
+
+		jobs = make([]*GoQueueJob, 0, count)
+		for i := uint32(0); i < count; i++ {
+			job, err := parseJob(cmdReader, client.version)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	internalJob, err := data.ParseJob(cmdReader)
+	if ctx.Err() != nil {
+		for _, job := range jobs {
+			client.ReleaseJob(job, job.Priority, 0)
+		}
+		return nil, ctx.Err()
+	}
+
+	return jobs, nil
+}
+
+// PeekJob gets the job with the given ID without changing it.
+// Returns a NotFoundError if the job doesn't exist.
+func (client *GoQueueClient) PeekJob(id uint64) (*GoQueueJob, error) {
+	return client.PeekJobContext(context.Background(), id)
+}
+
+// PeekJobContext gets a job like PeekJob, giving up when the context is done.
+func (client *GoQueueClient) PeekJobContext(ctx context.Context, id uint64) (*GoQueueJob, error) {
+	request := data.PackString("PEEK")
+	request = append(request, data.PackUint64(id)...)
+
+	return client.requestJob(ctx, request, "FOUND", false)
+}
+
+// PeekReady gets the job in the given queue which will be reserved next without reserving it.
+// Returns a NotFoundError if there are no ready jobs in the queue.
+func (client *GoQueueClient) PeekReady(queue string) (*GoQueueJob, error) {
+	return client.PeekReadyContext(context.Background(), queue)
+}
+
+// PeekReadyContext gets the next ready job like PeekReady, giving up when the context is done.
+func (client *GoQueueClient) PeekReadyContext(ctx context.Context, queue string) (*GoQueueJob, error) {
+	request := data.PackString("PEEKREADY")
+	request = append(request, data.PackString(queue)...)
+
+	return client.requestJob(ctx, request, "FOUND", false)
+}
+
+// PeekDelayed gets the delayed job in the given queue which will become ready soonest.
+// Returns a NotFoundError if there are no delayed jobs in the queue.
+func (client *GoQueueClient) PeekDelayed(queue string) (*GoQueueJob, error) {
+	return client.PeekDelayedContext(context.Background(), queue)
+}
+
+// PeekDelayedContext gets the next delayed job like PeekDelayed, giving up when the context is done.
+func (client *GoQueueClient) PeekDelayedContext(ctx context.Context, queue string) (*GoQueueJob, error) {
+	request := data.PackString("PEEKDELAYED")
+	request = append(request, data.PackString(queue)...)
+
+	return client.requestJob(ctx, request, "FOUND", false)
+}
+
+// PeekBuried gets the buried job in the given queue which will be kicked next without kicking it.
+// Returns a NotFoundError if there are no buried jobs in the queue.
+func (client *GoQueueClient) PeekBuried(queue string) (*GoQueueJob, error) {
+	return client.PeekBuriedContext(context.Background(), queue)
+}
+
+// PeekBuriedContext gets the next buried job like PeekBuried, giving up when the context is done.
+func (client *GoQueueClient) PeekBuriedContext(ctx context.Context, queue string) (*GoQueueJob, error) {
+	request := data.PackString("PEEKBURIED")
+	request = append(request, data.PackString(queue)...)
+
+	return client.requestJob(ctx, request, "FOUND", false)
+}
+
+// requestJob makes a request to the server whose response contains a single job and returns the job.
+func (client *GoQueueClient) requestJob(ctx context.Context, request []byte, expectedResponse string, cancellable bool) (*GoQueueJob, error) {
+	var job *GoQueueJob
+	err := client.makeRequestContext(ctx, request, expectedResponse, cancellable, func(cmdReader *bufio.Reader) error {
+		var err error
+		job, err = parseJob(cmdReader, client.version)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// parseJob parses a job from a response from the server using the negotiated protocol version.
+func parseJob(cmdReader *bufio.Reader, version uint32) (*GoQueueJob, error) {
+	internalJob, err := data.ParseJob(cmdReader, version)
 	if err != nil {
 		return nil, err
 	}
@@ -122,57 +546,482 @@ func (client *GoQueueClient) ReserveJob(timeout uint32) (*GoQueueJob, error) {
 
 // DeleteJob deletes a job from the server.
 func (client *GoQueueClient) DeleteJob(job *GoQueueJob) error {
+	return client.DeleteJobContext(context.Background(), job)
+}
+
+// DeleteJobContext deletes a job from the server like DeleteJob, giving up when the context is done.
+func (client *GoQueueClient) DeleteJobContext(ctx context.Context, job *GoQueueJob) error {
 	request := data.PackString("DELETE")
 	request = append(request, data.PackUint64(job.Id)...)
 
-	_, err := client.makeRequest(request, "OK")
+	return client.makeRequestContext(ctx, request, "OK", false, nil)
+}
+
+// TouchJob refreshes the reservation of a job reserved by this client, giving more time to process it.
+// Returns an error if the job is not reserved by this client.
+func (client *GoQueueClient) TouchJob(job *GoQueueJob) error {
+	return client.TouchJobContext(context.Background(), job)
+}
+
+// TouchJobContext refreshes the reservation of a job like TouchJob, giving up when the context is done.
+func (client *GoQueueClient) TouchJobContext(ctx context.Context, job *GoQueueJob) error {
+	request := data.PackString("TOUCH")
+	request = append(request, data.PackUint64(job.Id)...)
+
+	return client.makeRequestContext(ctx, request, "OK", false, nil)
+}
+
+// ReleaseJob releases a job reserved by this client back to the server so it can be reserved again.
+// The job is given the new priority and becomes ready after delay seconds, or immediately if delay is 0.
+func (client *GoQueueClient) ReleaseJob(job *GoQueueJob, priority, delay uint32) error {
+	return client.ReleaseJobContext(context.Background(), job, priority, delay)
+}
+
+// ReleaseJobContext releases a job back to the server like ReleaseJob, giving up when the context is done.
+func (client *GoQueueClient) ReleaseJobContext(ctx context.Context, job *GoQueueJob, priority, delay uint32) error {
+	request := data.PackString("RELEASE")
+	request = append(request, data.PackUint64(job.Id)...)
+	request = append(request, data.PackUint32(priority)...)
+	request = append(request, data.PackUint32(delay)...)
+
+	return client.makeRequestContext(ctx, request, "OK", false, nil)
+}
+
+// BuryJob buries a job reserved by this client with a new priority.
+// Buried jobs are kept on the server for inspection and can't be reserved until they are kicked.
+func (client *GoQueueClient) BuryJob(job *GoQueueJob, priority uint32) error {
+	return client.BuryJobContext(context.Background(), job, priority)
+}
+
+// BuryJobContext buries a job like BuryJob, giving up when the context is done.
+func (client *GoQueueClient) BuryJobContext(ctx context.Context, job *GoQueueJob, priority uint32) error {
+	request := data.PackString("BURY")
+	request = append(request, data.PackUint64(job.Id)...)
+	request = append(request, data.PackUint32(priority)...)
+
+	return client.makeRequestContext(ctx, request, "OK", false, nil)
+}
+
+// KickJobs moves up to count buried jobs in the given queue back to the ready queue.
+// Returns the number of jobs kicked.
+func (client *GoQueueClient) KickJobs(queue string, count uint32) (uint32, error) {
+	return client.KickJobsContext(context.Background(), queue, count)
+}
+
+// KickJobsContext kicks buried jobs like KickJobs, giving up when the context is done.
+func (client *GoQueueClient) KickJobsContext(ctx context.Context, queue string, count uint32) (uint32, error) {
+	request := data.PackString("KICK")
+	request = append(request, data.PackString(queue)...)
+	request = append(request, data.PackUint32(count)...)
+
+	var kicked uint32
+	err := client.makeRequestContext(ctx, request, "KICKED", false, func(cmdReader *bufio.Reader) error {
+		var err error
+		kicked, err = data.ParseUint32(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to get number of kicked jobs")
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return kicked, nil
 }
 
 // connect tries a connection to the server and returns an error if the connection failed.
 func (client *GoQueueClient) connect() error {
-	_, err := client.makeRequest(data.PackString("CONNECT"), "OK")
+	return client.makeRequest(data.PackString("CONNECT"), "OK", nil)
+}
+
+// ping checks the connection with a CONNECT request like connect, giving up when the context is done.
+// The connection fails if no response is read before the context's deadline, if it has one.
+func (client *GoQueueClient) ping(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if ok {
+		client.conn.SetReadDeadline(deadline)
+		defer client.conn.SetReadDeadline(time.Time{})
+	}
+
+	return client.makeRequestContext(ctx, data.PackString("CONNECT"), "OK", false, nil)
+}
+
+// negotiateVersion agrees a protocol version with the server.
+// Servers which don't support the VERSION command only support version 1 of the protocol.
+func (client *GoQueueClient) negotiateVersion() error {
+	request := append(data.PackString("VERSION"), data.PackUint32(data.ProtocolVersion)...)
+
+	var version uint32
+	err := client.makeRequest(request, "VERSION", func(cmdReader *bufio.Reader) error {
+		var err error
+		version, err = data.ParseUint32(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to get protocol version from server")
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		if _, ok := err.(serverError); !ok {
+			return err
+		}
+		version = 1
+	}
+	client.version = version
+
+	return nil
+}
+
+// useFramed switches the connection to framed mode. No other requests can be waiting for a response.
+func (client *GoQueueClient) useFramed() error {
+	// The response is parsed by the reader so it knows to read request IDs from then on
+	err := client.makeRequest(data.PackString("FRAMED"), "OK", func(cmdReader *bufio.Reader) error {
+		client.pendingMutex.Lock()
+		defer client.pendingMutex.Unlock()
+		client.framed = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to switch to framed mode: %v", err.Error())
 	}
 
 	return nil
 }
 
-// makeRequest makes a request to the server and checks the response given.
-// Returns a bufio.Reader fo reading the response of the request.
+// makeRequest sends a request to the server and waits for its response.
+// If the response is the expected one, parse is called to read the rest of the response unless it's nil.
 // Returns an error if there is an error, a timeout or the response does not match the expected response.
-func (client *GoQueueClient) makeRequest(request []byte, expectedResponse string) (*bufio.Reader, error) {
+func (client *GoQueueClient) makeRequest(request []byte, expectedResponse string, parse func(*bufio.Reader) error) error {
+	return client.makeRequestContext(context.Background(), request, expectedResponse, false, parse)
+}
+
+// makeRequestContext sends a request to the server and waits for its response like makeRequest,
+// giving up when the context is done. A cancellable request is cancelled on the server and its
+// response is still waited for, which is the result if the request finished before it could be cancelled.
+// Any other request is left to finish and its response is discarded.
+func (client *GoQueueClient) makeRequestContext(ctx context.Context, request []byte, expectedResponse string, cancellable bool, parse func(*bufio.Reader) error) error {
+	for {
+		pending, err := client.sendRequest(ctx, request, expectedResponse, parse)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case err = <-pending.done:
+		case <-ctx.Done():
+			if !cancellable {
+				return ctx.Err()
+			}
+			// The response to the cancel itself doesn't matter
+			cancelRequest := data.PackString("CANCEL")
+			if pending.framed {
+				cancelRequest = append(cancelRequest, data.PackUint32(pending.requestID)...)
+			}
+			client.sendRequest(context.Background(), cancelRequest, "OK", nil)
+			err = <-pending.done
+		}
+
+		if err != CancelledError {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A cancel sent for another request outside framed mode cancelled this one too so it's sent again
+	}
+}
+
+// sendRequest sends a request to the server and returns it once it's waiting for its response.
+// The context's deadline, if it has one, bounds how long writing the request can take.
+// A request which can't be written fails the connection as part of it may have been sent.
+func (client *GoQueueClient) sendRequest(ctx context.Context, request []byte, expectedResponse string, parse func(*bufio.Reader) error) (*pendingRequest, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	pending := &pendingRequest{
+		expectedResponse: expectedResponse,
+		parse:            parse,
+		done:             make(chan error, 1),
+	}
+
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	// The request must be pending before it's written so its response can be matched to it
+	client.pendingMutex.Lock()
+	if client.err != nil {
+		err := client.err
+		client.pendingMutex.Unlock()
+		return nil, err
+	}
+	if client.framed {
+		client.lastRequestID++
+		pending.framed = true
+		pending.requestID = client.lastRequestID
+		request = append(data.PackUint32(pending.requestID), request...)
+	}
+	client.pending = append(client.pending, pending)
+	client.pendingMutex.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		client.conn.SetWriteDeadline(deadline)
+		defer client.conn.SetWriteDeadline(time.Time{})
+	}
+
 	_, err := client.conn.Write(request)
 	if err != nil {
-		return nil, err
+		// Closing the connection stops the reader, which fails every pending request
+		client.conn.Close()
 	}
 
+	return pending, nil
+}
+
+// readResponses reads responses from the server and hands each to the oldest pending request,
+// as the server answers requests in the order they were sent, or in framed mode to the request with
+// the response's request ID. When the connection fails or is closed every pending request fails and
+// no more can be made.
+func (client *GoQueueClient) readResponses() {
 	cmdReader := bufio.NewReader(client.conn)
-	response, err := data.ParseCommand(cmdReader)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get response from server: " + err.Error())
+
+	for {
+		// Only the reader switches the connection to framed mode so it can't change while reading a response
+		client.pendingMutex.Lock()
+		framed := client.framed
+		client.pendingMutex.Unlock()
+
+		var requestID uint32
+		var err error
+		if framed {
+			requestID, err = data.ParseUint32(cmdReader)
+		}
+
+		var response string
+		if err == nil {
+			response, err = data.ParseCommand(cmdReader)
+		}
+		if err != nil {
+			client.failPending(fmt.Errorf("Failed to get response from server: " + err.Error()))
+			return
+		}
+
+		pending := client.takePending(framed, requestID)
+		if pending == nil {
+			client.failPending(fmt.Errorf("Unexpected '%v' response from server", response))
+			return
+		}
+
+		responseErr, connErr := readResponse(cmdReader, response, pending)
+		if connErr != nil {
+			pending.done <- client.failPending(connErr)
+			return
+		}
+		pending.done <- responseErr
 	}
+}
+
+// takePending removes and returns the request a response is for, which is the oldest pending request
+// or in framed mode the one with the given request ID. Returns nil if there's no such request.
+func (client *GoQueueClient) takePending(framed bool, requestID uint32) *pendingRequest {
+	client.pendingMutex.Lock()
+	defer client.pendingMutex.Unlock()
 
-	if response == "ERROR" {
+	for i, pending := range client.pending {
+		if !framed || pending.requestID == requestID {
+			copy(client.pending[i:], client.pending[i+1:])
+			client.pending[len(client.pending)-1] = nil
+			client.pending = client.pending[:len(client.pending)-1]
+			return pending
+		}
+	}
+	return nil
+}
+
+// failPending stops any more requests being made and fails every pending request.
+// Requests fail with the given error unless the client has been closed. Returns the error they failed with.
+func (client *GoQueueClient) failPending(err error) error {
+	client.conn.Close()
+
+	client.pendingMutex.Lock()
+	if client.err == nil {
+		client.err = err
+	}
+	failed := client.pending
+	client.pending = nil
+	err = client.err
+	client.pendingMutex.Unlock()
+
+	for _, pending := range failed {
+		pending.done <- err
+	}
+	return err
+}
+
+// readResponse reads the rest of the response to a pending request from the server.
+// The first returned error is the result of the request. The second is set if the response couldn't be read,
+// after which the rest of the responses from the connection can't be read either.
+func readResponse(cmdReader *bufio.Reader, response string, pending *pendingRequest) (error, error) {
+	switch response {
+	case "ERROR":
 		errorString, err := data.ParseString(cmdReader)
 		if err != nil {
-			return cmdReader, err
+			return nil, err
+		}
+		return serverError(errorString), nil
+	case "TIMEOUT":
+		return TimeoutError, nil
+	case "NOTFOUND":
+		return NotFoundError, nil
+	case "SHUTDOWN":
+		return ShutdownError, nil
+	case "CANCELLED":
+		return CancelledError, nil
+	}
+
+	if response != pending.expectedResponse {
+		return nil, fmt.Errorf("Expected '%v' response from server but got: '%v'", pending.expectedResponse, response)
+	}
+
+	if pending.parse != nil {
+		err := pending.parse(cmdReader)
+		if err != nil {
+			return nil, err
 		}
-		return cmdReader, errors.New(errorString)
 	}
 
-	if response == "TIMEOUT" {
-		return cmdReader, TimeoutError
+	return nil, nil
+}
+
+// ListQueues gets the names of all queues on the server in alphabetical order.
+func (client *GoQueueClient) ListQueues() ([]string, error) {
+	return client.ListQueuesContext(context.Background())
+}
+
+// ListQueuesContext gets the names of all queues like ListQueues, giving up when the context is done.
+func (client *GoQueueClient) ListQueuesContext(ctx context.Context) ([]string, error) {
+	var queues []string
+	err := client.makeRequestContext(ctx, data.PackString("LISTQUEUES"), "QUEUES", false, func(cmdReader *bufio.Reader) error {
+		count, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to get number of queues")
+		}
+
+		queues = make([]string, 0, count)
+		for i := uint32(0); i < count; i++ {
+			queue, err := data.ParseString(cmdReader)
+			if err != nil {
+				return fmt.Errorf("Failed to get queue name")
+			}
+			queues = append(queues, queue)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if response != expectedResponse {
-		return cmdReader, fmt.Errorf("Expected '%v' response from server but got: '%v'", expectedResponse, response)
+	return queues, nil
+}
+
+// QueueStats gets statistics about the named queue.
+func (client *GoQueueClient) QueueStats(queue string) (*GoQueueStats, error) {
+	return client.QueueStatsContext(context.Background(), queue)
+}
+
+// QueueStatsContext gets statistics about the named queue like QueueStats, giving up when the context is done.
+func (client *GoQueueClient) QueueStatsContext(ctx context.Context, queue string) (*GoQueueStats, error) {
+	request := data.PackString("STATSQUEUE")
+	request = append(request, data.PackString(queue)...)
+
+	var stats []data.Stat
+	err := client.makeRequestContext(ctx, request, "STATS", false, func(cmdReader *bufio.Reader) error {
+		var err error
+		stats, err = data.ParseStats(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to parse queue stats: " + err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Stats the client doesn't know about are ignored
+	queueStats := &GoQueueStats{}
+	for _, stat := range stats {
+		switch stat.Name {
+		case "ready":
+			queueStats.Ready = stat.Value
+		case "reserved":
+			queueStats.Reserved = stat.Value
+		case "delayed":
+			queueStats.Delayed = stat.Value
+		case "buried":
+			queueStats.Buried = stat.Value
+		case "added":
+			queueStats.Added = stat.Value
+		case "deleted":
+			queueStats.Deleted = stat.Value
+		case "timed-out":
+			queueStats.TimedOut = stat.Value
+		case "oldest-ready-age-ms":
+			queueStats.OldestReadyAge = time.Duration(stat.Value) * time.Millisecond
+		case "waiting":
+			queueStats.Waiting = stat.Value
+		}
+	}
+
+	return queueStats, nil
+}
+
+// ServerStats gets statistics about the server.
+func (client *GoQueueClient) ServerStats() (*GoQueueServerStats, error) {
+	return client.ServerStatsContext(context.Background())
+}
+
+// ServerStatsContext gets statistics about the server like ServerStats, giving up when the context is done.
+func (client *GoQueueClient) ServerStatsContext(ctx context.Context) (*GoQueueServerStats, error) {
+	var stats []data.Stat
+	err := client.makeRequestContext(ctx, data.PackString("STATS"), "STATS", false, func(cmdReader *bufio.Reader) error {
+		var err error
+		stats, err = data.ParseStats(cmdReader)
+		if err != nil {
+			return fmt.Errorf("Failed to parse server stats: " + err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Stats the client doesn't know about are ignored
+	serverStats := &GoQueueServerStats{Commands: make(map[string]uint64)}
+	for _, stat := range stats {
+		switch {
+		case stat.Name == "uptime-seconds":
+			serverStats.Uptime = time.Duration(stat.Value) * time.Second
+		case stat.Name == "connections-current":
+			serverStats.CurrentConnections = stat.Value
+		case stat.Name == "connections-total":
+			serverStats.TotalConnections = stat.Value
+		case strings.HasPrefix(stat.Name, "cmd-"):
+			serverStats.Commands[strings.ToUpper(strings.TrimPrefix(stat.Name, "cmd-"))] = stat.Value
+		case stat.Name == "errors":
+			serverStats.Errors = stat.Value
+		case stat.Name == "bytes-in":
+			serverStats.BytesIn = stat.Value
+		case stat.Name == "bytes-out":
+			serverStats.BytesOut = stat.Value
+		case stat.Name == "last-job-id":
+			serverStats.LastJobID = stat.Value
+		case stat.Name == "memory-heap-bytes":
+			serverStats.HeapBytes = stat.Value
+		case stat.Name == "memory-sys-bytes":
+			serverStats.SysBytes = stat.Value
+		}
 	}
 
-	return cmdReader, nil
+	return serverStats, nil
 }
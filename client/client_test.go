@@ -1,7 +1,11 @@
 package client
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -56,12 +60,36 @@ func TestClient(t *testing.T) {
 	}
 	assert.Equal(uint64(1), id, "Incorrect added job ID")
 
+	// Delayed job should not be reserved before the job with no delay
+	delayedID, err := client.AddJobDelayed(0, 60, 60, []byte{'4', '5', '6'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	assert.Equal(uint64(2), delayedID, "Incorrect added delayed job ID")
+
 	job, err := client.ReserveJob(1)
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 	assert.Equal(uint64(1), job.Id, "Incorrect reserved job ID")
 
+	err = client.TouchJob(job)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	err = client.ReleaseJob(job, 2, 0)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	job, err = client.ReserveJob(1)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	assert.Equal(uint64(1), job.Id, "Incorrect reserved job ID after release")
+	assert.Equal(uint32(2), job.Priority, "Incorrect priority after release")
+
 	err = client.DeleteJob(job)
 	if err != nil {
 		t.Errorf(err.Error())
@@ -70,4 +98,665 @@ func TestClient(t *testing.T) {
 	// Check timeout
 	job, err = client.ReserveJob(1)
 	assert.Equal(TimeoutError, err, "Expected timeout error")
+
+	// Can't touch a deleted job
+	err = client.TouchJob(&GoQueueJob{Id: id})
+	assert.Error(err, "Expected error touching deleted job")
+}
+
+func TestClientAddJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	client.AddQueue("queue-1")
+
+	ids, err := client.AddJobs([]*GoQueueNewJob{
+		{Data: []byte{'1'}, Priority: 2, Timeout: 60},
+		{Data: []byte{'2'}, Priority: 1, Timeout: 60},
+		{Data: []byte{'3'}, Priority: 1, Queue: "queue-2", Timeout: 60},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal([]uint64{1, 2, 3}, ids, "Incorrect added job IDs")
+
+	client.ReserveQueue("queue-1")
+	job, err := client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(uint64(2), job.Id, "Incorrect reserved job ID")
+	assert.Equal([]byte{'2'}, job.Data, "Incorrect reserved job data")
+
+	client.ReserveQueue("queue-2")
+	job, err = client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(uint64(3), job.Id, "Incorrect reserved job ID from other queue")
+
+	ids, err = client.AddJobs(nil)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	assert.Empty(ids, "Expected no IDs adding empty batch")
+}
+
+func TestClientReserveJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	_, err := client.AddJobs([]*GoQueueNewJob{
+		{Data: []byte{'1'}, Priority: 2, Timeout: 60},
+		{Data: []byte{'2'}, Priority: 1, Timeout: 60},
+		{Data: []byte{'3'}, Priority: 3, Timeout: 60},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	jobs, err := client.ReserveJobs(2, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if assert.Len(jobs, 2, "Incorrect number of reserved jobs") {
+		assert.Equal(uint64(2), jobs[0].Id, "Incorrect first reserved job ID")
+		assert.Equal(uint64(1), jobs[1].Id, "Incorrect second reserved job ID")
+		assert.Equal([]byte{'1'}, jobs[1].Data, "Incorrect reserved job data")
+	}
+
+	jobs, err = client.ReserveJobs(2, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if assert.Len(jobs, 1, "Incorrect number of reserved jobs") {
+		assert.Equal(uint64(3), jobs[0].Id, "Incorrect reserved job ID")
+	}
+
+	_, err = client.ReserveJobs(2, 1)
+	assert.Equal(TimeoutError, err, "Expected timeout error")
+
+	client.ReserveQueues("queue-1", "queue-2")
+	_, err = client.ReserveJobs(2, 1)
+	assert.Error(err, "Expected error reserving batch from several queues")
+}
+
+// benchmarkJobs is the number of jobs added in each iteration of the add benchmarks
+const benchmarkJobs = 100
+
+func BenchmarkAddJob(b *testing.B) {
+	server, _ := server.NewGoJobServer(connHost, connPort)
+	go server.Run()
+	defer server.Exit()
+
+	client, err := NewGoQueueClient(connHost, connPort)
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkJobs; j++ {
+			_, err := client.AddJob(1, 60, []byte{'1', '2', '3'})
+			if err != nil {
+				b.Fatalf(err.Error())
+			}
+		}
+	}
+}
+
+func BenchmarkAddJobs(b *testing.B) {
+	server, _ := server.NewGoJobServer(connHost, connPort)
+	go server.Run()
+	defer server.Exit()
+
+	client, err := NewGoQueueClient(connHost, connPort)
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	jobs := make([]*GoQueueNewJob, benchmarkJobs)
+	for j := range jobs {
+		jobs[j] = &GoQueueNewJob{Data: []byte{'1', '2', '3'}, Priority: 1, Timeout: 60}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.AddJobs(jobs)
+		if err != nil {
+			b.Fatalf(err.Error())
+		}
+	}
+}
+
+func TestClientReserveQueues(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	client.ReserveQueues("queue-1", "queue-2")
+
+	client.AddQueue("queue-1")
+	lowID, err := client.AddJob(2, 60, []byte{'1'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	client.AddQueue("queue-2")
+	highID, err := client.AddJob(1, 60, []byte{'2'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	client.AddQueue("queue-3")
+	_, err = client.AddJob(0, 60, []byte{'3'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	expectedJobs := []uint64{highID, lowID}
+	expectedQueues := []string{"queue-2", "queue-1"}
+	for i, expectedID := range expectedJobs {
+		job, err := client.ReserveJob(1)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assert.Equal(expectedID, job.Id, "Incorrect reserved job ID")
+		assert.Equal(expectedQueues[i], job.Queue, "Incorrect reserved job queue")
+	}
+
+	_, err = client.ReserveJob(1)
+	assert.Equal(TimeoutError, err, "Expected timeout error when watched queues are empty")
+}
+
+func TestClientConcurrentRequests(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+
+	// Many goroutines adding and reserving jobs should each get the responses to their own requests
+	const numWorkers = 20
+	const numJobs = 50
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for j := 0; j < numJobs; j++ {
+				jobData := []byte(fmt.Sprintf("%v-%v", worker, j))
+				id, err := client.AddJob(1, 60, jobData)
+				if err != nil {
+					t.Errorf(err.Error())
+					return
+				}
+
+				job, err := client.PeekJob(id)
+				if err != nil {
+					t.Errorf(err.Error())
+					return
+				}
+				if job.Id != id || string(job.Data) != string(jobData) {
+					t.Errorf("Peeked job %v with data %s, expected job %v with data %s", job.Id, job.Data, id, jobData)
+				}
+
+				job, err = client.ReserveJob(1)
+				if err != nil {
+					t.Errorf(err.Error())
+					return
+				}
+				err = client.DeleteJob(job)
+				if err != nil {
+					t.Errorf(err.Error())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats, err := client.QueueStats("default")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(t, uint64(numWorkers*numJobs), stats.Deleted, "Incorrect number of deleted jobs")
+}
+
+func TestClientClose(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	// A request waiting for a response should fail when the client is closed
+	reserveErr := make(chan error, 1)
+	go func() {
+		_, err := client.ReserveJob(0)
+		reserveErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err := client.Close()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	select {
+	case err := <-reserveErr:
+		assert.Equal(ClosedError, err, "Expected closed error from pending reserve")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Pending reserve didn't return when client was closed")
+	}
+
+	_, err = client.AddJob(1, 60, []byte{'1'})
+	assert.Equal(ClosedError, err, "Expected closed error adding job after close")
+}
+
+func TestClientContext(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+
+	// A blocked reserve should return when its context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	reserveErr := make(chan error, 1)
+	go func() {
+		_, err := client.ReserveJobContext(ctx, 0)
+		reserveErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-reserveErr:
+		assert.Equal(context.Canceled, err, "Expected cancelled error from reserve")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reserve didn't return when its context was cancelled")
+	}
+
+	// A reserve which has already been given up on shouldn't be sent
+	_, err := client.ReserveJobContext(ctx, 0)
+	assert.Equal(context.Canceled, err, "Expected cancelled error from reserve with a done context")
+
+	// Nor should any other request
+	_, err = client.KickJobsContext(ctx, "queue1", 1)
+	assert.Equal(context.Canceled, err, "Expected cancelled error from kick with a done context")
+	_, err = client.PeekReadyContext(ctx, "queue1")
+	assert.Equal(context.Canceled, err, "Expected cancelled error from peek with a done context")
+	_, err = client.ListQueuesContext(ctx)
+	assert.Equal(context.Canceled, err, "Expected cancelled error from list queues with a done context")
+	_, err = client.QueueStatsContext(ctx, "queue1")
+	assert.Equal(context.Canceled, err, "Expected cancelled error from queue stats with a done context")
+	_, err = client.ServerStatsContext(ctx)
+	assert.Equal(context.Canceled, err, "Expected cancelled error from server stats with a done context")
+
+	// The connection should still be usable and the cancelled reserves mustn't have taken the job
+	id, err := client.AddJobContext(context.Background(), 1, 60, []byte{'1'})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	job, err := client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(id, job.Id, "Incorrect reserved job ID")
+
+	// Reserves should give up when their deadline passes
+	deadlineCtx, deadlineCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer deadlineCancel()
+	_, err = client.ReserveJobsContext(deadlineCtx, 10, 0)
+	assert.Equal(context.DeadlineExceeded, err, "Expected deadline exceeded error from reserve")
+
+	err = client.DeleteJobContext(context.Background(), job)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestClientCancelOtherRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+
+	// A reserve cancelled along with another request's should carry on waiting
+	reserved := make(chan *GoQueueJob, 1)
+	go func() {
+		job, err := client.ReserveJob(0)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		reserved <- job
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.ReserveJobContext(ctx, 0)
+	assert.Equal(context.DeadlineExceeded, err, "Expected deadline exceeded error from reserve")
+
+	adder := createClient(t)
+	defer adder.Close()
+	id, err := adder.AddJob(1, 60, []byte{'1'})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case job := <-reserved:
+		assert.Equal(id, job.Id, "Incorrect reserved job ID")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reserve didn't get the added job")
+	}
+}
+
+func TestFramedClient(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client, err := NewFramedGoQueueClient(connHost, connPort)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer client.Close()
+
+	client.AddQueue("queue-2")
+	client.ReserveQueue("queue-1")
+
+	// A reserve waiting for a job shouldn't hold up other requests on the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	reserveErr := make(chan error, 1)
+	go func() {
+		_, err := client.ReserveJobContext(ctx, 0)
+		reserveErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	id, err := client.AddJob(1, 60, []byte{'1'})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	job, err := client.PeekJob(id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal("ready", job.Status, "Incorrect status of added job")
+
+	select {
+	case err := <-reserveErr:
+		t.Fatalf("Reserve returned before it was cancelled: %v", err)
+	default:
+	}
+
+	// Cancelling the reserve should only cancel that request
+	other := make(chan *GoQueueJob, 1)
+	go func() {
+		job, err := client.ReserveJob(0)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		other <- job
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-reserveErr:
+		assert.Equal(context.Canceled, err, "Expected cancelled error from reserve")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reserve didn't return when its context was cancelled")
+	}
+
+	client.AddQueue("queue-1")
+	id, err = client.AddJob(1, 60, []byte{'2'})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case job := <-other:
+		assert.Equal(id, job.Id, "Incorrect reserved job ID")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reserve didn't get the added job")
+	}
+}
+
+func TestClientBuryAndKick(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	id, err := client.AddJob(1, 60, []byte{'1', '2', '3'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	job, err := client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	err = client.BuryJob(job, 1)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	_, err = client.ReserveJob(1)
+	assert.Equal(TimeoutError, err, "Expected timeout error reserving when only job is buried")
+
+	kicked, err := client.KickJobs("default", 10)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	assert.Equal(uint32(1), kicked, "Incorrect number of kicked jobs")
+
+	job, err = client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(id, job.Id, "Incorrect reserved job ID after kick")
+}
+
+func TestClientPeek(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	_, err := client.PeekReady("default")
+	assert.Equal(NotFoundError, err, "Expected not found error peeking empty queue")
+
+	id, err := client.AddJob(1, 60, []byte{'1', '2', '3'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	delayedID, err := client.AddJobDelayed(1, 60, 60, []byte{'4', '5', '6'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	job, err := client.PeekReady("default")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(id, job.Id, "Incorrect peeked ready job ID")
+	assert.Equal([]byte{'1', '2', '3'}, job.Data, "Incorrect peeked job data")
+
+	job, err = client.PeekDelayed("default")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(delayedID, job.Id, "Incorrect peeked delayed job ID")
+	assert.Equal("delayed", job.Status, "Incorrect peeked delayed job status")
+
+	_, err = client.PeekBuried("default")
+	assert.Equal(NotFoundError, err, "Expected not found error peeking with no buried jobs")
+
+	// Peeking shouldn't stop the job being reserved
+	job, err = client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(id, job.Id, "Incorrect reserved job ID after peek")
+
+	err = client.BuryJob(job, 1)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	job, err = client.PeekBuried("default")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(id, job.Id, "Incorrect peeked buried job ID")
+
+	job, err = client.PeekJob(delayedID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(delayedID, job.Id, "Incorrect peeked job ID")
+
+	_, err = client.PeekJob(100)
+	assert.Equal(NotFoundError, err, "Expected not found error peeking job which doesn't exist")
+}
+
+func TestClientQueueStats(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.AddJob(1, 60, []byte{'1', '2', '3'})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+
+	job, err := client.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	client.DeleteJob(job)
+	client.ReserveJob(1)
+
+	stats, err := client.QueueStats("default")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(uint64(1), stats.Ready, "Incorrect number of ready jobs")
+	assert.Equal(uint64(1), stats.Reserved, "Incorrect number of reserved jobs")
+	assert.Equal(uint64(3), stats.Added, "Incorrect number of added jobs")
+	assert.Equal(uint64(1), stats.Deleted, "Incorrect number of deleted jobs")
+
+	stats, err = client.QueueStats("empty")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(&GoQueueStats{}, stats, "Expected empty stats for queue which doesn't exist")
+}
+
+func TestClientServerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	var lastID uint64
+	for i := 0; i < 2; i++ {
+		id, err := client.AddJob(1, 60, []byte{'1', '2', '3'})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		lastID = id
+	}
+	client.ReserveJob(1)
+	client.DeleteJob(&GoQueueJob{Id: 1000})
+
+	stats, err := client.ServerStats()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(uint64(1), stats.CurrentConnections, "Incorrect number of current connections")
+	assert.Equal(uint64(1), stats.TotalConnections, "Incorrect number of total connections")
+	assert.Equal(uint64(2), stats.Commands["ADD"], "Incorrect number of ADD commands")
+	assert.Equal(uint64(1), stats.Commands["RESERVE"], "Incorrect number of RESERVE commands")
+	assert.Equal(uint64(1), stats.Commands["DELETE"], "Incorrect number of DELETE commands")
+	assert.Equal(uint64(1), stats.Commands["STATS"], "Incorrect number of STATS commands")
+	assert.Equal(uint64(1), stats.Errors, "Incorrect number of errors")
+	assert.Equal(lastID, stats.LastJobID, "Incorrect last job ID")
+	assert.NotZero(stats.BytesIn, "Expected bytes read to be counted")
+	assert.NotZero(stats.BytesOut, "Expected bytes written to be counted")
+	assert.NotZero(stats.HeapBytes, "Expected heap memory to be reported")
+}
+
+func TestClientListQueues(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+
+	queues, err := client.ListQueues()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Empty(queues, "Expected no queues on new server")
+
+	for _, queue := range []string{"queue2", "queue1", "queue2"} {
+		client.AddQueue(queue)
+		_, err := client.AddJob(1, 60, []byte{'1'})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+
+	queues, err = client.ListQueues()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal([]string{"queue1", "queue2"}, queues, "Incorrect queue names")
 }
@@ -0,0 +1,696 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Error returned when a request can't be made because none of a pool's connections are up
+var NoConnectionError = errors.New("No connection to server")
+
+// GoQueueClientPoolConfig configures a GoQueueClientPool. Zero fields are given their default values.
+type GoQueueClientPoolConfig struct {
+	// Size is the number of connections in the pool. Defaults to 4.
+	Size int
+	// HealthCheckInterval is how often each connection is checked with a CONNECT command. Defaults to 10 seconds.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout is how long a check waits for its response before the connection is reconnected.
+	// Defaults to 5 seconds.
+	HealthCheckTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the time waited between attempts to reconnect or retry a request.
+	// The wait doubles after each failed attempt. Default to 100 milliseconds and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetries is the number of times a request which is safe to repeat is retried after its connection fails.
+	// Defaults to 3.
+	MaxRetries int
+}
+
+// GoQueueClientPool is a pool of connections to a goqueue server which has the same methods as a GoQueueClient.
+// Failed connections are reconnected in the background with exponential backoff so the pool keeps working
+// through server restarts. Connections are checked regularly with a CONNECT command.
+//
+// Connections use framed mode if the server supports it so a reserve waiting for a job doesn't hold up
+// other requests on its connection. Otherwise requests avoid connections with a reserve in progress
+// unless every connection has one.
+//
+// Requests which fail because their connection failed are retried on another connection if they are safe
+// to repeat, which are peeks, ListQueues, QueueStats and ServerStats. Other requests return the error.
+// Jobs reserved through the pool are touched, released and buried on the connection which reserved them
+// so they fail if that connection has failed, as the server has released the job.
+type GoQueueClientPool struct {
+	host   string
+	port   string
+	config GoQueueClientPoolConfig
+
+	slots []*poolSlot
+	next  uint32
+
+	// mutex protects the queue settings applied to every connection and the reservations,
+	// which map the ID of each job reserved through the pool to the client which reserved it
+	mutex         sync.Mutex
+	addQueue      string
+	reserveQueues []string
+	reservations  map[uint64]*GoQueueClient
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// A poolSlot holds one of a pool's connections, which is nil while it's reconnecting.
+// reserving counts the reserves in progress on the connection.
+// wake is signalled when the connection fails so it's reconnected straight away.
+type poolSlot struct {
+	mutex     sync.Mutex
+	client    *GoQueueClient
+	reserving int
+	wake      chan struct{}
+}
+
+// busy returns whether a request on the slot's connection would wait behind a reserve.
+// Framed connections are never busy. The slot's mutex must be held.
+func (slot *poolSlot) busy() bool {
+	return slot.reserving > 0 && !slot.client.usesFramed()
+}
+
+// NewGoQueueClientPool creates a pool of connections to the goqueue server specified by the host and port.
+// Returns an error if none of the connections could be made.
+func NewGoQueueClientPool(connHost, connPort string, config GoQueueClientPoolConfig) (*GoQueueClientPool, error) {
+	if config.Size <= 0 {
+		config.Size = 4
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = 10 * time.Second
+	}
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = 5 * time.Second
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 3
+	}
+
+	pool := &GoQueueClientPool{
+		host:          connHost,
+		port:          connPort,
+		config:        config,
+		slots:         make([]*poolSlot, config.Size),
+		addQueue:      "default",
+		reserveQueues: []string{"default"},
+		reservations:  make(map[uint64]*GoQueueClient),
+		closed:        make(chan struct{}),
+	}
+
+	var lastErr error
+	connected := 0
+	for i := range pool.slots {
+		pool.slots[i] = &poolSlot{wake: make(chan struct{}, 1)}
+		err := pool.connect(pool.slots[i])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		connected++
+	}
+
+	if connected == 0 {
+		return nil, fmt.Errorf("Failed to connect to server: %v", lastErr)
+	}
+
+	for _, slot := range pool.slots {
+		pool.wg.Add(1)
+		go pool.maintain(slot)
+	}
+
+	return pool, nil
+}
+
+// Close closes all of the pool's connections and stops reconnecting them.
+func (pool *GoQueueClientPool) Close() error {
+	pool.closeOnce.Do(func() {
+		close(pool.closed)
+	})
+
+	// Closing the connections first stops health checks waiting on them,
+	// then any connected while the pool was closing are closed
+	pool.closeClients()
+	pool.wg.Wait()
+	pool.closeClients()
+
+	return nil
+}
+
+// closeClients closes all of the pool's connections.
+func (pool *GoQueueClientPool) closeClients() {
+	for _, slot := range pool.slots {
+		slot.mutex.Lock()
+		if slot.client != nil {
+			slot.client.Close()
+			slot.client = nil
+		}
+		slot.mutex.Unlock()
+	}
+}
+
+// AddQueue sets the queue that jobs will be added to.
+func (pool *GoQueueClientPool) AddQueue(queue string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.addQueue = queue
+	pool.applySettings()
+}
+
+// ReserveQueue sets the queue that jobs will be reserved from.
+func (pool *GoQueueClientPool) ReserveQueue(queue string) {
+	pool.ReserveQueues(queue)
+}
+
+// ReserveQueues sets several queues that jobs will be reserved from.
+func (pool *GoQueueClientPool) ReserveQueues(queues ...string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.reserveQueues = append([]string(nil), queues...)
+	pool.applySettings()
+}
+
+// applySettings sets the queues of every connection to the pool's. The pool's mutex must be held.
+func (pool *GoQueueClientPool) applySettings() {
+	for _, slot := range pool.slots {
+		slot.mutex.Lock()
+		if slot.client != nil {
+			slot.client.AddQueue(pool.addQueue)
+			slot.client.ReserveQueues(pool.reserveQueues...)
+		}
+		slot.mutex.Unlock()
+	}
+}
+
+// AddJob adds a job to the server. See GoQueueClient.AddJob.
+func (pool *GoQueueClientPool) AddJob(priority, ttp uint32, jobData []byte) (uint64, error) {
+	return pool.AddJobDelayedContext(context.Background(), priority, ttp, 0, jobData)
+}
+
+// AddJobContext adds a job to the server. See GoQueueClient.AddJobContext.
+func (pool *GoQueueClientPool) AddJobContext(ctx context.Context, priority, ttp uint32, jobData []byte) (uint64, error) {
+	return pool.AddJobDelayedContext(ctx, priority, ttp, 0, jobData)
+}
+
+// AddJobDelayed adds a delayed job to the server. See GoQueueClient.AddJobDelayed.
+func (pool *GoQueueClientPool) AddJobDelayed(priority, ttp, delay uint32, jobData []byte) (uint64, error) {
+	return pool.AddJobDelayedContext(context.Background(), priority, ttp, delay, jobData)
+}
+
+// AddJobDelayedContext adds a delayed job to the server. See GoQueueClient.AddJobDelayedContext.
+func (pool *GoQueueClientPool) AddJobDelayedContext(ctx context.Context, priority, ttp, delay uint32, jobData []byte) (uint64, error) {
+	var jobID uint64
+	err := pool.do(ctx, false, func(client *GoQueueClient) error {
+		var err error
+		jobID, err = client.AddJobDelayedContext(ctx, priority, ttp, delay, jobData)
+		return err
+	})
+	return jobID, err
+}
+
+// AddJobs adds a batch of jobs to the server in a single request. See GoQueueClient.AddJobs.
+func (pool *GoQueueClientPool) AddJobs(jobs []*GoQueueNewJob) ([]uint64, error) {
+	return pool.AddJobsContext(context.Background(), jobs)
+}
+
+// AddJobsContext adds a batch of jobs to the server in a single request. See GoQueueClient.AddJobsContext.
+func (pool *GoQueueClientPool) AddJobsContext(ctx context.Context, jobs []*GoQueueNewJob) ([]uint64, error) {
+	var jobIDs []uint64
+	err := pool.do(ctx, false, func(client *GoQueueClient) error {
+		var err error
+		jobIDs, err = client.AddJobsContext(ctx, jobs)
+		return err
+	})
+	return jobIDs, err
+}
+
+// ReserveJob reserves a job from the server. See GoQueueClient.ReserveJob.
+func (pool *GoQueueClientPool) ReserveJob(timeout uint32) (*GoQueueJob, error) {
+	return pool.ReserveJobContext(context.Background(), timeout)
+}
+
+// ReserveJobContext reserves a job from the server. See GoQueueClient.ReserveJobContext.
+func (pool *GoQueueClientPool) ReserveJobContext(ctx context.Context, timeout uint32) (*GoQueueJob, error) {
+	var job *GoQueueJob
+	err := pool.doReserve(func(client *GoQueueClient) error {
+		var err error
+		job, err = client.ReserveJobContext(ctx, timeout)
+		if err == nil {
+			pool.addReservations(client, job)
+		}
+		return err
+	})
+	return job, err
+}
+
+// ReserveJobs reserves up to max jobs from the server in a single request. See GoQueueClient.ReserveJobs.
+func (pool *GoQueueClientPool) ReserveJobs(max, timeout uint32) ([]*GoQueueJob, error) {
+	return pool.ReserveJobsContext(context.Background(), max, timeout)
+}
+
+// ReserveJobsContext reserves up to max jobs from the server in a single request. See GoQueueClient.ReserveJobsContext.
+func (pool *GoQueueClientPool) ReserveJobsContext(ctx context.Context, max, timeout uint32) ([]*GoQueueJob, error) {
+	var jobs []*GoQueueJob
+	err := pool.doReserve(func(client *GoQueueClient) error {
+		var err error
+		jobs, err = client.ReserveJobsContext(ctx, max, timeout)
+		if err == nil {
+			pool.addReservations(client, jobs...)
+		}
+		return err
+	})
+	return jobs, err
+}
+
+// DeleteJob deletes a job from the server.
+// A job reserved through the pool is deleted on the connection which reserved it if it's still up.
+func (pool *GoQueueClientPool) DeleteJob(job *GoQueueJob) error {
+	return pool.DeleteJobContext(context.Background(), job)
+}
+
+// DeleteJobContext deletes a job from the server like DeleteJob, giving up when the context is done.
+func (pool *GoQueueClientPool) DeleteJobContext(ctx context.Context, job *GoQueueJob) error {
+	client, ok := pool.reservedBy(job)
+	if !ok || client.failed() {
+		return pool.do(ctx, false, func(client *GoQueueClient) error {
+			return client.DeleteJobContext(ctx, job)
+		})
+	}
+
+	err := pool.onReservingClient(client, client.DeleteJobContext(ctx, job))
+	if err == nil {
+		pool.removeReservation(job)
+	}
+	return err
+}
+
+// TouchJob refreshes the reservation of a job reserved through the pool. See GoQueueClient.TouchJob.
+func (pool *GoQueueClientPool) TouchJob(job *GoQueueJob) error {
+	return pool.TouchJobContext(context.Background(), job)
+}
+
+// TouchJobContext refreshes the reservation of a job reserved through the pool. See GoQueueClient.TouchJobContext.
+func (pool *GoQueueClientPool) TouchJobContext(ctx context.Context, job *GoQueueJob) error {
+	client, ok := pool.reservedBy(job)
+	if !ok {
+		return fmt.Errorf("Job %v was not reserved through this pool", job.Id)
+	}
+
+	return pool.onReservingClient(client, client.TouchJobContext(ctx, job))
+}
+
+// ReleaseJob releases a job reserved through the pool back to the server. See GoQueueClient.ReleaseJob.
+func (pool *GoQueueClientPool) ReleaseJob(job *GoQueueJob, priority, delay uint32) error {
+	return pool.ReleaseJobContext(context.Background(), job, priority, delay)
+}
+
+// ReleaseJobContext releases a job reserved through the pool back to the server. See GoQueueClient.ReleaseJobContext.
+func (pool *GoQueueClientPool) ReleaseJobContext(ctx context.Context, job *GoQueueJob, priority, delay uint32) error {
+	client, ok := pool.reservedBy(job)
+	if !ok {
+		return fmt.Errorf("Job %v was not reserved through this pool", job.Id)
+	}
+
+	err := pool.onReservingClient(client, client.ReleaseJobContext(ctx, job, priority, delay))
+	if err == nil {
+		pool.removeReservation(job)
+	}
+	return err
+}
+
+// BuryJob buries a job reserved through the pool with a new priority. See GoQueueClient.BuryJob.
+func (pool *GoQueueClientPool) BuryJob(job *GoQueueJob, priority uint32) error {
+	return pool.BuryJobContext(context.Background(), job, priority)
+}
+
+// BuryJobContext buries a job reserved through the pool with a new priority. See GoQueueClient.BuryJobContext.
+func (pool *GoQueueClientPool) BuryJobContext(ctx context.Context, job *GoQueueJob, priority uint32) error {
+	client, ok := pool.reservedBy(job)
+	if !ok {
+		return fmt.Errorf("Job %v was not reserved through this pool", job.Id)
+	}
+
+	err := pool.onReservingClient(client, client.BuryJobContext(ctx, job, priority))
+	if err == nil {
+		pool.removeReservation(job)
+	}
+	return err
+}
+
+// KickJobs moves up to count buried jobs in the given queue back to the ready queue. See GoQueueClient.KickJobs.
+func (pool *GoQueueClientPool) KickJobs(queue string, count uint32) (uint32, error) {
+	return pool.KickJobsContext(context.Background(), queue, count)
+}
+
+// KickJobsContext kicks buried jobs in the given queue. See GoQueueClient.KickJobsContext.
+func (pool *GoQueueClientPool) KickJobsContext(ctx context.Context, queue string, count uint32) (uint32, error) {
+	var kicked uint32
+	err := pool.do(ctx, false, func(client *GoQueueClient) error {
+		var err error
+		kicked, err = client.KickJobsContext(ctx, queue, count)
+		return err
+	})
+	return kicked, err
+}
+
+// PeekJob gets the job with the given ID without changing it. See GoQueueClient.PeekJob.
+func (pool *GoQueueClientPool) PeekJob(id uint64) (*GoQueueJob, error) {
+	return pool.PeekJobContext(context.Background(), id)
+}
+
+// PeekJobContext gets the job with the given ID without changing it. See GoQueueClient.PeekJobContext.
+func (pool *GoQueueClientPool) PeekJobContext(ctx context.Context, id uint64) (*GoQueueJob, error) {
+	return pool.peek(ctx, func(client *GoQueueClient) (*GoQueueJob, error) { return client.PeekJobContext(ctx, id) })
+}
+
+// PeekReady gets the job in the given queue which will be reserved next. See GoQueueClient.PeekReady.
+func (pool *GoQueueClientPool) PeekReady(queue string) (*GoQueueJob, error) {
+	return pool.PeekReadyContext(context.Background(), queue)
+}
+
+// PeekReadyContext gets the job in the given queue which will be reserved next. See GoQueueClient.PeekReadyContext.
+func (pool *GoQueueClientPool) PeekReadyContext(ctx context.Context, queue string) (*GoQueueJob, error) {
+	return pool.peek(ctx, func(client *GoQueueClient) (*GoQueueJob, error) { return client.PeekReadyContext(ctx, queue) })
+}
+
+// PeekDelayed gets the delayed job in the given queue which will become ready soonest. See GoQueueClient.PeekDelayed.
+func (pool *GoQueueClientPool) PeekDelayed(queue string) (*GoQueueJob, error) {
+	return pool.PeekDelayedContext(context.Background(), queue)
+}
+
+// PeekDelayedContext gets the delayed job in the given queue which will become ready soonest.
+// See GoQueueClient.PeekDelayedContext.
+func (pool *GoQueueClientPool) PeekDelayedContext(ctx context.Context, queue string) (*GoQueueJob, error) {
+	return pool.peek(ctx, func(client *GoQueueClient) (*GoQueueJob, error) { return client.PeekDelayedContext(ctx, queue) })
+}
+
+// PeekBuried gets the buried job in the given queue which will be kicked next. See GoQueueClient.PeekBuried.
+func (pool *GoQueueClientPool) PeekBuried(queue string) (*GoQueueJob, error) {
+	return pool.PeekBuriedContext(context.Background(), queue)
+}
+
+// PeekBuriedContext gets the buried job in the given queue which will be kicked next. See GoQueueClient.PeekBuriedContext.
+func (pool *GoQueueClientPool) PeekBuriedContext(ctx context.Context, queue string) (*GoQueueJob, error) {
+	return pool.peek(ctx, func(client *GoQueueClient) (*GoQueueJob, error) { return client.PeekBuriedContext(ctx, queue) })
+}
+
+// peek makes a peek request, retrying it if its connection fails until the context is done.
+func (pool *GoQueueClientPool) peek(ctx context.Context, request func(*GoQueueClient) (*GoQueueJob, error)) (*GoQueueJob, error) {
+	var job *GoQueueJob
+	err := pool.do(ctx, true, func(client *GoQueueClient) error {
+		var err error
+		job, err = request(client)
+		return err
+	})
+	return job, err
+}
+
+// ListQueues gets the names of all queues on the server in alphabetical order.
+func (pool *GoQueueClientPool) ListQueues() ([]string, error) {
+	return pool.ListQueuesContext(context.Background())
+}
+
+// ListQueuesContext gets the names of all queues on the server. See GoQueueClient.ListQueuesContext.
+func (pool *GoQueueClientPool) ListQueuesContext(ctx context.Context) ([]string, error) {
+	var queues []string
+	err := pool.do(ctx, true, func(client *GoQueueClient) error {
+		var err error
+		queues, err = client.ListQueuesContext(ctx)
+		return err
+	})
+	return queues, err
+}
+
+// QueueStats gets statistics about the named queue.
+func (pool *GoQueueClientPool) QueueStats(queue string) (*GoQueueStats, error) {
+	return pool.QueueStatsContext(context.Background(), queue)
+}
+
+// QueueStatsContext gets statistics about the named queue. See GoQueueClient.QueueStatsContext.
+func (pool *GoQueueClientPool) QueueStatsContext(ctx context.Context, queue string) (*GoQueueStats, error) {
+	var stats *GoQueueStats
+	err := pool.do(ctx, true, func(client *GoQueueClient) error {
+		var err error
+		stats, err = client.QueueStatsContext(ctx, queue)
+		return err
+	})
+	return stats, err
+}
+
+// ServerStats gets statistics about the server.
+func (pool *GoQueueClientPool) ServerStats() (*GoQueueServerStats, error) {
+	return pool.ServerStatsContext(context.Background())
+}
+
+// ServerStatsContext gets statistics about the server. See GoQueueClient.ServerStatsContext.
+func (pool *GoQueueClientPool) ServerStatsContext(ctx context.Context) (*GoQueueServerStats, error) {
+	var stats *GoQueueServerStats
+	err := pool.do(ctx, true, func(client *GoQueueClient) error {
+		var err error
+		stats, err = client.ServerStatsContext(ctx)
+		return err
+	})
+	return stats, err
+}
+
+// do makes a request with one of the pool's connections.
+// If the connection fails and retry is set the request is retried on another connection with backoff,
+// up to the configured number of retries or until the context is done. Returns NoConnectionError if no connection is up.
+func (pool *GoQueueClientPool) do(ctx context.Context, retry bool, request func(*GoQueueClient) error) error {
+	backoff := pool.config.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := NoConnectionError
+		slot, client := pool.get()
+		if client != nil {
+			err = request(client)
+			if err == nil || !client.failed() {
+				return err
+			}
+			pool.disconnect(slot, client)
+		}
+
+		if !retry || attempt >= pool.config.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pool.closed:
+			return ClosedError
+		}
+		backoff = pool.nextBackoff(backoff)
+	}
+}
+
+// doReserve makes a reserve request with one of the pool's connections, marking the connection as reserving
+// while it's in progress. Returns NoConnectionError if no connection is up.
+func (pool *GoQueueClientPool) doReserve(request func(*GoQueueClient) error) error {
+	slot, client := pool.get()
+	if client == nil {
+		return NoConnectionError
+	}
+
+	slot.mutex.Lock()
+	slot.reserving++
+	slot.mutex.Unlock()
+
+	err := request(client)
+
+	slot.mutex.Lock()
+	slot.reserving--
+	slot.mutex.Unlock()
+
+	if err != nil && client.failed() {
+		pool.disconnect(slot, client)
+	}
+	return err
+}
+
+// onReservingClient handles the result of a request made on the connection which reserved a job.
+// If the connection has failed it's reconnected.
+func (pool *GoQueueClientPool) onReservingClient(client *GoQueueClient, err error) error {
+	if err != nil && client.failed() {
+		for _, slot := range pool.slots {
+			pool.disconnect(slot, client)
+		}
+	}
+	return err
+}
+
+// get returns a connected client from the pool and the slot it's in, taking each slot in turn.
+// Connections which are busy with a reserve are skipped unless every connected one is.
+// The client is nil if no slot is connected.
+func (pool *GoQueueClientPool) get() (*poolSlot, *GoQueueClient) {
+	var busySlot *poolSlot
+	var busyClient *GoQueueClient
+
+	start := atomic.AddUint32(&pool.next, 1)
+	for i := range pool.slots {
+		slot := pool.slots[(int(start)+i)%len(pool.slots)]
+		slot.mutex.Lock()
+		client := slot.client
+		busy := client != nil && slot.busy()
+		slot.mutex.Unlock()
+
+		if client == nil {
+			continue
+		}
+		if !busy {
+			return slot, client
+		}
+		if busyClient == nil {
+			busySlot, busyClient = slot, client
+		}
+	}
+	return busySlot, busyClient
+}
+
+// addReservations records that the given jobs were reserved by the client.
+func (pool *GoQueueClientPool) addReservations(client *GoQueueClient, jobs ...*GoQueueJob) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, job := range jobs {
+		pool.reservations[job.Id] = client
+	}
+}
+
+// removeReservation forgets the reservation of the given job.
+func (pool *GoQueueClientPool) removeReservation(job *GoQueueJob) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	delete(pool.reservations, job.Id)
+}
+
+// reservedBy returns the client which reserved the given job.
+// The second return value is false if the job wasn't reserved through the pool.
+func (pool *GoQueueClientPool) reservedBy(job *GoQueueJob) (*GoQueueClient, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	client, ok := pool.reservations[job.Id]
+	return client, ok
+}
+
+// connect connects the slot to the server, giving the new connection the pool's queue settings.
+// The connection uses framed mode unless the server doesn't support it.
+func (pool *GoQueueClientPool) connect(slot *poolSlot) error {
+	client, err := NewFramedGoQueueClient(pool.host, pool.port)
+	if err != nil {
+		client, err = NewGoQueueClient(pool.host, pool.port)
+	}
+	if err != nil {
+		return err
+	}
+
+	pool.mutex.Lock()
+	client.AddQueue(pool.addQueue)
+	client.ReserveQueues(pool.reserveQueues...)
+	slot.mutex.Lock()
+	slot.client = client
+	slot.mutex.Unlock()
+	pool.mutex.Unlock()
+
+	return nil
+}
+
+// disconnect removes the client from the slot if it's still there, closes it and wakes the slot to reconnect.
+// Reservations made by the client are forgotten as the server releases them.
+func (pool *GoQueueClientPool) disconnect(slot *poolSlot, client *GoQueueClient) {
+	slot.mutex.Lock()
+	if slot.client != client {
+		slot.mutex.Unlock()
+		return
+	}
+	slot.client = nil
+	slot.mutex.Unlock()
+	client.Close()
+
+	pool.mutex.Lock()
+	for jobID, reservingClient := range pool.reservations {
+		if reservingClient == client {
+			delete(pool.reservations, jobID)
+		}
+	}
+	pool.mutex.Unlock()
+
+	select {
+	case slot.wake <- struct{}{}:
+	default:
+	}
+}
+
+// maintain keeps the slot connected until the pool is closed.
+// While it's connected the connection is checked every health check interval and reconnected
+// if the check fails or times out. Busy connections aren't checked as the check would wait behind a reserve.
+// While it isn't connected, reconnecting is attempted with exponential backoff.
+func (pool *GoQueueClientPool) maintain(slot *poolSlot) {
+	defer pool.wg.Done()
+
+	backoff := pool.config.MinBackoff
+	for {
+		slot.mutex.Lock()
+		client := slot.client
+		slot.mutex.Unlock()
+
+		if client == nil {
+			err := pool.connect(slot)
+			if err == nil {
+				backoff = pool.config.MinBackoff
+				continue
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-pool.closed:
+				return
+			}
+			backoff = pool.nextBackoff(backoff)
+			continue
+		}
+
+		select {
+		case <-time.After(pool.config.HealthCheckInterval):
+			slot.mutex.Lock()
+			busy := slot.client == client && slot.busy()
+			slot.mutex.Unlock()
+			if busy {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), pool.config.HealthCheckTimeout)
+			err := client.ping(ctx)
+			cancel()
+			if err != nil {
+				pool.disconnect(slot, client)
+			}
+		case <-slot.wake:
+		case <-pool.closed:
+			return
+		}
+	}
+}
+
+// nextBackoff returns the backoff to use after the given one, which is double it up to the maximum.
+func (pool *GoQueueClientPool) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > pool.config.MaxBackoff {
+		backoff = pool.config.MaxBackoff
+	}
+	return backoff
+}
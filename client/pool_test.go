@@ -0,0 +1,158 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPoolConfig is a pool config which reconnects quickly for tests
+var testPoolConfig = GoQueueClientPoolConfig{
+	Size:                2,
+	HealthCheckInterval: 50 * time.Millisecond,
+	MinBackoff:          10 * time.Millisecond,
+	MaxBackoff:          50 * time.Millisecond,
+	MaxRetries:          20,
+}
+
+func TestClientPool(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	pool, err := NewGoQueueClientPool(connHost, connPort, testPoolConfig)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer pool.Close()
+
+	pool.AddQueue("queue-1")
+	pool.ReserveQueue("queue-1")
+
+	id, err := pool.AddJob(1, 60, []byte{'1', '2', '3'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	job, err := pool.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(id, job.Id, "Incorrect reserved job ID")
+
+	// Reserved jobs should be handled by the connection which reserved them whichever is used next
+	for i := 0; i < 2; i++ {
+		err = pool.TouchJob(job)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+	}
+
+	err = pool.ReleaseJob(job, 1, 0)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	err = pool.TouchJob(job)
+	assert.Error(err, "Expected error touching released job")
+
+	job, err = pool.ReserveJob(1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = pool.DeleteJob(job)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	_, err = pool.PeekJob(id)
+	assert.Equal(NotFoundError, err, "Expected not found error peeking deleted job")
+}
+
+func TestClientPoolReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+
+	pool, err := NewGoQueueClientPool(connHost, connPort, testPoolConfig)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer pool.Close()
+
+	_, err = pool.AddJob(1, 60, []byte{'1'})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// Restart the server
+	server.Exit()
+	server = createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	// Requests which are safe to repeat should be retried until a connection is back
+	queues, err := pool.ListQueues()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Empty(queues, "Expected no queues on restarted server")
+
+	// Every connection should be reconnected
+	for i := 0; i < 100; i++ {
+		_, err = pool.AddJob(1, 60, []byte{'1'})
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to add job after server restart: " + err.Error())
+	}
+
+	for i := 0; i < testPoolConfig.Size; i++ {
+		_, err = pool.AddJob(1, 60, []byte{'1'})
+		assert.NoError(err, "Expected all connections to be reconnected")
+	}
+}
+
+func TestClientPoolBlockingReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	config := testPoolConfig
+	config.Size = 1
+	pool, err := NewGoQueueClientPool(connHost, connPort, config)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer pool.Close()
+
+	// A reserve waiting for a job mustn't stop the job being added or the connection passing its health checks
+	reserved := make(chan *GoQueueJob, 1)
+	go func() {
+		job, err := pool.ReserveJob(0)
+		assert.NoError(err, "Unexpected error reserving job")
+		reserved <- job
+	}()
+	time.Sleep(2 * config.HealthCheckInterval)
+
+	id, err := pool.AddJob(1, 60, []byte{'1'})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case job := <-reserved:
+		assert.Equal(id, job.Id, "Incorrect reserved job ID")
+	case <-time.After(time.Second):
+		t.Fatalf("Reserve didn't get the added job")
+	}
+}
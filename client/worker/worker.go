@@ -0,0 +1,379 @@
+// Package worker runs handlers for jobs reserved from a goqueue server.
+//
+// A Worker reserves jobs from the queues it has handlers for and runs the queue's handler for each one.
+// Jobs whose handler succeeds are deleted. Jobs whose handler fails are released to be retried after a backoff,
+// or buried once they've failed too many times. Reservations are touched while their handler runs so jobs
+// which take longer than their TTP aren't handed to another client.
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cswilson90/goqueue/client"
+)
+
+// A Handler handles a job reserved from a queue. Returning an error releases the job to be retried
+// unless the error is from Bury. The context is cancelled if the worker's shutdown runs out of time.
+type Handler func(ctx context.Context, job *client.GoQueueJob) error
+
+// Config configures a Worker. Zero fields are given their default values.
+type Config struct {
+	// Concurrency is the number of jobs from each queue handled at once, each reserved on its own connection.
+	// Defaults to 1.
+	Concurrency int
+	// MaxAttempts is the number of times the worker handles a job before burying it if its handler keeps failing.
+	// Defaults to 3. A job's failures are forgotten if the worker doesn't handle it again within
+	// 10 times MaxBackoff rounded up to a whole second, e.g. because another client reserved it.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the delay before a failed job is retried and the wait between attempts
+	// to reconnect to the server. The delay doubles after each failed attempt. Default to 1 second and 1 minute.
+	// Jobs can only be delayed by whole seconds so retry delays are rounded up.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// A Worker handles jobs reserved from a goqueue server with the handler registered for each queue.
+// Handlers are registered with Handle before the worker is started with Run.
+type Worker struct {
+	host   string
+	port   string
+	config Config
+
+	// mutex protects handlers, running, stopping, failures, which records each job this worker
+	// has failed to handle, and lastExpiry, when failures were last checked for expired entries
+	mutex      sync.Mutex
+	handlers   map[string]Handler
+	running    bool
+	stopping   bool
+	failures   map[uint64]*jobFailures
+	lastExpiry time.Time
+
+	// reserveCtx is cancelled when the worker starts shutting down so no more jobs are reserved
+	reserveCtx    context.Context
+	cancelReserve context.CancelFunc
+	// handlerCtx is cancelled if the worker's shutdown runs out of time
+	handlerCtx     context.Context
+	cancelHandlers context.CancelFunc
+
+	// slots tracks the goroutines reserving and handling jobs
+	slots sync.WaitGroup
+}
+
+// failureExpiryBackoffs is how many times the maximum backoff the worker remembers a job's failures
+// without handling it again.
+const failureExpiryBackoffs = 10
+
+// jobFailures records how many times a job's handler has failed and when it last did.
+type jobFailures struct {
+	attempts    int
+	lastFailure time.Time
+}
+
+// A buryError is a handler error which buries the job instead of retrying it.
+type buryError struct {
+	err error
+}
+
+func (e *buryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *buryError) Unwrap() error {
+	return e.err
+}
+
+// Bury wraps an error returned by a handler so the job is buried straight away instead of being retried.
+func Bury(err error) error {
+	return &buryError{err: err}
+}
+
+// New creates a worker which reserves jobs from the goqueue server specified by the host and port.
+func New(host, port string, config Config) *Worker {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 3
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Minute
+	}
+
+	worker := &Worker{
+		host:     host,
+		port:     port,
+		config:   config,
+		handlers: make(map[string]Handler),
+		failures: make(map[uint64]*jobFailures),
+	}
+	worker.reserveCtx, worker.cancelReserve = context.WithCancel(context.Background())
+	worker.handlerCtx, worker.cancelHandlers = context.WithCancel(context.Background())
+	return worker
+}
+
+// Handle registers the handler for jobs reserved from the named queue, replacing any registered before.
+// Handlers registered once the worker is running aren't used.
+func (w *Worker) Handle(queue string, handler Handler) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.handlers[queue] = handler
+}
+
+// Run connects to the server and handles jobs until the worker is shut down.
+// Returns an error if no handlers are registered, the worker has already been run
+// or the connections can't be made. Connections which fail later are reconnected.
+func (w *Worker) Run() error {
+	w.mutex.Lock()
+	if w.running {
+		w.mutex.Unlock()
+		return fmt.Errorf("Worker has already been run")
+	}
+	if len(w.handlers) == 0 {
+		w.mutex.Unlock()
+		return fmt.Errorf("Worker has no handlers")
+	}
+	w.running = true
+	handlers := make(map[string]Handler, len(w.handlers))
+	for queue, handler := range w.handlers {
+		handlers[queue] = handler
+	}
+	w.mutex.Unlock()
+
+	var conns []*client.GoQueueClient
+	for range handlers {
+		for i := 0; i < w.config.Concurrency; i++ {
+			conn, err := client.NewGoQueueClient(w.host, w.port)
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return fmt.Errorf("Failed to connect to server: %v", err.Error())
+			}
+			conns = append(conns, conn)
+		}
+	}
+
+	for queue, handler := range handlers {
+		for i := 0; i < w.config.Concurrency; i++ {
+			w.slots.Add(1)
+			go w.runSlot(queue, handler, conns[0])
+			conns = conns[1:]
+		}
+	}
+
+	w.slots.Wait()
+	return nil
+}
+
+// Shutdown gracefully stops the worker. No more jobs are reserved and jobs being handled are left to finish.
+// If the context is done before they have finished their handlers' contexts are cancelled, the worker waits for
+// them to return and the context's error is returned.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	w.mutex.Lock()
+	if w.stopping {
+		w.mutex.Unlock()
+		return fmt.Errorf("Worker is already shutting down")
+	}
+	w.stopping = true
+	w.mutex.Unlock()
+
+	w.cancelReserve()
+
+	slotsDone := make(chan struct{})
+	go func() {
+		w.slots.Wait()
+		close(slotsDone)
+	}()
+
+	select {
+	case <-slotsDone:
+		return nil
+	case <-ctx.Done():
+		w.cancelHandlers()
+		<-slotsDone
+		return ctx.Err()
+	}
+}
+
+// runSlot reserves jobs from the queue on its own connection and handles them one at a time until the worker
+// shuts down. If reserving fails the connection is replaced after a backoff.
+func (w *Worker) runSlot(queue string, handler Handler, conn *client.GoQueueClient) {
+	defer w.slots.Done()
+
+	backoff := w.config.MinBackoff
+	for {
+		if conn == nil {
+			var err error
+			conn, err = client.NewGoQueueClient(w.host, w.port)
+			if err != nil {
+				if !w.wait(backoff) {
+					return
+				}
+				backoff = w.nextBackoff(backoff)
+				continue
+			}
+		}
+		conn.ReserveQueue(queue)
+
+		job, err := conn.ReserveJobContext(w.reserveCtx, 0)
+		if err != nil {
+			conn.Close()
+			conn = nil
+			if w.reserveCtx.Err() != nil {
+				return
+			}
+
+			if !w.wait(backoff) {
+				return
+			}
+			backoff = w.nextBackoff(backoff)
+			continue
+		}
+		backoff = w.config.MinBackoff
+
+		// Servers older than protocol version 3 don't say which queue jobs are from
+		if job.Queue == "" {
+			job.Queue = queue
+		}
+		w.handle(conn, handler, job)
+	}
+}
+
+// handle runs the handler for a job, touching the job while it runs, then deletes, releases or buries the job.
+// Errors finishing the job are ignored as its reservation expires if it can't be finished.
+func (w *Worker) handle(conn *client.GoQueueClient, handler Handler, job *client.GoQueueJob) {
+	ctx, cancel := context.WithCancel(w.handlerCtx)
+	touchDone := make(chan struct{})
+	go func() {
+		defer close(touchDone)
+		touchJob(ctx, conn, job)
+	}()
+
+	err := runHandler(ctx, handler, job)
+	cancel()
+	<-touchDone
+
+	if err == nil {
+		w.forget(job)
+		conn.DeleteJob(job)
+		return
+	}
+
+	attempts := w.recordFailure(job)
+	if _, bury := err.(*buryError); bury || attempts >= w.config.MaxAttempts {
+		w.forget(job)
+		conn.BuryJob(job, job.Priority)
+		return
+	}
+
+	conn.ReleaseJob(job, job.Priority, w.retryDelay(attempts))
+}
+
+// runHandler runs the handler for a job, turning a panic into an error.
+func runHandler(ctx context.Context, handler Handler, job *client.GoQueueJob) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("Handler panicked handling job %v: %v", job.Id, r)
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// touchJob touches the job every half of its TTP until the context is cancelled.
+// The server reserves jobs for at least a second so a TTP of 0 is touched as if it were 1.
+func touchJob(ctx context.Context, conn *client.GoQueueClient, job *client.GoQueueJob) {
+	timeout := job.Timeout
+	if timeout == 0 {
+		timeout = 1
+	}
+
+	ticker := time.NewTicker(time.Duration(timeout) * time.Second / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			conn.TouchJobContext(ctx, job)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recordFailure records that the job's handler failed and returns how many times it has failed.
+// Failures of jobs which haven't been handled again for too long are forgotten so they don't build up
+// when jobs are finished by other clients.
+func (w *Worker) recordFailure(job *client.GoQueueJob) int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	expiry := w.failureExpiry()
+	if now.Sub(w.lastExpiry) >= expiry {
+		for id, failures := range w.failures {
+			if now.Sub(failures.lastFailure) >= expiry {
+				delete(w.failures, id)
+			}
+		}
+		w.lastExpiry = now
+	}
+
+	failures, ok := w.failures[job.Id]
+	if !ok {
+		failures = &jobFailures{}
+		w.failures[job.Id] = failures
+	}
+	failures.attempts++
+	failures.lastFailure = now
+	return failures.attempts
+}
+
+// failureExpiry returns how long the failures of a job which isn't handled again are remembered.
+// Retry delays are rounded up to whole seconds so the maximum backoff is too.
+func (w *Worker) failureExpiry() time.Duration {
+	maxDelay := (w.config.MaxBackoff + time.Second - 1) / time.Second * time.Second
+	return failureExpiryBackoffs * maxDelay
+}
+
+// forget forgets how many times the job's handler has failed once the job is finished with.
+func (w *Worker) forget(job *client.GoQueueJob) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.failures, job.Id)
+}
+
+// retryDelay returns the delay in seconds before a job which has failed the given number of times is retried.
+func (w *Worker) retryDelay(attempts int) uint32 {
+	delay := w.config.MinBackoff
+	for i := 1; i < attempts; i++ {
+		delay = w.nextBackoff(delay)
+	}
+	return uint32((delay + time.Second - 1) / time.Second)
+}
+
+// wait waits for the backoff to pass. Returns false if the worker started shutting down first.
+func (w *Worker) wait(backoff time.Duration) bool {
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-w.reserveCtx.Done():
+		return false
+	}
+}
+
+// nextBackoff returns the backoff to use after the given one, which is double it up to the maximum.
+func (w *Worker) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > w.config.MaxBackoff {
+		backoff = w.config.MaxBackoff
+	}
+	return backoff
+}
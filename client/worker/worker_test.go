@@ -0,0 +1,262 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cswilson90/goqueue/client"
+	"github.com/cswilson90/goqueue/internal/server"
+)
+
+const (
+	connHost = "localhost"
+	connPort = "11224"
+)
+
+// testConfig is a worker config which retries jobs quickly for tests
+var testConfig = Config{
+	Concurrency: 2,
+	MaxAttempts: 2,
+	MinBackoff:  10 * time.Millisecond,
+	MaxBackoff:  50 * time.Millisecond,
+}
+
+// createServer is a helper function to create a test server
+func createServer(t *testing.T) *server.GoJobServer {
+	server, err := server.NewGoJobServer(connHost, connPort)
+	if err != nil {
+		t.Fatalf("Failed to create test server")
+	}
+	return server
+}
+
+// createClient is a helper function to create a test connection to the server
+func createClient(t *testing.T) *client.GoQueueClient {
+	conn, err := client.NewGoQueueClient(connHost, connPort)
+	if err != nil {
+		t.Fatalf("Failed to create test client")
+	}
+	return conn
+}
+
+// runWorker is a helper function which runs the worker and returns a channel which receives Run's result
+func runWorker(worker *Worker) chan error {
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- worker.Run()
+	}()
+	return runErr
+}
+
+// waitForStatus is a helper function which waits for the job to have the given status
+func waitForStatus(t *testing.T, conn *client.GoQueueClient, jobID uint64, status string) {
+	var err error
+	for i := 0; i < 500; i++ {
+		var job *client.GoQueueJob
+		job, err = conn.PeekJob(jobID)
+		if err == nil && job.Status == status {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("status is %v", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %v never became %v: %v", jobID, status, err)
+}
+
+func TestWorker(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	conn := createClient(t)
+	defer conn.Close()
+
+	var mutex sync.Mutex
+	handled := make(map[string]int)
+	record := func(job *client.GoQueueJob) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled[string(job.Data)]++
+	}
+
+	worker := New(connHost, connPort, testConfig)
+	worker.Handle("queue-1", func(ctx context.Context, job *client.GoQueueJob) error {
+		assert.Equal("queue-1", job.Queue, "Incorrect queue of handled job")
+		record(job)
+		switch string(job.Data) {
+		case "fail":
+			return fmt.Errorf("Failed")
+		case "bury":
+			return Bury(fmt.Errorf("Failed"))
+		case "panic":
+			panic("Failed")
+		}
+		return nil
+	})
+	worker.Handle("queue-2", func(ctx context.Context, job *client.GoQueueJob) error {
+		record(job)
+		return nil
+	})
+	runErr := runWorker(worker)
+
+	jobIDs := make(map[string]uint64)
+	for _, jobData := range []string{"ok", "fail", "bury", "panic"} {
+		conn.AddQueue("queue-1")
+		id, err := conn.AddJob(1, 60, []byte(jobData))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		jobIDs[jobData] = id
+	}
+	conn.AddQueue("queue-2")
+	otherID, err := conn.AddJob(1, 60, []byte("other"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Failed jobs are retried until they've been handled the maximum number of times then buried
+	waitForStatus(t, conn, jobIDs["fail"], "buried")
+	waitForStatus(t, conn, jobIDs["panic"], "buried")
+	waitForStatus(t, conn, jobIDs["bury"], "buried")
+
+	// Successful jobs are deleted
+	for _, id := range []uint64{jobIDs["ok"], otherID} {
+		_, err = conn.PeekJob(id)
+		assert.Equal(client.NotFoundError, err, "Expected successful job to be deleted")
+	}
+
+	mutex.Lock()
+	assert.Equal(map[string]int{"ok": 1, "fail": 2, "bury": 1, "panic": 2, "other": 1}, handled, "Incorrect number of times jobs were handled")
+	mutex.Unlock()
+
+	err = worker.Shutdown(context.Background())
+	assert.NoError(err, "Unexpected error shutting down worker")
+	assert.NoError(<-runErr, "Unexpected error running worker")
+}
+
+func TestWorkerTouch(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	conn := createClient(t)
+	defer conn.Close()
+	conn.AddQueue("queue-1")
+
+	// The jobs take longer than their TTP so they must be touched to stay reserved.
+	// A TTP of 0 is reserved for the server's minimum of 1 second.
+	started := make(chan struct{}, 2)
+	worker := New(connHost, connPort, testConfig)
+	worker.Handle("queue-1", func(ctx context.Context, job *client.GoQueueJob) error {
+		started <- struct{}{}
+		time.Sleep(1500 * time.Millisecond)
+		return nil
+	})
+	runErr := runWorker(worker)
+
+	var ids []uint64
+	for _, ttp := range []uint32{0, 1} {
+		id, err := conn.AddJob(1, ttp, []byte{'1'})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	<-started
+	<-started
+	time.Sleep(1200 * time.Millisecond)
+	for _, id := range ids {
+		job, err := conn.PeekJob(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assert.Equal("reserved", job.Status, "Expected job to still be reserved after its TTP")
+	}
+
+	// The worker should wait for the jobs to finish when shutting down
+	err := worker.Shutdown(context.Background())
+	assert.NoError(err, "Unexpected error shutting down worker")
+	assert.NoError(<-runErr, "Unexpected error running worker")
+
+	for _, id := range ids {
+		_, err = conn.PeekJob(id)
+		assert.Equal(client.NotFoundError, err, "Expected job to be deleted")
+	}
+}
+
+func TestWorkerShutdownTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	conn := createClient(t)
+	defer conn.Close()
+	conn.AddQueue("queue-1")
+
+	started := make(chan struct{})
+	worker := New(connHost, connPort, testConfig)
+	worker.Handle("queue-1", func(ctx context.Context, job *client.GoQueueJob) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	runErr := runWorker(worker)
+
+	id, err := conn.AddJob(1, 60, []byte{'1'})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-started
+
+	// A handler still running when the shutdown runs out of time is cancelled and its job released
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = worker.Shutdown(ctx)
+	assert.Equal(context.DeadlineExceeded, err, "Expected deadline exceeded error shutting down worker")
+	assert.NoError(<-runErr, "Unexpected error running worker")
+
+	job, err := conn.PeekJob(id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal("delayed", job.Status, "Expected cancelled job to be released to be retried")
+}
+
+func TestWorkerNoHandlers(t *testing.T) {
+	worker := New(connHost, connPort, testConfig)
+	assert.Error(t, worker.Run(), "Expected error running worker with no handlers")
+}
+
+func TestWorkerForgetsOldFailures(t *testing.T) {
+	worker := New(connHost, connPort, Config{MaxBackoff: time.Millisecond})
+
+	job := &client.GoQueueJob{Id: 1}
+	assert.Equal(t, 1, worker.recordFailure(job), "Incorrect number of failures recorded")
+	assert.Equal(t, 2, worker.recordFailure(job), "Incorrect number of failures recorded")
+
+	// Failures of jobs which aren't handled again for long enough are forgotten
+	worker.mutex.Lock()
+	worker.failures[job.Id].lastFailure = time.Now().Add(-worker.failureExpiry())
+	worker.lastExpiry = time.Time{}
+	worker.mutex.Unlock()
+	worker.recordFailure(&client.GoQueueJob{Id: 2})
+
+	worker.mutex.Lock()
+	_, ok := worker.failures[job.Id]
+	worker.mutex.Unlock()
+	assert.False(t, ok, "Expected old failures to be forgotten")
+}
@@ -1,16 +1,63 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/cswilson90/goqueue/internal/config"
+	"github.com/cswilson90/goqueue/internal/logging"
 	"github.com/cswilson90/goqueue/internal/server"
 )
 
 func main() {
-	server, err := server.NewGoJobServer("localhost", "11223")
+	serverConfig, err := config.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal("Invalid configuration: " + err.Error())
+	}
+
+	logging.SetLevel(serverConfig.Level())
+	logging.Infof("Starting server with config: %v", serverConfig)
+
+	server, err := server.NewGoJobServerWithConfig(serverConfig)
 	if err != nil {
 		log.Fatal("Failed to create server: " + err.Error())
 	}
 
-	server.Run()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	logging.Infof("Listening on %v", server.Address())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run()
+	}()
+
+	exitCode := 0
+	select {
+	case received := <-signals:
+		logging.Infof("Received %v, shutting down", received)
+	case err := <-runErr:
+		logging.Errorf("Failed to accept connections, shutting down: %v", err.Error())
+		exitCode = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(serverConfig.ShutdownTimeout))
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		logging.Errorf("Failed to shut down cleanly: %v", err.Error())
+		exitCode = 1
+	}
+
+	logging.Infof("Server stopped")
+	cancel()
+	os.Exit(exitCode)
 }
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cswilson90/goqueue/internal/logging"
+)
+
+// Names of the stores jobs can be held in.
+const (
+	StoreMemory = "memory"
+	StoreLog    = "log"
+	StoreFile   = "file"
+)
+
+// Names of the policies for syncing a persistent store to disk.
+const (
+	SyncAlways = "always"
+	SyncEvery  = "every"
+	SyncNever  = "never"
+)
+
+// Names of the policies for jobs reserved by a client when it disconnects.
+const (
+	DisconnectRelease = "release"
+	DisconnectExpire  = "expire"
+)
+
+// A Config configures a GoJobServer.
+// It can be loaded from a JSON file whose keys are the field's json tags, with durations written as strings e.g. "5s".
+type Config struct {
+	// Host and Port are the address the server listens on.
+	Host string `json:"host"`
+	Port string `json:"port"`
+
+	// Store is the kind of store jobs are held in: memory, log or file.
+	// DataDir is the directory the log and file stores keep their files in.
+	Store   string `json:"store"`
+	DataDir string `json:"data_dir"`
+
+	// SyncPolicy controls when a persistent store is synced to disk: always, every or never.
+	// SyncInterval is how often the store is synced with the every policy.
+	SyncPolicy   string   `json:"sync_policy"`
+	SyncInterval Duration `json:"sync_interval"`
+
+	// SnapshotInterval and SnapshotLogSize control how often the log store is compacted.
+	// Zero values disable compaction for that trigger.
+	SnapshotInterval Duration `json:"snapshot_interval"`
+	SnapshotLogSize  int64    `json:"snapshot_log_size"`
+
+	// MaxConnections is the number of clients which can be connected at once, or 0 for no limit.
+	// MaxJobSize is the largest job data in bytes which can be added, or 0 for only the 1 GiB limit on all jobs.
+	// MaxBatchJobs is the most jobs which can be added in one batch, or 0 for only the limit of 10000 on all batches.
+	// MaxBatchSize is the largest total job data in bytes which can be added in one batch,
+	// or 0 for only the 1 GiB limit on all batches.
+	MaxConnections int    `json:"max_connections"`
+	MaxJobSize     uint32 `json:"max_job_size"`
+	MaxBatchJobs   uint32 `json:"max_batch_jobs"`
+	MaxBatchSize   uint32 `json:"max_batch_size"`
+
+	// DefaultTTP is the TTP in seconds given to jobs added with a TTP of 0.
+	DefaultTTP uint32 `json:"default_ttp"`
+
+	// DisconnectPolicy decides what happens to the jobs a client has reserved when it disconnects:
+	// release returns them to their ready queues straight away and expire leaves them until their TTP expires.
+	DisconnectPolicy string `json:"disconnect_policy"`
+
+	// MetricsAddress is the address e.g. "localhost:9100" an HTTP server listens on to serve
+	// Prometheus metrics at /metrics, or empty to not serve metrics.
+	MetricsAddress string `json:"metrics_address"`
+
+	// ShutdownTimeout is how long the server waits for commands to finish when shutting down
+	// before closing connections.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// LogLevel is the lowest level of message logged: debug, info, warn or error.
+	LogLevel string `json:"log_level"`
+}
+
+// A Duration is a time.Duration which is written as a string e.g. "1m30s" in config files and flags.
+type Duration time.Duration
+
+// Default returns the default config.
+func Default() *Config {
+	return &Config{
+		Host:             "localhost",
+		Port:             "11223",
+		Store:            StoreMemory,
+		SyncPolicy:       SyncAlways,
+		SyncInterval:     Duration(time.Second),
+		DisconnectPolicy: DisconnectRelease,
+		ShutdownTimeout:  Duration(30 * time.Second),
+		LogLevel:         "info",
+	}
+}
+
+// Parse creates a config from the command line arguments.
+// If the -config flag names a config file it is loaded over the defaults and any other flags override it.
+// Returns flag.ErrHelp if help was requested or an error if the arguments, file or resulting config are invalid.
+func Parse(args []string) (*Config, error) {
+	// Find the config file before loading it so flags can override it
+	var configPath string
+	err := newFlagSet(Default(), &configPath).Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Default()
+	if configPath != "" {
+		err = config.loadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = newFlagSet(config, &configPath).Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// newFlagSet creates a flag set which parses flags into the given config and config file path.
+func newFlagSet(config *Config, configPath *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("goqueue", flag.ContinueOnError)
+
+	flags.StringVar(configPath, "config", "", "JSON config file to load before applying other flags")
+	flags.StringVar(&config.Host, "host", config.Host, "host to listen on")
+	flags.StringVar(&config.Port, "port", config.Port, "port to listen on")
+	flags.StringVar(&config.Store, "store", config.Store, "store to hold jobs in: memory, log or file")
+	flags.StringVar(&config.DataDir, "data-dir", config.DataDir, "directory the log or file store keeps its files in")
+	flags.StringVar(&config.SyncPolicy, "sync-policy", config.SyncPolicy, "when the store is synced to disk: always, every or never")
+	flags.Var(&config.SyncInterval, "sync-interval", "how often the store is synced with the every sync policy")
+	flags.Var(&config.SnapshotInterval, "snapshot-interval", "how often the log store is compacted, 0 for never")
+	flags.Int64Var(&config.SnapshotLogSize, "snapshot-log-size", config.SnapshotLogSize, "log size in bytes which triggers compacting the log store, 0 for no limit")
+	flags.IntVar(&config.MaxConnections, "max-connections", config.MaxConnections, "maximum number of connected clients, 0 for no limit")
+	flags.Var((*uint32Value)(&config.MaxJobSize), "max-job-size", "maximum job data size in bytes, 0 for the 1 GiB limit on all jobs")
+	flags.Var((*uint32Value)(&config.MaxBatchJobs), "max-batch-jobs", "maximum number of jobs in a batch, 0 for the limit of 10000 on all batches")
+	flags.Var((*uint32Value)(&config.MaxBatchSize), "max-batch-size", "maximum total job data size in bytes of a batch, 0 for the 1 GiB limit on all batches")
+	flags.Var((*uint32Value)(&config.DefaultTTP), "default-ttp", "TTP in seconds given to jobs added with a TTP of 0")
+	flags.StringVar(&config.DisconnectPolicy, "disconnect-policy", config.DisconnectPolicy, "what happens to a disconnected client's reserved jobs: release or expire")
+	flags.StringVar(&config.MetricsAddress, "metrics-address", config.MetricsAddress, "address to serve Prometheus metrics on at /metrics, empty to disable")
+	flags.Var(&config.ShutdownTimeout, "shutdown-timeout", "how long to wait for commands to finish when shutting down")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "lowest level of message logged: debug, info, warn or error")
+
+	return flags
+}
+
+// loadFile loads the JSON config file at the given path over the config.
+func (c *Config) loadFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read config file: %v", err.Error())
+	}
+
+	err = json.Unmarshal(contents, c)
+	if err != nil {
+		return fmt.Errorf("Failed to parse config file %v: %v", path, err.Error())
+	}
+
+	return nil
+}
+
+// Validate returns an error describing the first invalid setting in the config.
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("Host must not be empty")
+	}
+
+	port, err := strconv.ParseUint(c.Port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port %q", c.Port)
+	}
+	c.Port = strconv.FormatUint(port, 10)
+
+	switch c.Store {
+	case StoreMemory:
+	case StoreLog, StoreFile:
+		if c.DataDir == "" {
+			return fmt.Errorf("The %v store needs a data directory", c.Store)
+		}
+	default:
+		return fmt.Errorf("Unknown store %q", c.Store)
+	}
+
+	switch c.SyncPolicy {
+	case SyncAlways, SyncNever:
+	case SyncEvery:
+		if c.SyncInterval <= 0 {
+			return fmt.Errorf("The every sync policy needs a positive sync interval")
+		}
+	default:
+		return fmt.Errorf("Unknown sync policy %q", c.SyncPolicy)
+	}
+
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("Snapshot interval must not be negative")
+	}
+	if c.SnapshotLogSize < 0 {
+		return fmt.Errorf("Snapshot log size must not be negative")
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("Max connections must not be negative")
+	}
+	if c.DisconnectPolicy != DisconnectRelease && c.DisconnectPolicy != DisconnectExpire {
+		return fmt.Errorf("Unknown disconnect policy %q", c.DisconnectPolicy)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("Shutdown timeout must not be negative")
+	}
+
+	_, err = logging.ParseLevel(c.LogLevel)
+	return err
+}
+
+// Level returns the log level of the config, which must be valid.
+func (c *Config) Level() logging.Level {
+	level, _ := logging.ParseLevel(c.LogLevel)
+	return level
+}
+
+// String describes the config for reporting at startup.
+func (c *Config) String() string {
+	settings := []string{
+		"address=" + c.Host + ":" + c.Port,
+		"store=" + c.Store,
+	}
+	if c.Store != StoreMemory {
+		settings = append(settings,
+			"data_dir="+c.DataDir,
+			"sync_policy="+c.SyncPolicy,
+		)
+		if c.SyncPolicy == SyncEvery {
+			settings = append(settings, "sync_interval="+c.SyncInterval.String())
+		}
+	}
+	if c.Store == StoreLog {
+		settings = append(settings,
+			"snapshot_interval="+c.SnapshotInterval.String(),
+			fmt.Sprintf("snapshot_log_size=%v", c.SnapshotLogSize),
+		)
+	}
+	settings = append(settings,
+		fmt.Sprintf("max_connections=%v", c.MaxConnections),
+		fmt.Sprintf("max_job_size=%v", c.MaxJobSize),
+		fmt.Sprintf("max_batch_jobs=%v", c.MaxBatchJobs),
+		fmt.Sprintf("max_batch_size=%v", c.MaxBatchSize),
+		fmt.Sprintf("default_ttp=%v", c.DefaultTTP),
+		"disconnect_policy="+c.DisconnectPolicy,
+		"metrics_address="+c.MetricsAddress,
+		"shutdown_timeout="+c.ShutdownTimeout.String(),
+		"log_level="+c.LogLevel,
+	)
+
+	return strings.Join(settings, " ")
+}
+
+// String returns the duration written as a string e.g. "1m30s".
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses the duration from a flag.
+func (d *Duration) Set(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// UnmarshalJSON parses the duration from a JSON string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return fmt.Errorf("Durations must be strings e.g. \"5s\"")
+	}
+	return d.Set(value)
+}
+
+// MarshalJSON writes the duration as a JSON string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// A uint32Value is a flag.Value for uint32 settings.
+type uint32Value uint32
+
+// String returns the value as a decimal string.
+func (v *uint32Value) String() string {
+	return strconv.FormatUint(uint64(*v), 10)
+}
+
+// Set parses the value from a flag.
+func (v *uint32Value) Set(value string) error {
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v = uint32Value(parsed)
+	return nil
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseDefaults(t *testing.T) {
+	config, err := Parse([]string{})
+	if err != nil {
+		t.Fatalf("Failed to parse empty arguments: " + err.Error())
+	}
+
+	if *config != *Default() {
+		t.Errorf("Expected default config, got %v", config)
+	}
+}
+
+func TestParseFileAndFlags(t *testing.T) {
+	file, err := ioutil.TempFile("", "goqueue-config")
+	if err != nil {
+		t.Fatalf("Failed to create config file: " + err.Error())
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{
+		"port": "11224",
+		"store": "log",
+		"data_dir": "/tmp/goqueue",
+		"sync_policy": "every",
+		"sync_interval": "250ms",
+		"max_job_size": 1024,
+		"max_batch_jobs": 100,
+		"max_batch_size": 4096,
+		"log_level": "debug"
+	}`)
+	file.Close()
+
+	config, err := Parse([]string{"-port", "11225", "-config", file.Name(), "-default-ttp", "60"})
+	if err != nil {
+		t.Fatalf("Failed to parse config: " + err.Error())
+	}
+
+	expected := Default()
+	expected.Port = "11225"
+	expected.Store = StoreLog
+	expected.DataDir = "/tmp/goqueue"
+	expected.SyncPolicy = SyncEvery
+	expected.SyncInterval = Duration(250 * time.Millisecond)
+	expected.MaxJobSize = 1024
+	expected.MaxBatchJobs = 100
+	expected.MaxBatchSize = 4096
+	expected.DefaultTTP = 60
+	expected.LogLevel = "debug"
+	if *config != *expected {
+		t.Errorf("Expected config %v, got %v", expected, config)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	invalidArgs := [][]string{
+		{"-port", "http"},
+		{"-port", "70000"},
+		{"-store", "disk"},
+		{"-store", "file"},
+		{"-sync-policy", "sometimes"},
+		{"-sync-policy", "every", "-sync-interval", "0s"},
+		{"-sync-interval", "soon"},
+		{"-max-connections", "-1"},
+		{"-max-batch-jobs", "-1"},
+		{"-disconnect-policy", "keep"},
+		{"-log-level", "loud"},
+		{"-config", "/nonexistent/goqueue.json"},
+		{"-unknown"},
+	}
+
+	for _, args := range invalidArgs {
+		_, err := Parse(args)
+		if err == nil {
+			t.Errorf("Expected error parsing %v", args)
+		}
+	}
+}
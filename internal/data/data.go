@@ -5,12 +5,17 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"regexp"
 
 	"github.com/cswilson90/goqueue/internal/queue"
 )
 
+// ProtocolVersion is the latest version of the client protocol.
+// Clients which don't negotiate a version with the VERSION command use version 1.
+const ProtocolVersion uint32 = 3
+
 var isUpperCaseString = regexp.MustCompile(`^[A-Z]+$`).MatchString
 
 // ParseString parses a null terminated string from the client.
@@ -100,6 +105,43 @@ func ParseJobData(cmdReader *bufio.Reader) ([]byte, error) {
 	return data, nil
 }
 
+// A JobTooLargeError is returned by ParseJobDataLimited when the job data is larger than allowed.
+type JobTooLargeError struct {
+	Size    uint32
+	MaxSize uint32
+}
+
+func (e *JobTooLargeError) Error() string {
+	return fmt.Sprintf("Job data of %v bytes is larger than the maximum of %v", e.Size, e.MaxSize)
+}
+
+// ParseJobDataLimited parses the data for a job from the client if it's no larger than the maximum size.
+// Larger data is discarded without being stored and a JobTooLargeError is returned so the client
+// can be told while the following commands are still read correctly.
+// Returns an error if no data could be parsed.
+func ParseJobDataLimited(cmdReader *bufio.Reader, maxSize uint32) ([]byte, error) {
+	dataLength, err := ParseUint32(cmdReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataLength > maxSize {
+		_, err = io.CopyN(ioutil.Discard, cmdReader, int64(dataLength))
+		if err != nil {
+			return nil, err
+		}
+		return nil, &JobTooLargeError{Size: dataLength, MaxSize: maxSize}
+	}
+
+	data := make([]byte, dataLength)
+	_, err = io.ReadFull(cmdReader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
 // PackJobData packs job data into a byte array that can be sent to the client.
 func PackJobData(jobData []byte) ([]byte, error) {
 	if len(jobData) > math.MaxUint32 {
@@ -110,8 +152,9 @@ func PackJobData(jobData []byte) ([]byte, error) {
 	return append(dataLength, jobData...), nil
 }
 
-// ParseJob parses a job and it's metadata from the client.
-func ParseJob(cmdReader *bufio.Reader) (*queue.GoJobData, error) {
+// ParseJob parses a job and it's metadata from the client packed with the given protocol version.
+// Jobs only include the name of their queue from version 3.
+func ParseJob(cmdReader *bufio.Reader, version uint32) (*queue.GoJobData, error) {
 	id, err := ParseUint64(cmdReader)
 	if err != nil {
 		return nil, err
@@ -132,6 +175,14 @@ func ParseJob(cmdReader *bufio.Reader) (*queue.GoJobData, error) {
 		return nil, err
 	}
 
+	var queueName string
+	if version >= 3 {
+		queueName, err = ParseString(cmdReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	jobData, err := ParseJobData(cmdReader)
 	if err != nil {
 		return nil, err
@@ -140,14 +191,16 @@ func ParseJob(cmdReader *bufio.Reader) (*queue.GoJobData, error) {
 	return &queue.GoJobData{
 		Id:       id,
 		Priority: priority,
+		Queue:    queueName,
 		Timeout:  ttp,
 		Status:   status,
 		Data:     jobData,
 	}, nil
 }
 
-// PackJob packs all the data and metadata for a job into a byte array to be sent to the client.
-func PackJob(job *queue.GoJobData) ([]byte, error) {
+// PackJob packs all the data and metadata for a job into a byte array to be sent to a client
+// using the given protocol version. The name of the job's queue is only included from version 3.
+func PackJob(job *queue.GoJobData, version uint32) ([]byte, error) {
 	allData := make([]byte, 0)
 	// Job ID
 	allData = append(allData, PackUint64(job.Id)...)
@@ -157,6 +210,10 @@ func PackJob(job *queue.GoJobData) ([]byte, error) {
 	allData = append(allData, PackUint32(job.Timeout)...)
 	// Status
 	allData = append(allData, PackString(job.Status)...)
+	// Queue
+	if version >= 3 {
+		allData = append(allData, PackString(job.Queue)...)
+	}
 
 	// Job Data
 	jobData, err := PackJobData(job.Data)
@@ -167,3 +224,45 @@ func PackJob(job *queue.GoJobData) ([]byte, error) {
 
 	return allData, nil
 }
+
+// A Stat is a single named statistic.
+type Stat struct {
+	Name  string
+	Value uint64
+}
+
+// ParseStats parses a list of statistics from the client.
+// Returns an error if the statistics can't be parsed.
+func ParseStats(cmdReader *bufio.Reader) ([]Stat, error) {
+	count, err := ParseUint32(cmdReader)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]Stat, 0, count)
+	for i := uint32(0); i < count; i++ {
+		name, err := ParseString(cmdReader)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := ParseUint64(cmdReader)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, Stat{Name: name, Value: value})
+	}
+
+	return stats, nil
+}
+
+// PackStats packs a list of statistics into a byte array to be sent to the client.
+func PackStats(stats []Stat) []byte {
+	allData := PackUint32(uint32(len(stats)))
+	for _, stat := range stats {
+		allData = append(allData, PackString(stat.Name)...)
+		allData = append(allData, PackUint64(stat.Value)...)
+	}
+	return allData
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// A Level is the severity of a log message.
+type Level int32
+
+const (
+	// Debug messages trace individual connections and commands.
+	Debug Level = iota
+	// Info messages report what the server is doing such as starting up.
+	Info
+	// Warn messages report problems the server has recovered from.
+	Warn
+	// Error messages report failures.
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+// level is the lowest level of message which is logged
+var level = int32(Info)
+
+// ParseLevel parses the name of a level e.g. "info".
+// Returns an error if the name isn't a level.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
+		}
+	}
+	return Info, fmt.Errorf("Unknown log level %q", name)
+}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// SetLevel sets the lowest level of message which is logged.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Debugf logs a debug message.
+func Debugf(format string, v ...interface{}) {
+	logf(Debug, "Debug: ", format, v...)
+}
+
+// Infof logs an informational message.
+func Infof(format string, v ...interface{}) {
+	logf(Info, "", format, v...)
+}
+
+// Warnf logs a warning.
+func Warnf(format string, v ...interface{}) {
+	logf(Warn, "Warning: ", format, v...)
+}
+
+// Errorf logs an error.
+func Errorf(format string, v ...interface{}) {
+	logf(Error, "Error: ", format, v...)
+}
+
+// logf logs a message with the given prefix if its level is being logged.
+func logf(l Level, prefix string, format string, v ...interface{}) {
+	if int32(l) < atomic.LoadInt32(&level) {
+		return
+	}
+	log.Printf(prefix+format, v...)
+}
@@ -0,0 +1,233 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cswilson90/goqueue/internal/queue"
+)
+
+// waitBuckets are the upper bounds in seconds of the histogram buckets for reserve wait
+// and time in queue, from a millisecond to an hour.
+var waitBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// jobStatuses are the statuses jobs are counted by.
+var jobStatuses = []string{"ready", "reserved", "delayed", "buried"}
+
+// Metrics collects metrics about a GoJobQueue and serves them over HTTP in the Prometheus text format.
+// Counters and histograms are collected through the queue's hooks and job counts are read from
+// the queue when the metrics are scraped.
+type Metrics struct {
+	queue *queue.GoJobQueue
+
+	// mutex protects queues
+	mutex  sync.Mutex
+	queues map[string]*queueMetrics
+}
+
+// queueMetrics are the metrics collected through hooks for a single named queue.
+type queueMetrics struct {
+	added    uint64
+	reserved uint64
+	released uint64
+	buried   uint64
+	timedOut uint64
+	deleted  uint64
+
+	reserveWait *histogram
+	timeInQueue *histogram
+}
+
+// New creates Metrics for the given queue and sets its hooks to collect them.
+func New(goJobQueue *queue.GoJobQueue) *Metrics {
+	metrics := &Metrics{
+		queue:  goJobQueue,
+		queues: make(map[string]*queueMetrics),
+	}
+	goJobQueue.SetHooks(metrics)
+	return metrics
+}
+
+// JobAdded counts a job added to the named queue.
+func (m *Metrics) JobAdded(queueName string) {
+	m.update(queueName, func(q *queueMetrics) { q.added++ })
+}
+
+// JobReserved counts a job reserved from the named queue and observes how long it was ready.
+func (m *Metrics) JobReserved(queueName string, timeInQueue time.Duration) {
+	m.update(queueName, func(q *queueMetrics) {
+		q.reserved++
+		q.timeInQueue.observe(timeInQueue.Seconds())
+	})
+}
+
+// ReserveWaited observes how long a client waited to reserve a job from the named queue.
+func (m *Metrics) ReserveWaited(queueName string, wait time.Duration) {
+	m.update(queueName, func(q *queueMetrics) { q.reserveWait.observe(wait.Seconds()) })
+}
+
+// JobReleased counts a job released back to the named queue.
+func (m *Metrics) JobReleased(queueName string) {
+	m.update(queueName, func(q *queueMetrics) { q.released++ })
+}
+
+// JobBuried counts a reserved job buried in the named queue.
+func (m *Metrics) JobBuried(queueName string) {
+	m.update(queueName, func(q *queueMetrics) { q.buried++ })
+}
+
+// ReservationTimedOut counts an expired reservation of a job in the named queue.
+func (m *Metrics) ReservationTimedOut(queueName string) {
+	m.update(queueName, func(q *queueMetrics) { q.timedOut++ })
+}
+
+// JobDeleted counts a job deleted from the named queue.
+func (m *Metrics) JobDeleted(queueName string) {
+	m.update(queueName, func(q *queueMetrics) { q.deleted++ })
+}
+
+// update changes the metrics of the named queue, creating them if they don't exist.
+func (m *Metrics) update(queueName string, change func(*queueMetrics)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	metrics, ok := m.queues[queueName]
+	if !ok {
+		metrics = &queueMetrics{
+			reserveWait: newHistogram(waitBuckets),
+			timeInQueue: newHistogram(waitBuckets),
+		}
+		m.queues[queueName] = metrics
+	}
+	change(metrics)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writer := bufio.NewWriter(w)
+	m.writeGauges(writer)
+	m.writeCollected(writer)
+	writer.Flush()
+}
+
+// writeGauges writes the number of jobs and waiting clients in each queue.
+func (m *Metrics) writeGauges(writer *bufio.Writer) {
+	queueNames := m.queue.QueueNames()
+	stats := make([]*queue.QueueStats, len(queueNames))
+	for i, queueName := range queueNames {
+		stats[i] = m.queue.QueueStats(queueName)
+	}
+
+	writeHeader(writer, "goqueue_jobs", "gauge", "Number of jobs in each queue by status.")
+	for i, queueName := range queueNames {
+		counts := []uint64{stats[i].Ready, stats[i].Reserved, stats[i].Delayed, stats[i].Buried}
+		for j, status := range jobStatuses {
+			fmt.Fprintf(writer, "goqueue_jobs{queue=%v,status=%q} %v\n", quoteLabel(queueName), status, counts[j])
+		}
+	}
+
+	writeHeader(writer, "goqueue_waiting_reservers", "gauge", "Number of clients waiting to reserve a job from each queue.")
+	for i, queueName := range queueNames {
+		fmt.Fprintf(writer, "goqueue_waiting_reservers{queue=%v} %v\n", quoteLabel(queueName), stats[i].Waiting)
+	}
+}
+
+// writeCollected writes the counters and histograms collected through hooks.
+func (m *Metrics) writeCollected(writer *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	queueNames := make([]string, 0, len(m.queues))
+	for queueName := range m.queues {
+		queueNames = append(queueNames, queueName)
+	}
+	sort.Strings(queueNames)
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(*queueMetrics) uint64
+	}{
+		{"goqueue_jobs_added_total", "Number of jobs added to each queue.", func(q *queueMetrics) uint64 { return q.added }},
+		{"goqueue_jobs_reserved_total", "Number of jobs reserved from each queue.", func(q *queueMetrics) uint64 { return q.reserved }},
+		{"goqueue_jobs_released_total", "Number of reserved jobs released back to each queue.", func(q *queueMetrics) uint64 { return q.released }},
+		{"goqueue_jobs_buried_total", "Number of reserved jobs buried in each queue.", func(q *queueMetrics) uint64 { return q.buried }},
+		{"goqueue_reservations_timed_out_total", "Number of reservations which expired in each queue.", func(q *queueMetrics) uint64 { return q.timedOut }},
+		{"goqueue_jobs_deleted_total", "Number of jobs deleted from each queue.", func(q *queueMetrics) uint64 { return q.deleted }},
+	}
+	for _, counter := range counters {
+		writeHeader(writer, counter.name, "counter", counter.help)
+		for _, queueName := range queueNames {
+			fmt.Fprintf(writer, "%v{queue=%v} %v\n", counter.name, quoteLabel(queueName), counter.value(m.queues[queueName]))
+		}
+	}
+
+	writeHeader(writer, "goqueue_reserve_wait_seconds", "histogram", "Time clients waited to reserve a job from each queue.")
+	for _, queueName := range queueNames {
+		m.queues[queueName].reserveWait.write(writer, "goqueue_reserve_wait_seconds", queueName)
+	}
+
+	writeHeader(writer, "goqueue_job_time_in_queue_seconds", "histogram", "Time jobs were ready before being reserved from each queue.")
+	for _, queueName := range queueNames {
+		m.queues[queueName].timeInQueue.write(writer, "goqueue_job_time_in_queue_seconds", queueName)
+	}
+}
+
+// writeHeader writes the help and type lines for a metric.
+func writeHeader(writer *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(writer, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(writer, "# TYPE %v %v\n", name, metricType)
+}
+
+// labelEscaper escapes the characters which must be escaped in a label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel escapes and quotes a label value.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// A histogram counts observations in cumulative buckets.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogram creates a histogram with buckets with the given upper bounds, which must be in increasing order.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// observe adds an observation to the histogram.
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// write writes the histogram's buckets, sum and count with the given metric name and queue label.
+func (h *histogram) write(writer *bufio.Writer, name, queueName string) {
+	label := quoteLabel(queueName)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(writer, "%v_bucket{queue=%v,le=\"%v\"} %v\n", name, label, bound, h.counts[i])
+	}
+	fmt.Fprintf(writer, "%v_bucket{queue=%v,le=\"+Inf\"} %v\n", name, label, h.count)
+	fmt.Fprintf(writer, "%v_sum{queue=%v} %v\n", name, label, h.sum)
+	fmt.Fprintf(writer, "%v_count{queue=%v} %v\n", name, label, h.count)
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cswilson90/goqueue/internal/queue"
+)
+
+func TestMetrics(t *testing.T) {
+	goJobQueue := queue.NewGoJobQueue()
+	metrics := New(goJobQueue)
+
+	for i := 0; i < 3; i++ {
+		goJobQueue.AddJob(&queue.GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue\"1", Timeout: 60})
+	}
+	job, _ := goJobQueue.ReserveJobWait(context.Background(), "queue\"1", 1)
+	goJobQueue.ReleaseJob(job.Id, 1, 1, 0)
+	job, _ = goJobQueue.ReserveJobWait(context.Background(), "queue\"1", 1)
+	goJobQueue.DeleteJob(job.Id)
+	job, _ = goJobQueue.ReserveJob("queue\"1", 1)
+	goJobQueue.BuryJob(job.Id, 1, 1)
+	goJobQueue.ReserveJob("queue\"1", 1)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	output := string(body)
+
+	expectedLines := []string{
+		"# TYPE goqueue_jobs gauge",
+		`goqueue_jobs{queue="queue\"1",status="ready"} 0`,
+		`goqueue_jobs{queue="queue\"1",status="reserved"} 1`,
+		`goqueue_jobs{queue="queue\"1",status="buried"} 1`,
+		`goqueue_waiting_reservers{queue="queue\"1"} 0`,
+		"# TYPE goqueue_jobs_added_total counter",
+		`goqueue_jobs_added_total{queue="queue\"1"} 3`,
+		`goqueue_jobs_reserved_total{queue="queue\"1"} 4`,
+		`goqueue_jobs_released_total{queue="queue\"1"} 1`,
+		`goqueue_jobs_buried_total{queue="queue\"1"} 1`,
+		`goqueue_reservations_timed_out_total{queue="queue\"1"} 0`,
+		`goqueue_jobs_deleted_total{queue="queue\"1"} 1`,
+		"# TYPE goqueue_reserve_wait_seconds histogram",
+		`goqueue_reserve_wait_seconds_bucket{queue="queue\"1",le="0.001"} 2`,
+		`goqueue_reserve_wait_seconds_count{queue="queue\"1"} 2`,
+		`goqueue_job_time_in_queue_seconds_bucket{queue="queue\"1",le="+Inf"} 4`,
+		`goqueue_job_time_in_queue_seconds_count{queue="queue\"1"} 4`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected metrics to contain %v, got:\n%v", line, output)
+		}
+	}
+}
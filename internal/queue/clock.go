@@ -0,0 +1,40 @@
+package queue
+
+import "time"
+
+// A clock provides the current time and timers to the queue.
+// Tests replace the clock so that time dependent behaviour can be tested without sleeping.
+type clock interface {
+	now() time.Time
+	newTimer(d time.Duration) timer
+}
+
+// A timer sends the current time on its channel once it has fired.
+type timer interface {
+	channel() <-chan time.Time
+	stop() bool
+}
+
+// realClock is a clock which uses the system time.
+type realClock struct{}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+func (realClock) newTimer(d time.Duration) timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+// realTimer is a timer backed by a time.Timer.
+type realTimer struct {
+	*time.Timer
+}
+
+func (t *realTimer) channel() <-chan time.Time {
+	return t.C
+}
+
+func (t *realTimer) stop() bool {
+	return t.Stop()
+}
@@ -0,0 +1,356 @@
+package queue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cswilson90/goqueue/internal/logging"
+)
+
+const (
+	// minFileStoreCompactSize is the smallest size a FileStore's file must reach before it's compacted.
+	minFileStoreCompactSize = 1 << 20
+)
+
+// A FileStore is a Store which appends a record of every change to a single file
+// and keeps the current state of every job in memory.
+//
+// Records are framed the same way as a LogStore's so a partially written record at the end of the file
+// is detected and removed when the store is opened. Once the file has grown to twice its size after it was
+// last compacted it's compacted in the background by writing a put record for every job to a new file,
+// copying over any records appended in the meantime and renaming it over the old one.
+type FileStore struct {
+	path string
+
+	// mutex protects everything below it
+	mutex         sync.Mutex
+	file          *os.File
+	size          int64
+	compactedSize int64
+	jobs          *jobTable
+	policy        SyncPolicy
+	dirty         bool
+	// failed is set if a record couldn't be written or removed so the end of the file is unknown
+	failed error
+
+	// compactMutex ensures only one compaction runs at a time
+	compactMutex sync.Mutex
+	compactNow   chan struct{}
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// OpenFileStore opens the store in the file at the given path, creating it if it doesn't exist.
+// The sync interval is only used with the SyncEvery policy.
+func OpenFileStore(path string, policy SyncPolicy, syncInterval time.Duration) (*FileStore, error) {
+	if policy == SyncEvery && syncInterval <= 0 {
+		return nil, fmt.Errorf("Invalid file store sync interval %v", syncInterval)
+	}
+
+	s := &FileStore{
+		path:       path,
+		jobs:       newJobTable(),
+		policy:     policy,
+		compactNow: make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+
+	err := s.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy != SyncEvery {
+		syncInterval = 0
+	}
+	s.done.Add(1)
+	go s.runBackgroundTasks(syncInterval)
+
+	return s, nil
+}
+
+// recover reads all jobs from the file then opens it for appending after its last complete record.
+func (s *FileStore) recover() error {
+	// A compaction may have been interrupted before the new file replaced the old one
+	err := os.Remove(s.tmpPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(s.file)
+	var end int64
+	for {
+		size, record, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Only a record torn by a crash while it was appended can be discarded
+			if !tornTail(reader, err) {
+				s.file.Close()
+				return fmt.Errorf("Corrupt record at offset %v of %v: %v", end, s.path, err.Error())
+			}
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("record truncated")
+			}
+			logging.Warnf("Discarding incomplete record at offset %v of %v: %v", end, s.path, err.Error())
+			break
+		}
+
+		s.jobs.apply(record.jobRecord)
+		end += size
+	}
+
+	err = truncateFile(s.file, end)
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+
+	s.size = end
+	s.compactedSize = end
+	return nil
+}
+
+// tmpPath returns the path the file is written to while it's being compacted.
+func (s *FileStore) tmpPath() string {
+	return s.path + ".tmp"
+}
+
+// PutJob stores a new job.
+func (s *FileStore) PutJob(job *StoredJob) error {
+	return s.record(putRecord(job))
+}
+
+// UpdateJob updates the status, priority and deadline of a stored job.
+func (s *FileStore) UpdateJob(id uint64, status string, priority uint32, deadline time.Time) error {
+	return s.record(updateRecord(id, status, priority, deadline))
+}
+
+// DeleteJob deletes a stored job.
+func (s *FileStore) DeleteJob(id uint64) error {
+	return s.record(deleteRecord(id))
+}
+
+// Jobs calls fn for each stored job in ID order.
+func (s *FileStore) Jobs(fn func(*StoredJob) error) error {
+	s.mutex.Lock()
+	jobs := s.jobs.sortedJobs()
+	s.mutex.Unlock()
+
+	for _, job := range jobs {
+		err := fn(job)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LastJobID returns the highest ID of any job stored, including jobs which have been deleted.
+func (s *FileStore) LastJobID() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jobs.lastJobID
+}
+
+// record appends a record to the file, syncing it to disk if the sync policy requires.
+// The change is only applied once the record is written and, with the SyncAlways policy, synced.
+// If the record can't be written whatever part of it was written is removed. If that fails, or the record
+// can't be synced so it's unknown whether it's on disk, the store is marked as failed and no more records
+// are written to it.
+func (s *FileStore) record(record *jobRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failed != nil {
+		return fmt.Errorf("File store failed: %v", s.failed.Error())
+	}
+
+	frame := frameRecord(0, record)
+	if len(frame)-frameHeaderSize > maxRecordSize {
+		return fmt.Errorf("Record of %v bytes is too large for the file store", len(frame)-frameHeaderSize)
+	}
+	_, err := s.file.Write(frame)
+	if err != nil {
+		truncateErr := truncateFile(s.file, s.size)
+		if truncateErr != nil {
+			s.failed = truncateErr
+			logging.Errorf("Failed to remove partially written record from file store: %v", truncateErr.Error())
+		}
+		return err
+	}
+
+	if s.policy == SyncAlways {
+		err = s.file.Sync()
+		if err != nil {
+			s.failed = err
+			truncateFile(s.file, s.size)
+			logging.Errorf("Failed to sync file store: %v", err.Error())
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	s.jobs.apply(record)
+	s.size += int64(len(frame))
+
+	if s.size >= minFileStoreCompactSize && s.size >= 2*s.compactedSize {
+		select {
+		case s.compactNow <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// compact replaces the file with one holding a put record for every job.
+// Records are only blocked while those appended since compaction started are copied to the new file.
+func (s *FileStore) compact() error {
+	s.compactMutex.Lock()
+	defer s.compactMutex.Unlock()
+
+	s.mutex.Lock()
+	jobs := s.jobs.copy()
+	start := s.size
+	s.mutex.Unlock()
+
+	tmpPath := s.tmpPath()
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	sortedJobs := jobs.sortedJobs()
+	records := make([]*jobRecord, 0, len(sortedJobs)+1)
+	for _, job := range sortedJobs {
+		records = append(records, putRecord(job))
+	}
+	// Deleting the last job ID keeps it from being reused if the job with it is gone
+	lastJobID := jobs.lastJobID
+	if lastJobID > 0 && (len(sortedJobs) == 0 || sortedJobs[len(sortedJobs)-1].Id < lastJobID) {
+		records = append(records, deleteRecord(lastJobID))
+	}
+
+	writer := bufio.NewWriter(file)
+	var size int64
+	for _, record := range records {
+		frame := frameRecord(0, record)
+		_, err = writer.Write(frame)
+		if err != nil {
+			break
+		}
+		size += int64(len(frame))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Records appended while the jobs were written still need to be applied after them
+	var copied int64
+	copied, err = io.Copy(file, io.NewSectionReader(s.file, start, s.size-start))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(s.path))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = size + copied
+	s.compactedSize = s.size
+	s.dirty = false
+	return nil
+}
+
+// runBackgroundTasks syncs the file at the given interval and compacts it whenever it grows too large
+// until the store is closed. An interval of 0 disables syncing.
+func (s *FileStore) runBackgroundTasks(syncInterval time.Duration) {
+	defer s.done.Done()
+
+	var syncTick <-chan time.Time
+	if syncInterval > 0 {
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-syncTick:
+			s.mutex.Lock()
+			err := s.sync()
+			s.mutex.Unlock()
+			if err != nil {
+				logging.Errorf("Failed to sync file store: %v", err.Error())
+			}
+		case <-s.compactNow:
+			err := s.compact()
+			if err != nil {
+				logging.Errorf("Failed to compact file store: %v", err.Error())
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sync syncs the file to disk if it has changed since it was last synced.
+// The caller must hold the mutex.
+func (s *FileStore) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.file.Sync()
+}
+
+// Close stops background tasks then syncs and closes the file.
+func (s *FileStore) Close() error {
+	close(s.stop)
+	s.done.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Records can't be written once the file is closed
+	s.failed = fmt.Errorf("store closed")
+
+	err := s.file.Sync()
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
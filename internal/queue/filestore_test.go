@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// openTestFileStore is a helper function which opens a file store at the given path
+func openTestFileStore(t *testing.T, path string) *FileStore {
+	store, err := OpenFileStore(path, SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file store: " + err.Error())
+	}
+	return store
+}
+
+// storedJobs is a helper function which returns every job in a store
+func storedJobs(store Store) []*StoredJob {
+	jobs := make([]*StoredJob, 0)
+	store.Jobs(func(job *StoredJob) error {
+		jobs = append(jobs, job)
+		return nil
+	})
+	return jobs
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+	path := filepath.Join(dataDir, "jobs")
+
+	store := openTestFileStore(t, path)
+	for i := uint64(1); i <= 3; i++ {
+		store.PutJob(&StoredJob{Data: []byte{byte(i)}, Id: i, Priority: 1, Queue: "queue1", Status: "ready", Timeout: 60})
+	}
+	store.UpdateJob(2, "reserved", 3, time.Unix(100, 0))
+	store.DeleteJob(3)
+	expected := storedJobs(store)
+	store.Close()
+
+	store = openTestFileStore(t, path)
+	if recovered := storedJobs(store); !cmp.Equal(expected, recovered) {
+		t.Errorf("Recovered jobs differ from jobs before restart: %v", cmp.Diff(expected, recovered))
+	}
+	if lastJobID := store.LastJobID(); lastJobID != 3 {
+		t.Errorf("Expected last job ID 3, got %v", lastJobID)
+	}
+	store.Close()
+
+	// A partially written record should be discarded
+	fileData, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file store: " + err.Error())
+	}
+	err = ioutil.WriteFile(path, fileData[:len(fileData)-3], 0644)
+	if err != nil {
+		t.Fatalf("Failed to truncate file store: " + err.Error())
+	}
+
+	store = openTestFileStore(t, path)
+	defer store.Close()
+	if recovered := storedJobs(store); len(recovered) != 3 {
+		t.Errorf("Expected 3 jobs after discarding torn delete, got %v", len(recovered))
+	}
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+	path := filepath.Join(dataDir, "jobs")
+
+	store := openTestFileStore(t, path)
+	for i := uint64(1); i <= 2; i++ {
+		store.PutJob(&StoredJob{Data: []byte{byte(i)}, Id: i, Priority: 1, Queue: "queue1", Status: "ready", Timeout: 60})
+	}
+	store.Close()
+
+	// A corrupt record before the end of the file isn't a torn write so recovery must fail
+	fileData, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file store: " + err.Error())
+	}
+	fileData[frameHeaderSize] ^= 0xff
+	err = ioutil.WriteFile(path, fileData, 0644)
+	if err != nil {
+		t.Fatalf("Failed to corrupt file store: " + err.Error())
+	}
+	_, err = OpenFileStore(path, SyncAlways, 0)
+	if err == nil {
+		t.Errorf("Opened file store with a corrupt record in the middle of the file")
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+	path := filepath.Join(dataDir, "jobs")
+
+	store, err := OpenFileStore(path, SyncNever, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file store: " + err.Error())
+	}
+
+	// Repeatedly adding and deleting jobs leaves nothing live so the file should stay small
+	data := make([]byte, 1024)
+	for i := uint64(1); i <= 4096; i++ {
+		store.PutJob(&StoredJob{Data: data, Id: i, Priority: 1, Queue: "queue1", Status: "ready", Timeout: 60})
+		store.DeleteJob(i)
+	}
+
+	// Compaction happens in the background so give it a moment to finish
+	var size int64
+	for i := 0; i < 100; i++ {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat file store: " + err.Error())
+		}
+		size = info.Size()
+		if size < 2*minFileStoreCompactSize {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size >= 2*minFileStoreCompactSize {
+		t.Errorf("Expected file store to be compacted, size is %v", size)
+	}
+
+	err = store.compact()
+	if err != nil {
+		t.Fatalf("Failed to compact file store: " + err.Error())
+	}
+	store.Close()
+
+	// The last job ID should survive compaction even though the job is gone
+	store = openTestFileStore(t, path)
+	defer store.Close()
+	if recovered := storedJobs(store); len(recovered) != 0 {
+		t.Errorf("Expected no jobs after compaction, got %v", len(recovered))
+	}
+	if lastJobID := store.LastJobID(); lastJobID != 4096 {
+		t.Errorf("Expected last job ID 4096, got %v", lastJobID)
+	}
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+	path := filepath.Join(dataDir, "jobs")
+
+	store := openTestFileStore(t, path)
+	err := store.PutJob(&StoredJob{Data: []byte{'1'}, Id: 1, Queue: "queue1", Status: "ready"})
+	if err != nil {
+		t.Fatalf("Failed to store job: " + err.Error())
+	}
+
+	// Neither the record nor the truncate can be written to a closed file so the store must stop accepting records
+	store.file.Close()
+	err = store.PutJob(&StoredJob{Data: []byte{'2'}, Id: 2, Queue: "queue1", Status: "ready"})
+	if err == nil {
+		t.Fatalf("Stored job in closed file store")
+	}
+
+	store.file, err = os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to reopen file store: " + err.Error())
+	}
+	err = store.PutJob(&StoredJob{Data: []byte{'3'}, Id: 3, Queue: "queue1", Status: "ready"})
+	if err == nil {
+		t.Errorf("Stored job in failed file store")
+	}
+	store.Close()
+}
@@ -1,15 +1,30 @@
 package queue
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
+)
+
+const (
+	// MaxJobSize is the largest job data in bytes which can be added.
+	MaxJobSize = 1 << 30
+	// MaxQueueNameLength is the longest queue name in bytes a job can be added to.
+	MaxQueueNameLength = 255
 )
 
 // A GoJobQueue manages a group of named priority queues.
 type GoJobQueue struct {
-	// queueMutex protects the queues map
+	// queueMutex protects the queues map, pendingWaiters and closed
 	queueMutex sync.Mutex
 	queues     map[string]*priorityJobQueue
+	closed     bool
+
+	// pendingWaiters are waiting for a job from queues which don't exist yet.
+	// They are handed to a queue when it's created so waiting doesn't create queues.
+	pendingWaiters map[string][]*reserveWaiter
 
 	// jobIdMutex protects nextJobID
 	jobIdMutex sync.Mutex
@@ -18,11 +33,22 @@ type GoJobQueue struct {
 	// jobsMutex protects the jobs map
 	jobsMutex sync.Mutex
 	jobs      map[uint64]*job
+
+	// clock is used by all queues to time reservations
+	clock clock
+
+	// hooks are told about changes to jobs in all queues
+	hooks *hookHolder
+
+	// store holds the state of every job so the choice of store decides whether jobs are persisted
+	store Store
 }
 
 // A GoJobData object represents the data for a single job in a GoJobQueue.
+// Delay is the number of seconds a job waits in the delayed state when it is added before becoming ready.
 type GoJobData struct {
 	Data     []byte
+	Delay    uint32
 	Id       uint64
 	Priority uint32
 	Queue    string
@@ -30,19 +56,96 @@ type GoJobData struct {
 	Timeout  uint32
 }
 
-// NewGoJobQueue creates a new GoJobQueue.
+// QueueStats are statistics about a single named queue.
+// Added, Deleted and TimedOut count jobs added, jobs deleted and reservations which expired
+// since the server started. OldestReadyAge is how long the job which has been ready longest has been waiting.
+type QueueStats struct {
+	Ready    uint64
+	Reserved uint64
+	Delayed  uint64
+	Buried   uint64
+
+	Added    uint64
+	Deleted  uint64
+	TimedOut uint64
+
+	OldestReadyAge time.Duration
+	Waiting        uint64
+}
+
+// NewGoJobQueue creates a new GoJobQueue which only holds jobs in memory.
+// Reserved jobs whose TTP expires before they are deleted are released back to the ready queue.
 func NewGoJobQueue() *GoJobQueue {
+	return newGoJobQueueWithClock(realClock{}, NewNullStore())
+}
+
+// NewGoJobQueueWithStore creates a new GoJobQueue which writes every change to a job through to the given store.
+// Jobs already in the store are loaded into their queues and new jobs are given IDs following the last stored ID.
+// Returns an error if the jobs can't be loaded.
+func NewGoJobQueueWithStore(store Store) (*GoJobQueue, error) {
+	return newGoJobQueueWithStore(store, realClock{})
+}
+
+// newGoJobQueueWithStore creates a GoJobQueue with the given store which uses the given clock to time reservations.
+func newGoJobQueueWithStore(store Store, clock clock) (*GoJobQueue, error) {
+	q := newGoJobQueueWithClock(clock, store)
+
+	err := store.Jobs(func(storedJob *StoredJob) error {
+		q.restore(storedJob.toJob())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load stored jobs: %v", err.Error())
+	}
+
+	q.nextJobID = store.LastJobID() + 1
+
+	return q, nil
+}
+
+// newGoJobQueueWithClock creates a new GoJobQueue with the given store which uses the given clock
+// to time reservations. Jobs already in the store are not loaded.
+func newGoJobQueueWithClock(clock clock, store Store) *GoJobQueue {
 	return &GoJobQueue{
-		jobs:      make(map[uint64]*job),
-		nextJobID: 1,
-		queues:    make(map[string]*priorityJobQueue),
+		jobs:           make(map[uint64]*job),
+		nextJobID:      1,
+		queues:         make(map[string]*priorityJobQueue),
+		pendingWaiters: make(map[string][]*reserveWaiter),
+		clock:          clock,
+		store:          store,
+		hooks:          newHookHolder(),
+	}
+}
+
+// SetHooks sets the hooks which are told about changes to jobs in all queues, replacing any set before.
+func (q *GoJobQueue) SetHooks(hooks Hooks) {
+	q.hooks.set(hooks)
+}
+
+// Close stops every queue's operations and timers then closes the store, making sure all changes are persisted.
+// Jobs can't be added or changed once the queue is closed.
+func (q *GoJobQueue) Close() error {
+	q.queueMutex.Lock()
+	q.closed = true
+	queues := make([]*priorityJobQueue, 0, len(q.queues))
+	for _, queue := range q.queues {
+		queues = append(queues, queue)
+	}
+	q.queueMutex.Unlock()
+
+	for _, queue := range queues {
+		queue.stop()
 	}
+
+	return q.store.Close()
 }
 
 // AddJob creates a job with the given GoJobData and adds it to the queue named in the data.
+// If the data has a delay the job is delayed for that many seconds before it can be reserved.
 // This function assigns an ID to the job so the given GoJobData should not have an id assigned
 // before passing it to this function.
-// Returns an error if the jobData already has an id assigned or if the queue name is empty.
+// Returns an error if the jobData already has an id assigned, if the queue name is empty
+// or if the queue name or data are too long.
 func (q *GoJobQueue) AddJob(jobData *GoJobData) error {
 	if jobData.Id != 0 {
 		return fmt.Errorf("Tried to add job to GoJobQueue which already had ID: %v", jobData.Id)
@@ -52,45 +155,434 @@ func (q *GoJobQueue) AddJob(jobData *GoJobData) error {
 		return fmt.Errorf("Tried to add job to a queue with no name")
 	}
 
+	if len(jobData.Queue) > MaxQueueNameLength {
+		return fmt.Errorf("Tried to add job to a queue with a name longer than %v bytes", MaxQueueNameLength)
+	}
+
+	if len(jobData.Data) > MaxJobSize {
+		return fmt.Errorf("Tried to add job with data larger than %v bytes", MaxJobSize)
+	}
+
 	newJob := newJob(q.getNextJobId(), jobData.Queue, jobData.Priority, jobData.Timeout, jobData.Data)
+	if jobData.Delay > 0 {
+		newJob.delay(q.clock.now(), jobData.Delay)
+	}
+
+	err := q.store.PutJob(newStoredJob(newJob))
+	if err != nil {
+		return fmt.Errorf("Failed to store new job %v: %v", newJob.id, err.Error())
+	}
 	jobData.Id = newJob.id
 
-	queue := q.priorityQueue(jobData.Queue)
+	// The job must be known before it's queued as it can be handed straight to a waiting reserve
+	q.jobsMutex.Lock()
+	q.jobs[newJob.id] = newJob
+	q.jobsMutex.Unlock()
+
+	err = q.priorityQueue(jobData.Queue).addJob(newJob)
+	if err != nil {
+		q.jobsMutex.Lock()
+		delete(q.jobs, newJob.id)
+		q.jobsMutex.Unlock()
+		return fmt.Errorf("Failed to add job %v: %v", newJob.id, err.Error())
+	}
+
+	return nil
+}
+
+// AddJobs adds several jobs to the queues given in their data.
+// Either all of the jobs are added or, if any of them can't be, none are and an error is returned.
+// The jobs are given consecutive IDs in the order given and the ID of each job is set in its data.
+func (q *GoJobQueue) AddJobs(jobs []*GoJobData) error {
+	for i, jobData := range jobs {
+		if jobData.Id != 0 {
+			return fmt.Errorf("Tried to add job %v to GoJobQueue which already had ID: %v", i, jobData.Id)
+		}
+
+		if jobData.Queue == "" {
+			return fmt.Errorf("Tried to add job %v to a queue with no name", i)
+		}
+
+		if len(jobData.Queue) > MaxQueueNameLength {
+			return fmt.Errorf("Tried to add job %v to a queue with a name longer than %v bytes", i, MaxQueueNameLength)
+		}
+
+		if len(jobData.Data) > MaxJobSize {
+			return fmt.Errorf("Tried to add job %v with data larger than %v bytes", i, MaxJobSize)
+		}
+	}
+
+	firstID := q.getJobIds(uint64(len(jobs)))
+	now := q.clock.now()
 
-	queue.addJob(newJob)
+	newJobs := make([]*job, len(jobs))
+	for i, jobData := range jobs {
+		newJobs[i] = newJob(firstID+uint64(i), jobData.Queue, jobData.Priority, jobData.Timeout, jobData.Data)
+		if jobData.Delay > 0 {
+			newJobs[i].delay(now, jobData.Delay)
+		}
+
+		err := q.store.PutJob(newStoredJob(newJobs[i]))
+		if err != nil {
+			// Remove the jobs already stored so none of the batch is kept
+			for _, storedJob := range newJobs[:i] {
+				q.store.DeleteJob(storedJob.id)
+			}
+			return fmt.Errorf("Failed to store new job %v: %v", newJobs[i].id, err.Error())
+		}
+	}
+
+	// Add the jobs for each queue in one go
+	jobsByQueue := make(map[string][]*job)
+	var queueNames []string
+	for _, addedJob := range newJobs {
+		if _, ok := jobsByQueue[addedJob.queueName]; !ok {
+			queueNames = append(queueNames, addedJob.queueName)
+		}
+		jobsByQueue[addedJob.queueName] = append(jobsByQueue[addedJob.queueName], addedJob)
+	}
 
 	q.jobsMutex.Lock()
-	q.jobs[newJob.id] = newJob
+	for i, addedJob := range newJobs {
+		jobs[i].Id = addedJob.id
+		q.jobs[addedJob.id] = addedJob
+	}
 	q.jobsMutex.Unlock()
 
+	// Queues can only fail to add jobs once the GoJobQueue is closed
+	for _, queueName := range queueNames {
+		err := q.priorityQueue(queueName).addJobs(jobsByQueue[queueName])
+		if err != nil {
+			return fmt.Errorf("Failed to add jobs: %v", err.Error())
+		}
+	}
+
 	return nil
 }
 
 // GetJobData returns the job data for the job with the given ID.
 // If the job with the given ID does not exist the second return value will be false.
 func (q *GoJobQueue) GetJobData(id uint64) (*GoJobData, bool) {
-	internalJob, ok := q.jobs[id]
+	internalJob, ok := q.getJob(id)
 	if !ok {
 		return nil, false
 	}
 
-	return internalJobToData(internalJob), true
+	jobData := q.priorityQueue(internalJob.queueName).getJobData(internalJob)
+	return jobData, jobData != nil
 }
 
-// ReserveJob reserves a job from the queue with the given name.
+// PeekNextJob returns the data for the next job with the given status in the named queue without changing it.
+// The status must be "ready", "delayed" or "buried". The next ready or buried job is the one which would
+// be reserved or kicked next and the next delayed job is the one which becomes ready soonest.
+// If there is no such job the second return value will be false.
+func (q *GoJobQueue) PeekNextJob(queueName string, status string) (*GoJobData, bool) {
+	if status != "ready" && status != "delayed" && status != "buried" {
+		return nil, false
+	}
+
+	q.queueMutex.Lock()
+	queue, exists := q.queues[queueName]
+	q.queueMutex.Unlock()
+	if !exists {
+		return nil, false
+	}
+
+	return queue.peekJob(status)
+}
+
+// ReserveJob reserves a job from the queue with the given name on behalf of the given owner.
+// The owner identifies the client reserving the job, only that owner can then touch the job.
 // If no job can be reserved from the queue the second returned value will be false.
-func (q *GoJobQueue) ReserveJob(queueName string) (*GoJobData, bool) {
+func (q *GoJobQueue) ReserveJob(queueName string, owner uint64) (*GoJobData, bool) {
+	q.queueMutex.Lock()
 	queue, exists := q.queues[queueName]
+	q.queueMutex.Unlock()
 	if !exists {
 		return nil, false
 	}
 
-	internalJob, ok := queue.reserveJob()
-	if !ok {
+	return queue.reserveJob(owner)
+}
+
+// ReserveJobWait reserves a job from the queue with the given name on behalf of the given owner.
+// If there is no job ready it waits until one is, handing jobs to waiting clients in the order they started waiting.
+// Returns the context's error if the context is done before a job could be reserved.
+func (q *GoJobQueue) ReserveJobWait(ctx context.Context, queueName string, owner uint64) (*GoJobData, error) {
+	return q.ReserveJobWaitAny(ctx, []string{queueName}, owner)
+}
+
+// ReserveJobsWait reserves up to max ready jobs in priority order from the queue with the given name on behalf of the given owner.
+// If there is no job ready it waits until one is as ReserveJobWait does, then reserves any others ready by then up to max.
+// Returns the context's error if the context is done before any job could be reserved.
+func (q *GoJobQueue) ReserveJobsWait(ctx context.Context, queueName string, owner uint64, max int) ([]*GoJobData, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("Can't reserve fewer than 1 job")
+	}
+
+	q.queueMutex.Lock()
+	queue, exists := q.queues[queueName]
+	q.queueMutex.Unlock()
+	if exists {
+		jobs := queue.reserveJobs(owner, max)
+		if len(jobs) > 0 {
+			q.hooks.get().ReserveWaited(queueName, 0)
+			return jobs, nil
+		}
+	}
+
+	jobData, err := q.ReserveJobWait(ctx, queueName, owner)
+	if err != nil {
+		return nil, err
+	}
+	// The queue exists now a job has been reserved from it
+	jobs := append([]*GoJobData{jobData}, q.priorityQueue(queueName).reserveJobs(owner, max-1)...)
+
+	return jobs, nil
+}
+
+// ReserveJobWaitAny reserves a job from any of the queues with the given names on behalf of the given owner.
+// If several queues have a job ready the job with the highest priority is reserved, with ties going to the
+// job which was added first. If there is no job ready it waits until one of the queues has one.
+// Returns the context's error if the context is done before a job could be reserved.
+// Queues which don't exist aren't created to wait on them.
+func (q *GoJobQueue) ReserveJobWaitAny(ctx context.Context, queueNames []string, owner uint64) (*GoJobData, error) {
+	queueNames = uniqueNames(queueNames)
+
+	if len(queueNames) > 1 {
+		jobData, ok := q.reserveHighestPriority(q.existingQueues(queueNames), owner)
+		if ok {
+			q.hooks.get().ReserveWaited(jobData.Queue, 0)
+			return jobData, nil
+		}
+	}
+
+	// Wait on all of the queues with the same waiter so only one of them can hand it a job.
+	// The queue which hands over a job removes the waiter but the others must have it removed.
+	waiter := newReserveWaiter(owner)
+	defer func() {
+		if len(queueNames) > 1 {
+			q.cancelWait(queueNames, waiter)
+		}
+	}()
+
+	for _, queueName := range queueNames {
+		jobData, ok := q.reserveJobOrWait(queueName, waiter)
+		if ok {
+			q.hooks.get().ReserveWaited(jobData.Queue, 0)
+			return jobData, nil
+		}
+	}
+
+	started := q.clock.now()
+	select {
+	case jobData := <-waiter.response:
+		q.hooks.get().ReserveWaited(jobData.Queue, q.clock.now().Sub(started))
+		return jobData, nil
+	case <-ctx.Done():
+	}
+
+	if !waiter.claim() {
+		// A job was handed to the waiter before it could give up
+		jobData := <-waiter.response
+		q.hooks.get().ReserveWaited(jobData.Queue, q.clock.now().Sub(started))
+		return jobData, nil
+	}
+	if len(queueNames) == 1 {
+		q.cancelWait(queueNames, waiter)
+	}
+
+	return nil, ctx.Err()
+}
+
+// uniqueNames returns the given queue names with names given more than once only included once.
+func uniqueNames(queueNames []string) []string {
+	seen := make(map[string]bool, len(queueNames))
+	unique := make([]string, 0, len(queueNames))
+	for _, queueName := range queueNames {
+		if seen[queueName] {
+			continue
+		}
+		seen[queueName] = true
+		unique = append(unique, queueName)
+	}
+	return unique
+}
+
+// existingQueues returns the priority queues with the given names which exist.
+func (q *GoJobQueue) existingQueues(queueNames []string) []*priorityJobQueue {
+	q.queueMutex.Lock()
+	defer q.queueMutex.Unlock()
+
+	queues := make([]*priorityJobQueue, 0, len(queueNames))
+	for _, queueName := range queueNames {
+		queue, exists := q.queues[queueName]
+		if exists {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
+
+// reserveJobOrWait reserves the next ready job in the named queue for the waiter's owner or adds the waiter
+// to the queue's waiters. If the queue doesn't exist the waiter is kept until it's created.
+// Returns false if the waiter has to wait, or if it has already been claimed by another queue it's waiting on.
+func (q *GoJobQueue) reserveJobOrWait(queueName string, waiter *reserveWaiter) (*GoJobData, bool) {
+	q.queueMutex.Lock()
+	queue, exists := q.queues[queueName]
+	if !exists {
+		q.pendingWaiters[queueName] = append(q.pendingWaiters[queueName], waiter)
+	}
+	q.queueMutex.Unlock()
+	if !exists {
 		return nil, false
 	}
 
-	return internalJobToData(internalJob), true
+	return queue.reserveJobOrWait(waiter)
+}
+
+// cancelWait stops the waiter waiting for a job from the named queues.
+func (q *GoJobQueue) cancelWait(queueNames []string, waiter *reserveWaiter) {
+	for _, queueName := range queueNames {
+		q.queueMutex.Lock()
+		queue, exists := q.queues[queueName]
+		if !exists {
+			q.removePendingWaiter(queueName, waiter)
+		}
+		q.queueMutex.Unlock()
+
+		if exists {
+			queue.cancelWait(waiter)
+		}
+	}
+}
+
+// removePendingWaiter removes the waiter from those waiting for the named queue to be created.
+// The caller must hold the queue mutex.
+func (q *GoJobQueue) removePendingWaiter(queueName string, waiter *reserveWaiter) {
+	waiters := q.pendingWaiters[queueName]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(q.pendingWaiters, queueName)
+	} else {
+		q.pendingWaiters[queueName] = waiters
+	}
+}
+
+// reserveHighestPriority reserves the ready job with the highest priority from the given queues.
+// Jobs can be reserved by other clients between looking at the queues and reserving, in which case
+// the next best queue is tried. The second returned value is false if no job could be reserved.
+func (q *GoJobQueue) reserveHighestPriority(queues []*priorityJobQueue, owner uint64) (*GoJobData, bool) {
+	type candidate struct {
+		queue *priorityJobQueue
+		next  *GoJobData
+	}
+
+	candidates := make([]candidate, 0, len(queues))
+	for _, queue := range queues {
+		next, ok := queue.peekJob("ready")
+		if ok {
+			candidates = append(candidates, candidate{queue, next})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].next.Priority != candidates[j].next.Priority {
+			return candidates[i].next.Priority < candidates[j].next.Priority
+		}
+		return candidates[i].next.Id < candidates[j].next.Id
+	})
+
+	for _, candidate := range candidates {
+		jobData, ok := candidate.queue.reserveJob(owner)
+		if ok {
+			return jobData, true
+		}
+	}
+
+	return nil, false
+}
+
+// TouchJob refreshes the reservation of the job with the given ID giving the owner more time to process it.
+// Returns an error if the job doesn't exist or is not reserved by the given owner.
+func (q *GoJobQueue) TouchJob(id uint64, owner uint64) error {
+	job, ok := q.getJob(id)
+	if !ok {
+		return fmt.Errorf("Can't touch job with ID %v: job doesn't exist", id)
+	}
+
+	return q.priorityQueue(job.queueName).touchJob(job, owner)
+}
+
+// IsReservedBy returns whether the job with the given ID exists and is reserved by the given owner.
+func (q *GoJobQueue) IsReservedBy(id uint64, owner uint64) bool {
+	job, ok := q.getJob(id)
+	if !ok {
+		return false
+	}
+
+	return q.priorityQueue(job.queueName).isReservedBy(job, owner)
+}
+
+// ReleaseJob releases the job with the given ID, which must be reserved by the given owner, back to its queue.
+// The job is given the new priority and becomes ready again after delay seconds, or immediately if delay is 0.
+// Returns an error if the job doesn't exist or is not reserved by the owner.
+func (q *GoJobQueue) ReleaseJob(id uint64, owner uint64, priority uint32, delay uint32) error {
+	job, ok := q.getJob(id)
+	if !ok {
+		return fmt.Errorf("Can't release job with ID %v: job doesn't exist", id)
+	}
+
+	return q.priorityQueue(job.queueName).releaseJob(job, owner, priority, delay)
+}
+
+// BuryJob buries the job with the given ID, which must be reserved by the given owner, with a new priority.
+// Buried jobs can't be reserved until they are kicked back to the ready queue with KickJobs.
+// Returns an error if the job doesn't exist or is not reserved by the owner.
+func (q *GoJobQueue) BuryJob(id uint64, owner uint64, priority uint32) error {
+	job, ok := q.getJob(id)
+	if !ok {
+		return fmt.Errorf("Can't bury job with ID %v: job doesn't exist", id)
+	}
+
+	return q.priorityQueue(job.queueName).buryJob(job, owner, priority)
+}
+
+// KickJobs moves up to count buried jobs in the named queue back to the ready queue.
+// Jobs are kicked in priority order. Returns the number of jobs kicked.
+func (q *GoJobQueue) KickJobs(queueName string, count uint32) uint32 {
+	q.queueMutex.Lock()
+	queue, exists := q.queues[queueName]
+	q.queueMutex.Unlock()
+	if !exists {
+		return 0
+	}
+
+	return queue.kickJobs(count)
+}
+
+// ReleaseReservedJobs releases every reserved job in all queues back to the ready queue.
+// This is used when the queue is shutting down so reservations aren't left waiting to expire.
+// Returns the number of jobs released.
+func (q *GoJobQueue) ReleaseReservedJobs() uint32 {
+	q.queueMutex.Lock()
+	queues := make([]*priorityJobQueue, 0, len(q.queues))
+	for _, queue := range q.queues {
+		queues = append(queues, queue)
+	}
+	q.queueMutex.Unlock()
+
+	var released uint32
+	for _, queue := range queues {
+		released += queue.releaseAll()
+	}
+	return released
 }
 
 // DeleteJob deletes the job with the given ID.
@@ -106,38 +598,102 @@ func (q *GoJobQueue) DeleteJob(id uint64) error {
 	delete(q.jobs, id)
 	q.jobsMutex.Unlock()
 
-	queue, ok := q.queues[job.queueName]
-	if ok {
-		queue.deleteJob(job)
+	return q.priorityQueue(job.queueName).deleteJob(job)
+}
+
+// QueueStats returns statistics about the named queue.
+// A queue which doesn't exist has no jobs so all its statistics are 0.
+func (q *GoJobQueue) QueueStats(queueName string) *QueueStats {
+	q.queueMutex.Lock()
+	queue, exists := q.queues[queueName]
+	q.queueMutex.Unlock()
+	if !exists {
+		return &QueueStats{}
+	}
+
+	return queue.stats()
+}
+
+// LastJobID returns the ID given to the most recently added job, or 0 if no job has been added.
+func (q *GoJobQueue) LastJobID() uint64 {
+	q.jobIdMutex.Lock()
+	defer q.jobIdMutex.Unlock()
+	return q.nextJobID - 1
+}
+
+// QueueNames returns the names of all queues in alphabetical order.
+func (q *GoJobQueue) QueueNames() []string {
+	q.queueMutex.Lock()
+	names := make([]string, 0, len(q.queues))
+	for name := range q.queues {
+		names = append(names, name)
 	}
+	q.queueMutex.Unlock()
 
-	return nil
+	sort.Strings(names)
+	return names
 }
 
 // NumJobs returns the total number of jobs in all queues.
 func (q *GoJobQueue) NumJobs() int {
+	q.jobsMutex.Lock()
+	defer q.jobsMutex.Unlock()
 	return len(q.jobs)
 }
 
+// getJob returns the internal job with the given ID.
+// The second return value is false if the job doesn't exist.
+func (q *GoJobQueue) getJob(id uint64) (*job, bool) {
+	q.jobsMutex.Lock()
+	defer q.jobsMutex.Unlock()
+
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
 // jobsQueue returns the priorityJobQueue object that the given job is in.
 // Teh queue will be created if it doesn't exist.
 func (q *GoJobQueue) priorityQueue(queueName string) *priorityJobQueue {
 	q.queueMutex.Lock()
 	queue, ok := q.queues[queueName]
 	if !ok {
-		q.queues[queueName] = newPriorityJobQueue()
+		q.queues[queueName] = newPriorityJobQueue(q.clock, q.store, q.hooks)
 		queue = q.queues[queueName]
+		if q.closed {
+			queue.stop()
+		}
+
+		// Hand over waiters before the queue can be found so they can't miss a job or fail to be cancelled
+		waiters := q.pendingWaiters[queueName]
+		if len(waiters) > 0 {
+			delete(q.pendingWaiters, queueName)
+			queue.addWaiters(waiters)
+		}
 	}
 
 	q.queueMutex.Unlock()
 	return queue
 }
 
+// restore adds a job loaded from the store to its queue.
+func (q *GoJobQueue) restore(job *job) {
+	q.jobsMutex.Lock()
+	q.jobs[job.id] = job
+	q.jobsMutex.Unlock()
+
+	q.priorityQueue(job.queueName).restoreJob(job)
+}
+
 // getNextJobId returns the next free job ID and increments the counter.
 func (q *GoJobQueue) getNextJobId() uint64 {
+	return q.getJobIds(1)
+}
+
+// getJobIds reserves count consecutive free job IDs and returns the first of them.
+func (q *GoJobQueue) getJobIds(count uint64) uint64 {
 	q.jobIdMutex.Lock()
 	nextID := q.nextJobID
-	q.nextJobID++
+	q.nextJobID += count
 	q.jobIdMutex.Unlock()
 	return nextID
 }
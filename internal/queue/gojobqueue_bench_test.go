@@ -0,0 +1,81 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package queue
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// BenchmarkIdleReservers measures the CPU used by clients waiting to reserve from an empty queue.
+// Waiting clients should use no CPU so the CPU time logged per op should be close to zero.
+func BenchmarkIdleReservers(b *testing.B) {
+	goJobQueue := NewGoJobQueue()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const numReservers = 100
+	for i := 0; i < numReservers; i++ {
+		go goJobQueue.ReserveJobWait(ctx, "idle", uint64(i))
+	}
+	for goJobQueue.priorityQueue("idle").numWaiters() != numReservers {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+
+	logCPUTime(b, start)
+}
+
+// BenchmarkReserveWithIdleReservers measures add, reserve and delete throughput on one queue
+// while other clients wait to reserve from an empty queue. The CPU time used per op is logged.
+func BenchmarkReserveWithIdleReservers(b *testing.B) {
+	goJobQueue := NewGoJobQueue()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const numReservers = 100
+	for i := 0; i < numReservers; i++ {
+		go goJobQueue.ReserveJobWait(ctx, "idle", uint64(i))
+	}
+
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "busy", Timeout: 60}
+		goJobQueue.AddJob(jobData)
+		reserved, err := goJobQueue.ReserveJobWait(ctx, "busy", 1)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		goJobQueue.DeleteJob(reserved.Id)
+	}
+	b.StopTimer()
+
+	logCPUTime(b, start)
+}
+
+// logCPUTime logs the CPU time used per op since the given CPU time.
+func logCPUTime(b *testing.B, start int64) {
+	b.Logf("%v cpu-ns/op over %v ops", (cpuTime(b)-start)/int64(b.N), b.N)
+}
+
+// cpuTime returns the user and system CPU time used by the process in nanoseconds.
+func cpuTime(b *testing.B) int64 {
+	var usage syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	return usage.Utime.Nano() + usage.Stime.Nano()
+}
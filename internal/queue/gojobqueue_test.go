@@ -1,6 +1,9 @@
 package queue
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,7 +13,7 @@ import (
 func TestEmptyGoJobQueue(t *testing.T) {
 	goJobQueue := NewGoJobQueue()
 
-	_, ok := goJobQueue.ReserveJob("queue1")
+	_, ok := goJobQueue.ReserveJob("queue1", 1)
 	if ok {
 		t.Error("Reserved job from empty queue")
 	}
@@ -52,7 +55,7 @@ func TestSingleGoQueueJob(t *testing.T) {
 		t.Errorf("Getting data for job1 returned different data than given")
 	}
 
-	job1Reserved, ok := goJobQueue.ReserveJob("queue1")
+	job1Reserved, ok := goJobQueue.ReserveJob("queue1", 1)
 	if !ok {
 		t.Errorf("Failed to reserve job 1")
 	}
@@ -75,7 +78,7 @@ func TestSingleGoQueueJob(t *testing.T) {
 		t.Errorf("Got job data for deleted job 1")
 	}
 
-	_, ok = goJobQueue.ReserveJob("queue1")
+	_, ok = goJobQueue.ReserveJob("queue1", 1)
 	if ok {
 		t.Errorf("Reserved job after all jobs already reserved")
 	}
@@ -108,7 +111,7 @@ func TestMultipleGoQueueJobs(t *testing.T) {
 
 	expectedJobs := [6]uint64{2, 4, 1, 5, 6, 3}
 	for _, expectedID := range expectedJobs {
-		nextJob, ok := goJobQueue.ReserveJob("queue1")
+		nextJob, ok := goJobQueue.ReserveJob("queue1", 1)
 		if !ok {
 			t.Errorf("Failed to reserve job, expected job %v", expectedID)
 		}
@@ -153,7 +156,7 @@ func TestMultipleGoQueueQueues(t *testing.T) {
 			queueName = "queue2"
 		}
 
-		nextJob, ok := goJobQueue.ReserveJob(queueName)
+		nextJob, ok := goJobQueue.ReserveJob(queueName, 1)
 		if !ok {
 			t.Errorf("Failed to reserve job, expected job %v", expectedID)
 		}
@@ -167,6 +170,58 @@ func TestMultipleGoQueueQueues(t *testing.T) {
 	}
 }
 
+func TestAddJobs(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	jobs := []*GoJobData{
+		{Data: []byte{'1'}, Priority: 2, Queue: "queue1", Timeout: 60},
+		{Data: []byte{'2'}, Priority: 1, Queue: "queue2", Timeout: 60},
+		{Data: []byte{'3'}, Priority: 1, Queue: "queue1", Timeout: 60},
+		{Data: []byte{'4'}, Delay: 10, Priority: 1, Queue: "queue1", Timeout: 60},
+	}
+	err := goJobQueue.AddJobs(jobs)
+	if err != nil {
+		t.Fatalf("Error adding batch of jobs: " + err.Error())
+	}
+
+	for i, jobData := range jobs {
+		if jobData.Id != uint64(i+1) {
+			t.Errorf("Job %v in batch given ID %v, expected %v", i, jobData.Id, i+1)
+		}
+	}
+
+	expectedJobs := []struct {
+		queue string
+		id    uint64
+	}{{"queue1", 3}, {"queue1", 1}, {"queue2", 2}}
+	for _, expected := range expectedJobs {
+		nextJob, ok := goJobQueue.ReserveJob(expected.queue, 1)
+		if !ok || nextJob.Id != expected.id {
+			t.Errorf("Expected to reserve job %v from %v, got %v", expected.id, expected.queue, nextJob)
+		}
+	}
+
+	delayed, _ := goJobQueue.GetJobData(4)
+	if delayed.Status != "delayed" {
+		t.Errorf("Delayed job in batch has status %v", delayed.Status)
+	}
+
+	// A batch with an invalid job should add none of its jobs
+	invalid := []*GoJobData{
+		{Data: []byte{'5'}, Priority: 1, Queue: "queue3", Timeout: 60},
+		{Data: []byte{'6'}, Priority: 1, Queue: "", Timeout: 60},
+	}
+	err = goJobQueue.AddJobs(invalid)
+	if err == nil {
+		t.Error("Added batch containing a job with no queue name")
+	}
+
+	_, ok := goJobQueue.ReserveJob("queue3", 1)
+	if ok {
+		t.Error("Reserved job from batch which failed to be added")
+	}
+}
+
 func TestConcurrentGoQueue(t *testing.T) {
 	goJobQueue := NewGoJobQueue()
 
@@ -229,7 +284,7 @@ func reserveTestJobs(t *testing.T, queue *GoJobQueue, queueName string, numJobs
 
 	for i := 0; i < numJobs; i++ {
 		for {
-			nextJob, ok := queue.ReserveJob(queueName)
+			nextJob, ok := queue.ReserveJob(queueName, 1)
 			if !ok {
 				time.Sleep(1 * time.Microsecond)
 				continue
@@ -242,3 +297,797 @@ func reserveTestJobs(t *testing.T, queue *GoJobQueue, queueName string, numJobs
 
 	finished <- true
 }
+
+func TestReservationExpiry(t *testing.T) {
+	clock := newFakeClock()
+	goJobQueue := newGoJobQueueWithClock(clock, NewNullStore())
+
+	job1 := &GoJobData{Data: []byte{'1'}, Priority: 3, Queue: "queue1", Timeout: 60}
+	job2 := &GoJobData{Data: []byte{'2'}, Priority: 5, Queue: "queue1", Timeout: 60}
+	for _, jobData := range []*GoJobData{job1, job2} {
+		err := goJobQueue.AddJob(jobData)
+		if err != nil {
+			t.Errorf("Error adding job: " + err.Error())
+		}
+	}
+
+	reserved, ok := goJobQueue.ReserveJob("queue1", 1)
+	if !ok || reserved.Id != job1.Id {
+		t.Fatalf("Failed to reserve job %v", job1.Id)
+	}
+	if !goJobQueue.IsReservedBy(job1.Id, 1) || goJobQueue.IsReservedBy(job1.Id, 2) {
+		t.Errorf("Expected job %v to be reserved by owner 1 only", job1.Id)
+	}
+
+	// Reservation has not expired yet so only job 2 can be reserved
+	clock.advance(59 * time.Second)
+	jobData, ok := goJobQueue.GetJobData(job1.Id)
+	if !ok || jobData.Status != "reserved" {
+		t.Errorf("Job %v released before its TTP expired", job1.Id)
+	}
+
+	clock.advance(1 * time.Second)
+	jobData, ok = goJobQueue.GetJobData(job1.Id)
+	if !ok || jobData.Status != "ready" {
+		t.Errorf("Job %v not released after its TTP expired", job1.Id)
+	}
+	if goJobQueue.IsReservedBy(job1.Id, 1) {
+		t.Errorf("Job %v still reserved by owner 1 after its TTP expired", job1.Id)
+	}
+	if jobData.Priority != job1.Priority {
+		t.Errorf("Released job has priority %v, expected %v", jobData.Priority, job1.Priority)
+	}
+
+	// Job 1 should be released with its original priority so be reserved before job 2
+	reserved, ok = goJobQueue.ReserveJob("queue1", 1)
+	if !ok || reserved.Id != job1.Id {
+		t.Errorf("Expected to reserve released job %v", job1.Id)
+	}
+}
+
+func TestTouchJob(t *testing.T) {
+	clock := newFakeClock()
+	goJobQueue := newGoJobQueueWithClock(clock, NewNullStore())
+
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+
+	err := goJobQueue.TouchJob(jobData.Id, 1)
+	if err == nil {
+		t.Errorf("Touched job %v which was not reserved", jobData.Id)
+	}
+
+	goJobQueue.ReserveJob("queue1", 1)
+
+	err = goJobQueue.TouchJob(jobData.Id, 2)
+	if err == nil {
+		t.Errorf("Touched job %v which was reserved by a different owner", jobData.Id)
+	}
+
+	// Touching the job should restart its TTP
+	clock.advance(50 * time.Second)
+	err = goJobQueue.TouchJob(jobData.Id, 1)
+	if err != nil {
+		t.Errorf("Failed to touch job %v: %v", jobData.Id, err.Error())
+	}
+
+	clock.advance(50 * time.Second)
+	touched, _ := goJobQueue.GetJobData(jobData.Id)
+	if touched.Status != "reserved" {
+		t.Errorf("Touched job %v released before its refreshed TTP expired", jobData.Id)
+	}
+
+	clock.advance(10 * time.Second)
+	touched, _ = goJobQueue.GetJobData(jobData.Id)
+	if touched.Status != "ready" {
+		t.Errorf("Touched job %v not released after its refreshed TTP expired", jobData.Id)
+	}
+
+	err = goJobQueue.TouchJob(100, 1)
+	if err == nil {
+		t.Error("Touched job which doesn't exist")
+	}
+}
+
+func TestReleaseJob(t *testing.T) {
+	clock := newFakeClock()
+	goJobQueue := newGoJobQueueWithClock(clock, NewNullStore())
+
+	job1 := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	job2 := &GoJobData{Data: []byte{'2'}, Priority: 5, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(job1)
+	goJobQueue.AddJob(job2)
+
+	err := goJobQueue.ReleaseJob(job1.Id, 1, 1, 0)
+	if err == nil {
+		t.Errorf("Released job %v which was not reserved", job1.Id)
+	}
+
+	goJobQueue.ReserveJob("queue1", 1)
+	err = goJobQueue.ReleaseJob(job1.Id, 2, 1, 0)
+	if err == nil {
+		t.Errorf("Released job %v which was reserved by a different owner", job1.Id)
+	}
+
+	// Releasing with a lower priority should put the job behind job 2
+	err = goJobQueue.ReleaseJob(job1.Id, 1, 10, 0)
+	if err != nil {
+		t.Errorf("Failed to release job %v: %v", job1.Id, err.Error())
+	}
+	released, _ := goJobQueue.GetJobData(job1.Id)
+	if released.Status != "ready" || released.Priority != 10 {
+		t.Errorf("Released job has status %v and priority %v", released.Status, released.Priority)
+	}
+
+	expectedJobs := [2]uint64{job2.Id, job1.Id}
+	for _, expectedID := range expectedJobs {
+		nextJob, ok := goJobQueue.ReserveJob("queue1", 1)
+		if !ok || nextJob.Id != expectedID {
+			t.Errorf("Expected to reserve job %v", expectedID)
+		}
+	}
+
+	// Release with a delay
+	err = goJobQueue.ReleaseJob(job1.Id, 1, 1, 30)
+	if err != nil {
+		t.Errorf("Failed to release job %v: %v", job1.Id, err.Error())
+	}
+	released, _ = goJobQueue.GetJobData(job1.Id)
+	if released.Status != "delayed" {
+		t.Errorf("Job released with delay has status %v", released.Status)
+	}
+
+	clock.advance(29 * time.Second)
+	_, ok := goJobQueue.ReserveJob("queue1", 1)
+	if ok {
+		t.Errorf("Reserved delayed job before its delay passed")
+	}
+
+	clock.advance(1 * time.Second)
+	nextJob, ok := goJobQueue.ReserveJob("queue1", 1)
+	if !ok || nextJob.Id != job1.Id {
+		t.Errorf("Failed to reserve job %v after its delay passed", job1.Id)
+	}
+}
+
+func TestReleaseReservedJobs(t *testing.T) {
+	goJobQueue := newGoJobQueueWithClock(newFakeClock(), NewNullStore())
+
+	for _, queueName := range []string{"queue1", "queue1", "queue2"} {
+		goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: queueName, Timeout: 60})
+	}
+	goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.ReserveJob("queue2", 2)
+
+	released := goJobQueue.ReleaseReservedJobs()
+	if released != 2 {
+		t.Errorf("Expected 2 jobs released, got %v", released)
+	}
+
+	for id := uint64(1); id <= 3; id++ {
+		jobData, _ := goJobQueue.GetJobData(id)
+		if jobData.Status != "ready" {
+			t.Errorf("Expected job %v to be ready, got %v", id, jobData.Status)
+		}
+	}
+}
+
+func TestOperationsOnDeletedJob(t *testing.T) {
+	goJobQueue := newGoJobQueueWithClock(newFakeClock(), NewNullStore())
+
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	goJobQueue.ReserveJob("queue1", 1)
+
+	// Simulate the job being deleted after an operation has looked it up but before the operation runs
+	job, _ := goJobQueue.getJob(jobData.Id)
+	err := goJobQueue.DeleteJob(jobData.Id)
+	if err != nil {
+		t.Fatalf("Failed to delete job: " + err.Error())
+	}
+
+	priorityQueue := goJobQueue.priorityQueue("queue1")
+	if err := priorityQueue.releaseJob(job, 1, 1, 0); err == nil {
+		t.Errorf("Released deleted job")
+	}
+	if err := priorityQueue.buryJob(job, 1, 1); err == nil {
+		t.Errorf("Buried deleted job")
+	}
+	if err := priorityQueue.touchJob(job, 1); err == nil {
+		t.Errorf("Touched deleted job")
+	}
+	if goJobQueue.NumJobs() != 0 {
+		t.Errorf("Expected no jobs left, got %v", goJobQueue.NumJobs())
+	}
+}
+
+func TestCloseStopsQueues(t *testing.T) {
+	goJobQueue := newGoJobQueueWithClock(newFakeClock(), NewNullStore())
+
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	goJobQueue.ReserveJob("queue1", 1)
+
+	err := goJobQueue.Close()
+	if err != nil {
+		t.Fatalf("Failed to close queue: " + err.Error())
+	}
+
+	// The operation loop must have returned so nothing more is written to the store
+	select {
+	case <-goJobQueue.priorityQueue("queue1").done:
+	default:
+		t.Errorf("Queue operation loop still running after close")
+	}
+
+	if err := goJobQueue.ReleaseJob(jobData.Id, 1, 1, 0); err == nil {
+		t.Errorf("Released job in closed queue")
+	}
+	if err := goJobQueue.DeleteJob(jobData.Id); err == nil {
+		t.Errorf("Deleted job in closed queue")
+	}
+	if err := goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue2", Timeout: 60}); err == nil {
+		t.Errorf("Added job to closed queue")
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	clock := newFakeClock()
+	goJobQueue := newGoJobQueueWithClock(clock, NewNullStore())
+
+	if stats := goJobQueue.QueueStats("queue1"); !cmp.Equal(stats, &QueueStats{}) {
+		t.Errorf("Expected empty stats for queue which doesn't exist, got %+v", stats)
+	}
+
+	for i := 0; i < 5; i++ {
+		jobData := &GoJobData{Data: []byte{'1'}, Priority: uint32(i), Queue: "queue1", Timeout: 10}
+		if i == 4 {
+			jobData.Delay = 60
+		}
+		goJobQueue.AddJob(jobData)
+		clock.advance(time.Second)
+	}
+
+	reserved, _ := goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.DeleteJob(reserved.Id)
+	reserved, _ = goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.BuryJob(reserved.Id, 1, 1)
+	goJobQueue.ReserveJob("queue1", 1)
+
+	// Let the last reservation expire
+	clock.advance(10 * time.Second)
+	goJobQueue.ReserveJob("queue1", 1)
+
+	expected := &QueueStats{
+		Ready:          1,
+		Reserved:       1,
+		Delayed:        1,
+		Buried:         1,
+		Added:          5,
+		Deleted:        1,
+		TimedOut:       1,
+		OldestReadyAge: 12 * time.Second,
+	}
+	if stats := goJobQueue.QueueStats("queue1"); !cmp.Equal(stats, expected) {
+		t.Errorf("Unexpected queue stats: %v", cmp.Diff(expected, stats))
+	}
+}
+
+// recordingHooks is a Hooks which records the events it's told about
+type recordingHooks struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mutex.Lock()
+	h.events = append(h.events, event)
+	h.mutex.Unlock()
+}
+
+func (h *recordingHooks) JobAdded(queue string) {
+	h.record("added " + queue)
+}
+
+func (h *recordingHooks) JobReserved(queue string, timeInQueue time.Duration) {
+	h.record(fmt.Sprintf("reserved %v after %v", queue, timeInQueue))
+}
+
+func (h *recordingHooks) ReserveWaited(queue string, wait time.Duration) {
+	h.record(fmt.Sprintf("waited %v for %v", wait, queue))
+}
+
+func (h *recordingHooks) JobReleased(queue string) {
+	h.record("released " + queue)
+}
+
+func (h *recordingHooks) JobBuried(queue string) {
+	h.record("buried " + queue)
+}
+
+func (h *recordingHooks) ReservationTimedOut(queue string) {
+	h.record("timed out " + queue)
+}
+
+func (h *recordingHooks) JobDeleted(queue string) {
+	h.record("deleted " + queue)
+}
+
+func TestHooks(t *testing.T) {
+	clock := newFakeClock()
+	goJobQueue := newGoJobQueueWithClock(clock, NewNullStore())
+	hooks := &recordingHooks{}
+	goJobQueue.SetHooks(hooks)
+
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 10}
+	goJobQueue.AddJob(jobData)
+	clock.advance(2 * time.Second)
+	goJobQueue.ReserveJobWait(context.Background(), "queue1", 1)
+	goJobQueue.ReleaseJob(jobData.Id, 1, 1, 0)
+	goJobQueue.ReserveJob("queue1", 1)
+	clock.advance(10 * time.Second)
+	goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.BuryJob(jobData.Id, 1, 1)
+	goJobQueue.DeleteJob(jobData.Id)
+
+	expected := []string{
+		"added queue1",
+		"reserved queue1 after 2s",
+		"waited 0s for queue1",
+		"released queue1",
+		"reserved queue1 after 0s",
+		"timed out queue1",
+		"reserved queue1 after 0s",
+		"buried queue1",
+		"deleted queue1",
+	}
+	hooks.mutex.Lock()
+	defer hooks.mutex.Unlock()
+	if !cmp.Equal(expected, hooks.events) {
+		t.Errorf("Unexpected hook events: %v", cmp.Diff(expected, hooks.events))
+	}
+}
+
+func TestBuryAndKickJobs(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	for i := 0; i < 3; i++ {
+		jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+		goJobQueue.AddJob(jobData)
+	}
+
+	err := goJobQueue.BuryJob(1, 1, 1)
+	if err == nil {
+		t.Error("Buried job 1 which was not reserved")
+	}
+
+	// Bury all jobs giving later jobs a higher priority
+	for i := 0; i < 3; i++ {
+		reserved, _ := goJobQueue.ReserveJob("queue1", 1)
+		err = goJobQueue.BuryJob(reserved.Id, 2, 1)
+		if err == nil {
+			t.Errorf("Buried job %v which was reserved by a different owner", reserved.Id)
+		}
+
+		err = goJobQueue.BuryJob(reserved.Id, 1, uint32(10-i))
+		if err != nil {
+			t.Errorf("Failed to bury job %v: %v", reserved.Id, err.Error())
+		}
+	}
+
+	buried, _ := goJobQueue.GetJobData(1)
+	if buried.Status != "buried" {
+		t.Errorf("Buried job has status %v", buried.Status)
+	}
+
+	_, ok := goJobQueue.ReserveJob("queue1", 1)
+	if ok {
+		t.Error("Reserved job when all jobs are buried")
+	}
+
+	kicked := goJobQueue.KickJobs("queue1", 2)
+	if kicked != 2 {
+		t.Errorf("Expected to kick 2 jobs, kicked %v", kicked)
+	}
+
+	expectedJobs := [2]uint64{3, 2}
+	for _, expectedID := range expectedJobs {
+		nextJob, ok := goJobQueue.ReserveJob("queue1", 1)
+		if !ok || nextJob.Id != expectedID {
+			t.Errorf("Expected to reserve kicked job %v", expectedID)
+		}
+	}
+
+	kicked = goJobQueue.KickJobs("queue1", 2)
+	if kicked != 1 {
+		t.Errorf("Expected to kick 1 job, kicked %v", kicked)
+	}
+
+	kicked = goJobQueue.KickJobs("queue2", 2)
+	if kicked != 0 {
+		t.Errorf("Kicked %v jobs from a queue which doesn't exist", kicked)
+	}
+}
+
+func TestPeekNextJob(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	_, ok := goJobQueue.PeekNextJob("queue1", "ready")
+	if ok {
+		t.Error("Peeked job from a queue which doesn't exist")
+	}
+
+	priorities := []uint32{2, 1, 1}
+	for _, priority := range priorities {
+		jobData := &GoJobData{Data: []byte{'1'}, Priority: priority, Queue: "queue1", Timeout: 60}
+		goJobQueue.AddJob(jobData)
+	}
+	goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Delay: 20, Priority: 1, Queue: "queue1", Timeout: 60})
+	goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Delay: 10, Priority: 2, Queue: "queue1", Timeout: 60})
+
+	// Peeking should return the job which would be reserved next without reserving it
+	for i := 0; i < 2; i++ {
+		peeked, ok := goJobQueue.PeekNextJob("queue1", "ready")
+		if !ok || peeked.Id != 2 || peeked.Status != "ready" {
+			t.Errorf("Expected to peek ready job 2, got %v", peeked)
+		}
+	}
+
+	peeked, ok := goJobQueue.PeekNextJob("queue1", "delayed")
+	if !ok || peeked.Id != 5 || peeked.Status != "delayed" {
+		t.Errorf("Expected to peek delayed job 5, got %v", peeked)
+	}
+
+	_, ok = goJobQueue.PeekNextJob("queue1", "buried")
+	if ok {
+		t.Error("Peeked buried job when no jobs are buried")
+	}
+
+	_, ok = goJobQueue.PeekNextJob("queue1", "reserved")
+	if ok {
+		t.Error("Peeked job with reserved status")
+	}
+
+	reserved, _ := goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.BuryJob(reserved.Id, 1, 1)
+	peeked, ok = goJobQueue.PeekNextJob("queue1", "buried")
+	if !ok || peeked.Id != reserved.Id || peeked.Status != "buried" {
+		t.Errorf("Expected to peek buried job %v, got %v", reserved.Id, peeked)
+	}
+
+	peeked, ok = goJobQueue.PeekNextJob("queue1", "ready")
+	if !ok || peeked.Id != 3 {
+		t.Errorf("Expected to peek ready job 3, got %v", peeked)
+	}
+}
+
+func TestReserveJobWait(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	// Start two waiters one after the other
+	reserved := make([]chan *GoJobData, 2)
+	for i := range reserved {
+		reserved[i] = make(chan *GoJobData, 1)
+		go func(owner uint64, reservedJob chan<- *GoJobData) {
+			jobData, err := goJobQueue.ReserveJobWait(context.Background(), "queue1", owner)
+			if err != nil {
+				t.Errorf("Error waiting to reserve job: " + err.Error())
+			}
+			reservedJob <- jobData
+		}(uint64(i+1), reserved[i])
+
+		waitForWaiters(t, goJobQueue, "queue1", i+1)
+	}
+
+	// Jobs should be handed to the waiters in the order they started waiting
+	for i := range reserved {
+		jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+		goJobQueue.AddJob(jobData)
+
+		select {
+		case reservedJob := <-reserved[i]:
+			if reservedJob.Id != jobData.Id || reservedJob.Status != "reserved" {
+				t.Errorf("Waiter %v was given job %v with status %v, expected reserved job %v", i+1, reservedJob.Id, reservedJob.Status, jobData.Id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Waiter %v was not given job %v", i+1, jobData.Id)
+		}
+	}
+
+	// Jobs should be reserved by the waiter's owner
+	err := goJobQueue.TouchJob(2, 2)
+	if err != nil {
+		t.Errorf("Waiter does not own the job it was given: " + err.Error())
+	}
+}
+
+func TestReserveJobsWait(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	priorities := []uint32{3, 1, 2, 1}
+	for _, priority := range priorities {
+		goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: priority, Queue: "queue1", Timeout: 60})
+	}
+
+	jobs, err := goJobQueue.ReserveJobsWait(context.Background(), "queue1", 1, 3)
+	if err != nil {
+		t.Fatalf("Error reserving batch of jobs: " + err.Error())
+	}
+	reservedIDs := make([]uint64, len(jobs))
+	for i, jobData := range jobs {
+		reservedIDs[i] = jobData.Id
+		if jobData.Status != "reserved" {
+			t.Errorf("Job %v in batch has status %v", jobData.Id, jobData.Status)
+		}
+	}
+	if !cmp.Equal([]uint64{2, 4, 3}, reservedIDs) {
+		t.Errorf("Reserved jobs %v, expected 2, 4 and 3", reservedIDs)
+	}
+
+	jobs, _ = goJobQueue.ReserveJobsWait(context.Background(), "queue1", 1, 3)
+	if len(jobs) != 1 || jobs[0].Id != 1 {
+		t.Errorf("Expected to reserve only job 1, got %v", jobs)
+	}
+
+	// Waiting for a batch should return once a job is ready
+	reserved := make(chan []*GoJobData, 1)
+	go func() {
+		jobs, err := goJobQueue.ReserveJobsWait(context.Background(), "queue1", 2, 3)
+		if err != nil {
+			t.Errorf("Error waiting to reserve batch of jobs: " + err.Error())
+		}
+		reserved <- jobs
+	}()
+	waitForWaiters(t, goJobQueue, "queue1", 1)
+
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	select {
+	case jobs := <-reserved:
+		if len(jobs) != 1 || jobs[0].Id != jobData.Id {
+			t.Errorf("Waiter was given jobs %v, expected job %v", jobs, jobData.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Waiter was not given job %v", jobData.Id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = goJobQueue.ReserveJobsWait(ctx, "queue1", 1, 3)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+
+	_, err = goJobQueue.ReserveJobsWait(context.Background(), "queue1", 1, 0)
+	if err == nil {
+		t.Error("Reserved batch of 0 jobs")
+	}
+}
+
+func TestReserveJobWaitAny(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+	queueNames := []string{"queue1", "queue2", "queue3"}
+
+	goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 2, Queue: "queue1", Timeout: 60})
+	goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue2", Timeout: 60})
+	goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue3", Timeout: 60})
+
+	// Highest priority job should be reserved first with ties going to the oldest job
+	expectedJobs := []uint64{2, 3, 1}
+	for _, expectedID := range expectedJobs {
+		jobData, err := goJobQueue.ReserveJobWaitAny(context.Background(), queueNames, 1)
+		if err != nil || jobData.Id != expectedID {
+			t.Errorf("Expected to reserve job %v, got %v", expectedID, jobData)
+		}
+	}
+
+	// Waiter should be given a job added to any of the queues and then stop waiting on the others
+	reserved := make(chan *GoJobData, 1)
+	go func() {
+		jobData, err := goJobQueue.ReserveJobWaitAny(context.Background(), queueNames, 2)
+		if err != nil {
+			t.Errorf("Error waiting to reserve job: " + err.Error())
+		}
+		reserved <- jobData
+	}()
+	for _, queueName := range queueNames {
+		waitForWaiters(t, goJobQueue, queueName, 1)
+	}
+
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue3", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	select {
+	case reservedJob := <-reserved:
+		if reservedJob.Id != jobData.Id {
+			t.Errorf("Waiter was given job %v, expected job %v", reservedJob.Id, jobData.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Waiter was not given job %v", jobData.Id)
+	}
+
+	for _, queueName := range queueNames {
+		waitForWaiters(t, goJobQueue, queueName, 0)
+	}
+
+	// Job added after the waiter was given one should stay ready
+	goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60})
+	stats := goJobQueue.QueueStats("queue1")
+	if stats.Ready != 1 {
+		t.Errorf("Expected 1 ready job in queue1, got %v", stats.Ready)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := goJobQueue.ReserveJobWaitAny(ctx, []string{"queue2", "queue3"}, 1)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+	for _, queueName := range queueNames {
+		waitForWaiters(t, goJobQueue, queueName, 0)
+	}
+}
+
+func TestReserveJobWaitTimeout(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := goJobQueue.ReserveJobWait(ctx, "queue1", 1)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+
+	if waiters := goJobQueue.priorityQueue("queue1").numWaiters(); waiters != 0 {
+		t.Errorf("%v waiters left on queue after timing out", waiters)
+	}
+
+	// A job added after the waiter gave up should be left ready
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	_, ok := goJobQueue.ReserveJob("queue1", 1)
+	if !ok {
+		t.Errorf("Job added after waiter timed out could not be reserved")
+	}
+}
+
+func TestReserveJobWaitAnyMissingQueues(t *testing.T) {
+	goJobQueue := NewGoJobQueue()
+
+	// Waiting on queues which don't exist shouldn't create them
+	reserved := make(chan *GoJobData, 1)
+	go func() {
+		jobData, err := goJobQueue.ReserveJobWaitAny(context.Background(), []string{"queue1", "queue2"}, 1)
+		if err != nil {
+			t.Errorf("Error waiting to reserve job: " + err.Error())
+		}
+		reserved <- jobData
+	}()
+	waitForPendingWaiters(t, goJobQueue, "queue2", 1)
+	if queues := goJobQueue.existingQueues([]string{"queue1", "queue2"}); len(queues) != 0 {
+		t.Errorf("Expected waiting not to create queues, %v were created", len(queues))
+	}
+
+	// The queue created for a new job should hand it to the waiter which then stops waiting for the other queue
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue2", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	select {
+	case reservedJob := <-reserved:
+		if reservedJob.Id != jobData.Id {
+			t.Errorf("Waiter was given job %v, expected job %v", reservedJob.Id, jobData.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Waiter was not given job %v", jobData.Id)
+	}
+	waitForPendingWaiters(t, goJobQueue, "queue1", 0)
+
+	// A waiter which gives up should be forgotten
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := goJobQueue.ReserveJobWait(ctx, "queue3", 1)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+	waitForPendingWaiters(t, goJobQueue, "queue3", 0)
+}
+
+// waitForPendingWaiters is a helper function which waits until the given number of clients are waiting
+// for the named queue to be created.
+func waitForPendingWaiters(t *testing.T, goJobQueue *GoJobQueue, queueName string, numWaiters int) {
+	for i := 0; i < 1000; i++ {
+		goJobQueue.queueMutex.Lock()
+		pending := len(goJobQueue.pendingWaiters[queueName])
+		goJobQueue.queueMutex.Unlock()
+		if pending == numWaiters {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %v pending waiters on %v", numWaiters, queueName)
+}
+
+// waitForWaiters is a helper function which waits until the named queue has the given number of waiters
+func waitForWaiters(t *testing.T, goJobQueue *GoJobQueue, queueName string, numWaiters int) {
+	for i := 0; i < 1000; i++ {
+		if goJobQueue.priorityQueue(queueName).numWaiters() == numWaiters {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %v waiters on %v", numWaiters, queueName)
+}
+
+// fakeClock is a clock for tests whose time only moves when advance is called.
+type fakeClock struct {
+	mutex  sync.Mutex
+	time   time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a timer created by a fakeClock.
+type fakeTimer struct {
+	c     chan time.Time
+	when  time.Time
+	clock *fakeClock
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{time: time.Unix(1000000, 0)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.time
+}
+
+func (c *fakeClock) newTimer(d time.Duration) timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &fakeTimer{
+		c:     make(chan time.Time, 1),
+		when:  c.time.Add(d),
+		clock: c,
+	}
+	if d <= 0 {
+		t.c <- c.time
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+// advance moves the clock forward by the given duration, firing any timers which expire.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.time = c.time.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.time) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.time
+		}
+	}
+	c.timers = pending
+}
+
+func (t *fakeTimer) channel() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
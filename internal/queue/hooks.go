@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Hooks are told about events in a GoJobQueue, e.g. so metrics can be collected.
+// Hooks are called while the job's queue is handling an operation so they must be fast
+// and must not call back into the GoJobQueue.
+type Hooks interface {
+	// JobAdded is called when a job is added to the named queue.
+	JobAdded(queue string)
+	// JobReserved is called when a job is reserved from the named queue.
+	// timeInQueue is how long the job was ready before it was reserved.
+	JobReserved(queue string, timeInQueue time.Duration)
+	// ReserveWaited is called when a client waiting to reserve a job from the named queue gets one.
+	// wait is how long the client waited.
+	ReserveWaited(queue string, wait time.Duration)
+	// JobReleased is called when a reserved job is released back to the named queue by its owner.
+	JobReleased(queue string)
+	// JobBuried is called when a reserved job in the named queue is buried by its owner.
+	JobBuried(queue string)
+	// ReservationTimedOut is called when a reservation of a job in the named queue expires.
+	ReservationTimedOut(queue string)
+	// JobDeleted is called when a job is deleted from the named queue.
+	JobDeleted(queue string)
+}
+
+// noHooks is the Hooks used by a GoJobQueue until it's given others, which does nothing.
+type noHooks struct{}
+
+func (noHooks) JobAdded(string)                     {}
+func (noHooks) JobReserved(string, time.Duration)   {}
+func (noHooks) ReserveWaited(string, time.Duration) {}
+func (noHooks) JobReleased(string)                  {}
+func (noHooks) JobBuried(string)                    {}
+func (noHooks) ReservationTimedOut(string)          {}
+func (noHooks) JobDeleted(string)                   {}
+
+// hookHolder holds the hooks of a GoJobQueue so they can be replaced while its queues are running.
+type hookHolder struct {
+	value atomic.Value
+}
+
+// heldHooks wraps hooks so the atomic value always holds the same type.
+type heldHooks struct {
+	Hooks
+}
+
+// newHookHolder creates a hookHolder holding hooks which do nothing.
+func newHookHolder() *hookHolder {
+	holder := &hookHolder{}
+	holder.set(noHooks{})
+	return holder
+}
+
+// get returns the current hooks.
+func (h *hookHolder) get() Hooks {
+	return h.value.Load().(heldHooks).Hooks
+}
+
+// set replaces the current hooks.
+func (h *hookHolder) set(hooks Hooks) {
+	h.value.Store(heldHooks{hooks})
+}
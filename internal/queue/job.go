@@ -6,6 +6,10 @@ import (
 	"time"
 )
 
+// minReservationTimeout is the shortest time a job can be reserved for.
+// Without it a job with a TTP of 0 would be released as soon as it was reserved.
+const minReservationTimeout = 1
+
 // A Job holds all the data for a single job in the queue
 type job struct {
 	id        uint64
@@ -16,10 +20,20 @@ type job struct {
 	status   string
 
 	reservationTimeout uint32
-	reserveExpires     int64
+	reserveExpires     time.Time
+	// owner identifies who reserved the job, e.g. a client connection.
+	owner uint64
+
+	// readyAt is the time a delayed job becomes ready.
+	readyAt time.Time
+	// readySince is the time the job last became ready.
+	readySince time.Time
 
 	data []byte
 
+	// timerIndex is the index of the job in its priorityJobQueue's timers or -1 if it has no timer.
+	timerIndex int
+
 	nextJob     *job
 	previousJob *job
 }
@@ -33,18 +47,24 @@ func newJob(id uint64, queue string, priority uint32, reservationTimeout uint32,
 		status:             "ready",
 		reservationTimeout: reservationTimeout,
 		data:               data,
+		timerIndex:         -1,
 	}
 }
 
+// deleted returns whether the job has been deleted from its queue.
+func (j *job) deleted() bool {
+	return j.status == ""
+}
+
 // Reserved returns whether the job is currently reserved.
 func (j *job) reserved() bool {
 	return j.status == "reserved"
 }
 
-// Reserve reserves the job.
-// The job will be reserved for the reservation timeout.
+// Reserve reserves the job for the given owner.
+// The job will be reserved for the reservation timeout starting from the given time.
 // If the reservation timeout passes without it being refreshed the job will be released.
-func (j *job) reserve() error {
+func (j *job) reserve(now time.Time, owner uint64) error {
 	j.mutex.Lock()
 	defer j.mutex.Unlock()
 
@@ -54,24 +74,70 @@ func (j *job) reserve() error {
 
 	oldStatus := j.status
 	j.status = "reserved"
-	err := j.refreshReservation()
+	err := j.refreshReservation(now)
 	if err != nil {
 		j.status = oldStatus
 		return fmt.Errorf("Failed to reserve Job %v", j.id)
 	}
+	j.owner = owner
+
+	return nil
+}
+
+// checkOwner returns an error if the job is not reserved by the given owner.
+func (j *job) checkOwner(owner uint64) error {
+	if j.deleted() {
+		return fmt.Errorf("Job %v not found: job has been deleted", j.id)
+	}
+
+	if !j.reserved() {
+		return fmt.Errorf("Job %v is not reserved", j.id)
+	}
+
+	if j.owner != owner {
+		return fmt.Errorf("Job %v is reserved by another client", j.id)
+	}
 
 	return nil
 }
 
-// refreshReservation resets the reservation timeout.
+// refreshReservation resets the reservation timeout from the given time.
 // This allows more time to process the job.
-func (j *job) refreshReservation() error {
+func (j *job) refreshReservation(now time.Time) error {
 	if !j.reserved() {
 		return fmt.Errorf("Job %v is not reserved", j.id)
 	}
 
-	currentTime := time.Now()
-	j.reserveExpires = currentTime.Unix() + int64(j.reservationTimeout)
+	timeout := j.reservationTimeout
+	if timeout < minReservationTimeout {
+		timeout = minReservationTimeout
+	}
+	j.reserveExpires = now.Add(time.Duration(timeout) * time.Second)
 
 	return nil
 }
+
+// delay delays the job so it becomes ready the given number of seconds after the given time.
+func (j *job) delay(now time.Time, seconds uint32) {
+	j.status = "delayed"
+	j.readyAt = now.Add(time.Duration(seconds) * time.Second)
+}
+
+// delayExpired returns whether the job is delayed and its delay has passed at the given time.
+func (j *job) delayExpired(now time.Time) bool {
+	return j.status == "delayed" && !j.readyAt.After(now)
+}
+
+// reservationExpired returns whether the job is reserved and its reservation has expired at the given time.
+func (j *job) reservationExpired(now time.Time) bool {
+	return j.reserved() && !j.reserveExpires.After(now)
+}
+
+// deadline returns the time at which the job next needs attention from its queue.
+// This is when the reservation expires for reserved jobs or when the job becomes ready for delayed jobs.
+func (j *job) deadline() time.Time {
+	if j.status == "delayed" {
+		return j.readyAt
+	}
+	return j.reserveExpires
+}
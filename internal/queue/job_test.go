@@ -37,20 +37,41 @@ func TestReservation(t *testing.T) {
 		t.Error("Newly created Job is reserved")
 	}
 
-	job.reserve()
+	job.reserve(time.Now(), 1)
 	if !job.reserved() {
 		t.Error("Failed to reserved Job")
 	}
 
-	if job.reserveExpires <= time.Now().Unix() {
+	if !job.reserveExpires.After(time.Now()) {
 		t.Error("Job reserve expiry time not after now")
 	}
 
 	oldExpiry := job.reserveExpires
 	time.Sleep(1000 * time.Millisecond)
 
-	job.refreshReservation()
-	if job.reserveExpires <= oldExpiry {
+	job.refreshReservation(time.Now())
+	if !job.reserveExpires.After(oldExpiry) {
 		t.Error("Failed to refresh the Job reservation")
 	}
+
+	if job.checkOwner(1) != nil {
+		t.Error("Job not owned by the client which reserved it")
+	}
+	if job.checkOwner(2) == nil {
+		t.Error("Job owned by a client which did not reserve it")
+	}
+}
+
+func TestReservationExpired(t *testing.T) {
+	now := time.Now()
+	job := newJob(1, "queue1", 2, 0, []byte{'2', '3', '4'})
+
+	job.reserve(now, 1)
+	if job.reservationExpired(now) {
+		t.Error("Job with a TTP of 0 expired as soon as it was reserved")
+	}
+
+	if !job.reservationExpired(now.Add(minReservationTimeout * time.Second)) {
+		t.Error("Job reservation did not expire after the minimum TTP")
+	}
 }
@@ -51,6 +51,38 @@ func (q *jobQueue) addJob(job *job) {
 	q.lastJob = job
 }
 
+// forEachJob calls fn for every job in the queue in priority order.
+func (q *jobQueue) forEachJob(fn func(*job)) {
+	if q == nil {
+		return
+	}
+
+	q.leftQueue.forEachJob(fn)
+	for job := q.firstJob; job != nil; job = job.nextJob {
+		fn(job)
+	}
+	q.rightQueue.forEachJob(fn)
+}
+
+// peekNextJob returns the next job in the queue without removing it.
+// The second return value is false if there are no jobs in the queue.
+func (q *jobQueue) peekNextJob() (*job, bool) {
+	if q == nil {
+		return nil, false
+	}
+
+	higherPriJob, ok := q.leftQueue.peekNextJob()
+	if ok {
+		return higherPriJob, true
+	}
+
+	if q.firstJob != nil {
+		return q.firstJob, true
+	}
+
+	return q.rightQueue.peekNextJob()
+}
+
 // getNextJob gets the next job in the queue, removes it from the queue and returns it.
 // Te second return value is false if there are no jobs in the queue.
 func (q *jobQueue) getNextJob() (*job, bool) {
@@ -80,6 +112,7 @@ func (q *jobQueue) getNextJob() (*job, bool) {
 	} else {
 		q.firstJob.previousJob = nil
 	}
+	nextJob.nextJob = nil
 
 	return nextJob, true
 }
@@ -52,3 +52,27 @@ func TestRemovingJobs(t *testing.T) {
 		queue.removeJob(jobs[jobIndex])
 	}
 }
+
+func TestRequeuingJobs(t *testing.T) {
+	queue1 := newJobQueue(2)
+	queue2 := newJobQueue(2)
+
+	job1 := newJob(1, "queue1", 2, 60, []byte{'1', '2', '3'})
+	job2 := newJob(2, "queue1", 2, 60, []byte{'2', '3', '4'})
+	queue1.addJob(job1)
+	queue1.addJob(job2)
+
+	// Moving a job to another queue should not leave it linked to jobs in the old queue
+	nextJob, _ := queue1.getNextJob()
+	queue2.addJob(nextJob)
+
+	nextJob, ok := queue2.getNextJob()
+	if !ok || nextJob.id != job1.id {
+		t.Errorf("Expected to get job 1 from second queue")
+	}
+
+	_, ok = queue2.getNextJob()
+	if ok {
+		t.Errorf("Got job from second queue which should be empty")
+	}
+}
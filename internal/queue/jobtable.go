@@ -0,0 +1,69 @@
+package queue
+
+import "sort"
+
+// A jobTable holds the state of the jobs in a persistent store so it can write a snapshot of them
+// and hand them back when the store is opened. Stored jobs share their data with the queue's jobs,
+// so only their state is held twice.
+// A jobTable isn't safe for concurrent use; the store holding it must serialise access.
+type jobTable struct {
+	jobs      map[uint64]*StoredJob
+	lastJobID uint64
+}
+
+// newJobTable creates a new empty jobTable.
+func newJobTable() *jobTable {
+	return &jobTable{jobs: make(map[uint64]*StoredJob)}
+}
+
+// apply applies a record of a change to a job to the table.
+// Stored jobs are replaced rather than changed so copies of the table aren't affected.
+func (t *jobTable) apply(record *jobRecord) {
+	switch record.recordType {
+	case recordPut:
+		t.setLastJobID(record.id)
+		t.jobs[record.id] = record.storedJob()
+	case recordUpdate:
+		job, ok := t.jobs[record.id]
+		if !ok {
+			return
+		}
+		updated := *job
+		updated.Status = record.status
+		updated.Priority = record.priority
+		updated.Deadline = record.deadlineTime()
+		t.jobs[record.id] = &updated
+	case recordDelete:
+		t.setLastJobID(record.id)
+		delete(t.jobs, record.id)
+	}
+}
+
+// setLastJobID records the ID as the last job ID if it's higher than any seen so far.
+func (t *jobTable) setLastJobID(id uint64) {
+	if id > t.lastJobID {
+		t.lastJobID = id
+	}
+}
+
+// copy returns a copy of the table which is not affected by later changes.
+func (t *jobTable) copy() *jobTable {
+	jobs := make(map[uint64]*StoredJob, len(t.jobs))
+	for id, job := range t.jobs {
+		jobs[id] = job
+	}
+	return &jobTable{jobs: jobs, lastJobID: t.lastJobID}
+}
+
+// sortedJobs returns all jobs in ID order.
+func (t *jobTable) sortedJobs() []*StoredJob {
+	jobs := make([]*StoredJob, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Id < jobs[j].Id
+	})
+	return jobs
+}
@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJobTable(t *testing.T) {
+	table := newJobTable()
+	for i := uint64(1); i <= 4; i++ {
+		table.apply(putRecord(&StoredJob{Data: []byte{byte(i)}, Id: i, Priority: 1, Queue: "queue1", Status: "ready", Timeout: 60}))
+	}
+
+	copied := table.copy()
+	deadline := time.Unix(100, 0)
+	table.apply(updateRecord(3, "reserved", 2, deadline))
+	table.apply(updateRecord(5, "reserved", 2, deadline))
+	table.apply(deleteRecord(4))
+
+	if table.lastJobID != 4 {
+		t.Errorf("Expected last job ID 4 after deleting job 4, got %v", table.lastJobID)
+	}
+
+	ids := make([]uint64, 0)
+	for _, job := range table.sortedJobs() {
+		ids = append(ids, job.Id)
+	}
+	if expected := []uint64{1, 2, 3}; !cmp.Equal(expected, ids) {
+		t.Errorf("Expected jobs %v, got %v", expected, ids)
+	}
+
+	updated := table.jobs[3]
+	if updated.Status != "reserved" || updated.Priority != 2 || !updated.Deadline.Equal(deadline) {
+		t.Errorf("Job not updated: %+v", updated)
+	}
+
+	// Changes after a copy is taken shouldn't affect it
+	if len(copied.jobs) != 4 || copied.jobs[3].Status != "ready" {
+		t.Errorf("Copy of table changed: %+v", copied.jobs)
+	}
+}
@@ -0,0 +1,42 @@
+package queue
+
+import "time"
+
+// A NullStore is a Store which doesn't persist any jobs so they are lost when the process exits.
+// It's the default store of a GoJobQueue.
+type NullStore struct{}
+
+// NewNullStore creates a new NullStore.
+func NewNullStore() *NullStore {
+	return &NullStore{}
+}
+
+// PutJob does nothing as jobs aren't stored.
+func (s *NullStore) PutJob(job *StoredJob) error {
+	return nil
+}
+
+// UpdateJob does nothing as jobs aren't stored.
+func (s *NullStore) UpdateJob(id uint64, status string, priority uint32, deadline time.Time) error {
+	return nil
+}
+
+// DeleteJob does nothing as jobs aren't stored.
+func (s *NullStore) DeleteJob(id uint64) error {
+	return nil
+}
+
+// Jobs never calls fn as no jobs are stored.
+func (s *NullStore) Jobs(fn func(*StoredJob) error) error {
+	return nil
+}
+
+// LastJobID always returns 0 as no jobs are stored.
+func (s *NullStore) LastJobID() uint64 {
+	return 0
+}
+
+// Close does nothing as there is nothing to persist.
+func (s *NullStore) Close() error {
+	return nil
+}
@@ -1,14 +1,49 @@
 package queue
 
-import "log"
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cswilson90/goqueue/internal/logging"
+)
 
 // priorityJobQueue is a priority queue of jobs.
 type priorityJobQueue struct {
 	statusQueues map[string]*jobQueue
 
 	operations chan priorityQueueOperation
+
+	// stopped is closed to stop the operation loop, which closes done once it has returned
+	stopped chan struct{}
+	done    chan struct{}
+
+	// waiters are waiting for a job to become ready, oldest first
+	waiters []*reserveWaiter
+
+	// store holds the state of the jobs in the queue and has every change to them written through to it
+	store Store
+
+	// hooks are told about changes to jobs in the queue
+	hooks *hookHolder
+
+	// added, deleted and timedOut count jobs added to and deleted from the queue
+	// and reservations which expired since the queue was created.
+	added    uint64
+	deleted  uint64
+	timedOut uint64
+
+	// timers tracks jobs with deadlines such as reservation expiry.
+	// wakeUpTimer fires when the earliest deadline passes.
+	clock       clock
+	timers      jobTimers
+	wakeUpTimer timer
+	wakeUpAt    time.Time
 }
 
+// errQueueStopped is returned by operations which change jobs once their queue has been stopped.
+var errQueueStopped = errors.New("Queue has been closed")
+
 // priorityQueueOperation defines the interface for an operation on a priorityJobQueue
 // e.g. reserve, delete etc.
 type priorityQueueOperation interface {
@@ -18,11 +53,14 @@ type priorityQueueOperation interface {
 // A priorityQueueOperationReponse is a response object from a priority queue operation.
 type priorityQueueOperationReponse struct {
 	success bool
-	job     *job
+	jobData *GoJobData
+	jobs    []*GoJobData
+	err     error
 }
 
-// newPriorityJobQueue creates a new priorityJobQueue.
-func newPriorityJobQueue() *priorityJobQueue {
+// newPriorityJobQueue creates a new priorityJobQueue which uses the given clock for reservation timeouts
+// writes changes to its jobs through to the given store and tells the given hooks about them.
+func newPriorityJobQueue(clock clock, store Store, hooks *hookHolder) *priorityJobQueue {
 	queue := &priorityJobQueue{
 		statusQueues: map[string]*jobQueue{
 			"reserved": nil,
@@ -31,6 +69,11 @@ func newPriorityJobQueue() *priorityJobQueue {
 			"buried":   nil,
 		},
 		operations: make(chan priorityQueueOperation),
+		stopped:    make(chan struct{}),
+		done:       make(chan struct{}),
+		clock:      clock,
+		store:      store,
+		hooks:      hooks,
 	}
 	go queue.doOperations()
 	return queue
@@ -53,56 +96,231 @@ func (p *priorityJobQueue) getStatusQueue(job *job) *jobQueue {
 }
 
 // doOperations performs all operations in the queue one at a time reading from the operations channel.
+// Expired reservations and delays are handled before each operation and whenever the earliest one expires.
 func (p *priorityJobQueue) doOperations() {
+	defer close(p.done)
 	for {
-		op, ok := <-p.operations
-		if !ok {
-			break
+		select {
+		case op := <-p.operations:
+			p.reapJobs()
+			op.doOperation(p)
+		case <-p.wakeUp():
+			p.wakeUpTimer = nil
+			p.reapJobs()
+		case <-p.stopped:
+			p.stopWakeUp()
+			return
 		}
-		op.doOperation(p)
 	}
 }
 
-// addJob adds the given job to the queue.
-func (p *priorityJobQueue) addJob(job *job) {
+// stop stops the queue's operation loop and timers, waiting for any operation being done to finish,
+// so nothing more is written to the store. Operations on a stopped queue fail or find no jobs.
+func (p *priorityJobQueue) stop() {
+	close(p.stopped)
+	<-p.done
+}
+
+// send sends the operation to the queue's operation loop.
+// Returns false without sending it if the queue has been stopped.
+func (p *priorityJobQueue) send(op priorityQueueOperation) bool {
+	select {
+	case p.operations <- op:
+		return true
+	case <-p.stopped:
+		return false
+	}
+}
+
+// makeReady moves the given job, which must not be in any status queue, to the ready queue.
+// If there are clients waiting to reserve a job it is reserved by the oldest instead.
+func (p *priorityJobQueue) makeReady(job *job) {
+	job.status = "ready"
+	job.owner = 0
+	job.readySince = p.clock.now()
+	if p.handToWaiter(job) {
+		return
+	}
+	p.getStatusQueue(job).addJob(job)
+	p.storeChange(job)
+}
+
+// reserve reserves the given ready job, which must not be in any status queue, for the given owner.
+func (p *priorityJobQueue) reserve(job *job, owner uint64) {
+	now := p.clock.now()
+	err := job.reserve(now, owner)
+	if err != nil {
+		log.Fatalf("Failed to reserve job %v from ready queue: %v\n", job.id, err.Error())
+	}
+	p.hooks.get().JobReserved(job.queueName, now.Sub(job.readySince))
+	p.getStatusQueue(job).addJob(job)
+	p.startTimer(job)
+	p.storeChange(job)
+}
+
+// storeChange writes the current state of the job through to the queue's store.
+func (p *priorityJobQueue) storeChange(job *job) {
+	storedJob := newStoredJob(job)
+	err := p.store.UpdateJob(job.id, storedJob.Status, storedJob.Priority, storedJob.Deadline)
+	if err != nil {
+		logging.Errorf("Failed to store change to job %v: %v", job.id, err.Error())
+	}
+}
+
+// storeDelete deletes the job from the queue's store.
+func (p *priorityJobQueue) storeDelete(job *job) {
+	err := p.store.DeleteJob(job.id)
+	if err != nil {
+		logging.Errorf("Failed to delete job %v from store: %v", job.id, err.Error())
+	}
+}
+
+// addJob adds the given job, which must be ready or delayed, to the queue.
+// Returns an error if the queue has been stopped.
+func (p *priorityJobQueue) addJob(jobToAdd *job) error {
+	return p.addJobs([]*job{jobToAdd})
+}
+
+// addJobs adds the given jobs, which must be ready or delayed, to the queue in a single operation
+// so no job can be reserved before all of them have been added.
+// Returns an error if the queue has been stopped.
+func (p *priorityJobQueue) addJobs(jobs []*job) error {
 	op := &priorityQueueAdd{
-		jobToAdd: job,
-		response: make(chan *priorityQueueOperationReponse),
+		jobsToAdd: jobs,
+		response:  make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return errQueueStopped
 	}
-	p.operations <- op
 
 	// Wait for response before returning
 	_ = <-op.response
+	return nil
 }
 
 // A priorityQueueAdd encapsulates an add operation
 type priorityQueueAdd struct {
-	jobToAdd *job
-	response chan *priorityQueueOperationReponse
+	jobsToAdd []*job
+	response  chan *priorityQueueOperationReponse
 }
 
-// doOperation does the operation to add the job to the queue
+// doOperation does the operation to add the jobs to the queue
+// The jobs have already been stored so only changes after adding them are stored.
 func (o *priorityQueueAdd) doOperation(q *priorityJobQueue) {
-	statusQueue := q.getStatusQueue(o.jobToAdd)
-	statusQueue.addJob(o.jobToAdd)
+	for _, jobToAdd := range o.jobsToAdd {
+		q.added++
+		q.hooks.get().JobAdded(jobToAdd.queueName)
+		if jobToAdd.status == "delayed" {
+			q.getStatusQueue(jobToAdd).addJob(jobToAdd)
+			q.startTimer(jobToAdd)
+		} else {
+			jobToAdd.readySince = q.clock.now()
+			if !q.handToWaiter(jobToAdd) {
+				q.getStatusQueue(jobToAdd).addJob(jobToAdd)
+			}
+		}
+	}
+
 	o.response <- &priorityQueueOperationReponse{success: true}
 }
 
-// reserveJob gets the next ready job in the queue and reserves it.
+// restoreJob adds a job loaded from the store to the queue in the status it was stored with.
+func (p *priorityJobQueue) restoreJob(job *job) {
+	op := &priorityQueueRestore{
+		jobToRestore: job,
+		response:     make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return
+	}
+
+	// Wait for response before returning
+	_ = <-op.response
+}
+
+// A priorityQueueRestore encapsulates an operation to restore a recovered job
+type priorityQueueRestore struct {
+	jobToRestore *job
+	response     chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to restore a job
+// Reservations and delays which expired while the queue was stopped are handled before the next operation.
+func (o *priorityQueueRestore) doOperation(q *priorityJobQueue) {
+	job := o.jobToRestore
+	q.getStatusQueue(job).addJob(job)
+	if job.status == "reserved" || job.status == "delayed" {
+		q.startTimer(job)
+	} else if job.status == "ready" {
+		job.readySince = q.clock.now()
+	}
+
+	o.response <- &priorityQueueOperationReponse{success: true}
+}
+
+// reserveJob gets the next ready job in the queue, reserves it for the given owner and returns a copy of its data.
 // Second returned value is false if there is no job that can be reserved.
-func (p *priorityJobQueue) reserveJob() (*job, bool) {
+func (p *priorityJobQueue) reserveJob(owner uint64) (*GoJobData, bool) {
+	op := &priorityQueueReserve{
+		owner:    owner,
+		response: make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return nil, false
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.jobData, opResponse.success
+}
+
+// reserveJobs reserves up to max ready jobs in priority order for the given owner in a single operation
+// and returns copies of their data. Returns no jobs if there are none ready or max is less than 1.
+func (p *priorityJobQueue) reserveJobs(owner uint64, max int) []*GoJobData {
+	if max < 1 {
+		return nil
+	}
+
 	op := &priorityQueueReserve{
+		owner:    owner,
+		max:      max,
 		response: make(chan *priorityQueueOperationReponse),
 	}
-	p.operations <- op
+	if !p.send(op) {
+		return nil
+	}
 
 	// Wait for response before returning
 	opResponse := <-op.response
-	return opResponse.job, opResponse.success
+	return opResponse.jobs
+}
+
+// reserveJobOrWait reserves the next ready job in the queue for the waiter's owner.
+// If there is no job ready the waiter is added to the queue's waiters and will be sent
+// the next job that becomes ready. Returns false if the waiter has to wait, or if it
+// has already been claimed by another queue it's waiting on.
+func (p *priorityJobQueue) reserveJobOrWait(waiter *reserveWaiter) (*GoJobData, bool) {
+	op := &priorityQueueReserve{
+		owner:    waiter.owner,
+		waiter:   waiter,
+		response: make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return nil, false
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.jobData, opResponse.success
 }
 
 // A priorityQueueOperation encapsulates a reserve operation
+// If the operation has a waiter it waits for a job when there is none ready.
+// If the operation has a max it reserves up to that many jobs instead of one.
 type priorityQueueReserve struct {
+	owner    uint64
+	waiter   *reserveWaiter
+	max      int
 	response chan *priorityQueueOperationReponse
 }
 
@@ -110,37 +328,128 @@ type priorityQueueReserve struct {
 func (o *priorityQueueReserve) doOperation(q *priorityJobQueue) {
 	statusQueue := q.statusQueues["ready"]
 
-	if statusQueue == nil {
-		o.response <- &priorityQueueOperationReponse{success: false}
+	if o.max > 0 {
+		var jobs []*GoJobData
+		for statusQueue != nil && len(jobs) < o.max {
+			reservedJob, ok := statusQueue.getNextJob()
+			if !ok {
+				break
+			}
+			q.reserve(reservedJob, o.owner)
+			jobs = append(jobs, internalJobToData(reservedJob))
+		}
+		o.response <- &priorityQueueOperationReponse{success: len(jobs) > 0, jobs: jobs}
 		return
 	}
 
-	reservedJob, ok := statusQueue.getNextJob()
-	if ok {
-		err := reservedJob.reserve()
-		if err != nil {
-			log.Fatalf("Failed to reserve job %v from ready queue: %v\n", reservedJob.id, err.Error())
-		}
-		newQueue := q.getStatusQueue(reservedJob)
-		newQueue.addJob(reservedJob)
-		o.response <- &priorityQueueOperationReponse{success: true, job: reservedJob}
+	_, ready := statusQueue.peekNextJob()
+
+	// A waiter may be waiting on other queues too so it must be claimed before a job is reserved for it
+	if ready && (o.waiter == nil || o.waiter.claim()) {
+		reservedJob, _ := statusQueue.getNextJob()
+		q.reserve(reservedJob, o.owner)
+		o.response <- &priorityQueueOperationReponse{success: true, jobData: internalJobToData(reservedJob)}
 		return
 	}
 
+	if o.waiter != nil && !ready {
+		q.addWaiter(o.waiter)
+	}
+
 	o.response <- &priorityQueueOperationReponse{success: false}
-	return
 }
 
-// deleteJob deletes the given job from the queue
-func (p *priorityJobQueue) deleteJob(job *job) {
+// cancelWait stops the waiter waiting for a job from the queue.
+func (p *priorityJobQueue) cancelWait(waiter *reserveWaiter) {
+	op := &priorityQueueCancelWait{
+		waiter:   waiter,
+		response: make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return
+	}
+
+	// Wait for response before returning
+	_ = <-op.response
+}
+
+// A priorityQueueCancelWait encapsulates an operation to stop a waiter waiting for a job
+type priorityQueueCancelWait struct {
+	waiter   *reserveWaiter
+	response chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to remove a waiter
+func (o *priorityQueueCancelWait) doOperation(q *priorityJobQueue) {
+	q.removeWaiter(o.waiter)
+	o.response <- &priorityQueueOperationReponse{success: true}
+}
+
+// addWaiters adds waiters which were waiting for the queue to be created to its waiters.
+func (p *priorityJobQueue) addWaiters(waiters []*reserveWaiter) {
+	op := &priorityQueueAddWaiters{
+		waiters:  waiters,
+		response: make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return
+	}
+
+	// Wait for response before returning
+	_ = <-op.response
+}
+
+// A priorityQueueAddWaiters encapsulates an operation to add waiters to a queue
+type priorityQueueAddWaiters struct {
+	waiters  []*reserveWaiter
+	response chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to add waiters
+func (o *priorityQueueAddWaiters) doOperation(q *priorityJobQueue) {
+	for _, waiter := range o.waiters {
+		q.addWaiter(waiter)
+	}
+	o.response <- &priorityQueueOperationReponse{success: true}
+}
+
+// numWaiters returns the number of clients waiting to reserve a job from the queue.
+func (p *priorityJobQueue) numWaiters() int {
+	op := &priorityQueueNumWaiters{
+		response: make(chan int),
+	}
+	if !p.send(op) {
+		return 0
+	}
+
+	// Wait for response before returning
+	return <-op.response
+}
+
+// A priorityQueueNumWaiters encapsulates an operation to count the waiters on a queue
+type priorityQueueNumWaiters struct {
+	response chan int
+}
+
+// doOperation does the operation to count waiters
+func (o *priorityQueueNumWaiters) doOperation(q *priorityJobQueue) {
+	o.response <- len(q.waiters)
+}
+
+// deleteJob deletes the given job from the queue.
+// Returns an error if the queue has been stopped.
+func (p *priorityJobQueue) deleteJob(job *job) error {
 	op := &priorityQueueDelete{
 		jobToDelete: job,
 		response:    make(chan *priorityQueueOperationReponse),
 	}
-	p.operations <- op
+	if !p.send(op) {
+		return errQueueStopped
+	}
 
 	// Wait for response before returning
 	_ = <-op.response
+	return nil
 }
 
 // A priorityQueueAdd encapsulates a add operation
@@ -149,9 +458,379 @@ type priorityQueueDelete struct {
 	response    chan *priorityQueueOperationReponse
 }
 
-// doOperation does the operation to delete a job
+// doOperation does the operation to delete a job.
+// The job is marked as deleted so operations on it which were already waiting fail rather than
+// trying to remove it from a status queue again.
 func (o *priorityQueueDelete) doOperation(q *priorityJobQueue) {
 	statusQueue := q.getStatusQueue(o.jobToDelete)
 	statusQueue.removeJob(o.jobToDelete)
+	q.stopTimer(o.jobToDelete)
+	o.jobToDelete.status = ""
+	o.jobToDelete.owner = 0
+	q.storeDelete(o.jobToDelete)
+	q.deleted++
+	q.hooks.get().JobDeleted(o.jobToDelete.queueName)
 	o.response <- &priorityQueueOperationReponse{success: true}
 }
+
+// touchJob refreshes the reservation of the given job which must be reserved by the given owner.
+// Returns an error if the job is not reserved by the owner.
+func (p *priorityJobQueue) touchJob(job *job, owner uint64) error {
+	op := &priorityQueueTouch{
+		jobToTouch: job,
+		owner:      owner,
+		response:   make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return errQueueStopped
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.err
+}
+
+// A priorityQueueTouch encapsulates a touch operation
+type priorityQueueTouch struct {
+	jobToTouch *job
+	owner      uint64
+	response   chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to refresh a job's reservation
+func (o *priorityQueueTouch) doOperation(q *priorityJobQueue) {
+	err := o.jobToTouch.checkOwner(o.owner)
+	if err != nil {
+		o.response <- &priorityQueueOperationReponse{success: false, err: err}
+		return
+	}
+
+	err = o.jobToTouch.refreshReservation(q.clock.now())
+	if err != nil {
+		o.response <- &priorityQueueOperationReponse{success: false, err: err}
+		return
+	}
+	q.resetTimer(o.jobToTouch)
+	q.storeChange(o.jobToTouch)
+
+	o.response <- &priorityQueueOperationReponse{success: true}
+}
+
+// releaseJob releases the given job, which must be reserved by the given owner, with a new priority.
+// The job is moved to the ready queue or if delay is non-zero to the delayed queue for that many seconds.
+// Returns an error if the job is not reserved by the owner.
+func (p *priorityJobQueue) releaseJob(job *job, owner uint64, priority uint32, delay uint32) error {
+	op := &priorityQueueRelease{
+		jobToRelease: job,
+		owner:        owner,
+		priority:     priority,
+		delay:        delay,
+		response:     make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return errQueueStopped
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.err
+}
+
+// A priorityQueueRelease encapsulates a release operation
+type priorityQueueRelease struct {
+	jobToRelease *job
+	owner        uint64
+	priority     uint32
+	delay        uint32
+	response     chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to release a job
+func (o *priorityQueueRelease) doOperation(q *priorityJobQueue) {
+	job := o.jobToRelease
+	err := job.checkOwner(o.owner)
+	if err != nil {
+		o.response <- &priorityQueueOperationReponse{success: false, err: err}
+		return
+	}
+
+	q.getStatusQueue(job).removeJob(job)
+	q.stopTimer(job)
+	q.hooks.get().JobReleased(job.queueName)
+
+	job.priority = o.priority
+	job.owner = 0
+	if o.delay > 0 {
+		job.delay(q.clock.now(), o.delay)
+		q.getStatusQueue(job).addJob(job)
+		q.startTimer(job)
+		q.storeChange(job)
+	} else {
+		q.makeReady(job)
+	}
+
+	o.response <- &priorityQueueOperationReponse{success: true}
+}
+
+// buryJob buries the given job, which must be reserved by the given owner, with a new priority.
+// Buried jobs can't be reserved until they are kicked back to the ready queue.
+// Returns an error if the job is not reserved by the owner.
+func (p *priorityJobQueue) buryJob(job *job, owner uint64, priority uint32) error {
+	op := &priorityQueueBury{
+		jobToBury: job,
+		owner:     owner,
+		priority:  priority,
+		response:  make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return errQueueStopped
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.err
+}
+
+// A priorityQueueBury encapsulates a bury operation
+type priorityQueueBury struct {
+	jobToBury *job
+	owner     uint64
+	priority  uint32
+	response  chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to bury a job
+func (o *priorityQueueBury) doOperation(q *priorityJobQueue) {
+	job := o.jobToBury
+	err := job.checkOwner(o.owner)
+	if err != nil {
+		o.response <- &priorityQueueOperationReponse{success: false, err: err}
+		return
+	}
+
+	q.getStatusQueue(job).removeJob(job)
+	q.stopTimer(job)
+	q.hooks.get().JobBuried(job.queueName)
+
+	job.priority = o.priority
+	job.owner = 0
+	job.status = "buried"
+	q.getStatusQueue(job).addJob(job)
+	q.storeChange(job)
+
+	o.response <- &priorityQueueOperationReponse{success: true}
+}
+
+// kickJobs moves up to count buried jobs back to the ready queue in priority order.
+// Returns the number of jobs kicked.
+func (p *priorityJobQueue) kickJobs(count uint32) uint32 {
+	op := &priorityQueueKick{
+		count:    count,
+		response: make(chan uint32),
+	}
+	if !p.send(op) {
+		return 0
+	}
+
+	// Wait for response before returning
+	return <-op.response
+}
+
+// A priorityQueueKick encapsulates a kick operation
+type priorityQueueKick struct {
+	count    uint32
+	response chan uint32
+}
+
+// doOperation does the operation to kick buried jobs
+func (o *priorityQueueKick) doOperation(q *priorityJobQueue) {
+	buriedQueue := q.statusQueues["buried"]
+
+	var kicked uint32
+	for buriedQueue != nil && kicked < o.count {
+		job, ok := buriedQueue.getNextJob()
+		if !ok {
+			break
+		}
+		q.makeReady(job)
+		kicked++
+	}
+
+	o.response <- kicked
+}
+
+// releaseAll releases every reserved job in the queue back to the ready queue.
+// Returns the number of jobs released.
+func (p *priorityJobQueue) releaseAll() uint32 {
+	op := &priorityQueueReleaseAll{
+		response: make(chan uint32),
+	}
+	if !p.send(op) {
+		return 0
+	}
+
+	// Wait for response before returning
+	return <-op.response
+}
+
+// A priorityQueueReleaseAll encapsulates an operation to release all reserved jobs
+type priorityQueueReleaseAll struct {
+	response chan uint32
+}
+
+// doOperation does the operation to release all reserved jobs
+func (o *priorityQueueReleaseAll) doOperation(q *priorityJobQueue) {
+	reservedQueue := q.statusQueues["reserved"]
+
+	var released uint32
+	for reservedQueue != nil {
+		job, ok := reservedQueue.getNextJob()
+		if !ok {
+			break
+		}
+		q.stopTimer(job)
+		q.makeReady(job)
+		released++
+	}
+
+	o.response <- released
+}
+
+// stats returns statistics about the queue.
+func (p *priorityJobQueue) stats() *QueueStats {
+	op := &priorityQueueStats{
+		response: make(chan *QueueStats),
+	}
+	if !p.send(op) {
+		return &QueueStats{}
+	}
+
+	// Wait for response before returning
+	return <-op.response
+}
+
+// A priorityQueueStats encapsulates an operation to get statistics about the queue
+type priorityQueueStats struct {
+	response chan *QueueStats
+}
+
+// doOperation does the operation to get statistics about the queue
+func (o *priorityQueueStats) doOperation(q *priorityJobQueue) {
+	now := q.clock.now()
+	stats := &QueueStats{
+		Added:    q.added,
+		Deleted:  q.deleted,
+		TimedOut: q.timedOut,
+		Waiting:  uint64(len(q.waiters)),
+	}
+
+	q.statusQueues["ready"].forEachJob(func(job *job) {
+		stats.Ready++
+		if age := now.Sub(job.readySince); age > stats.OldestReadyAge {
+			stats.OldestReadyAge = age
+		}
+	})
+	q.statusQueues["reserved"].forEachJob(func(*job) { stats.Reserved++ })
+	q.statusQueues["delayed"].forEachJob(func(*job) { stats.Delayed++ })
+	q.statusQueues["buried"].forEachJob(func(*job) { stats.Buried++ })
+
+	o.response <- stats
+}
+
+// peekJob returns a copy of the data for the next job with the given status without changing it.
+// The next ready or buried job is the one which would be reserved or kicked next and the next delayed job
+// is the one which becomes ready soonest. The second return value is false if there are no jobs with the status.
+func (p *priorityJobQueue) peekJob(status string) (*GoJobData, bool) {
+	op := &priorityQueuePeek{
+		status:   status,
+		response: make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return nil, false
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.jobData, opResponse.success
+}
+
+// A priorityQueuePeek encapsulates an operation to peek at the next job with a status
+type priorityQueuePeek struct {
+	status   string
+	response chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to peek at the next job with a status
+func (o *priorityQueuePeek) doOperation(q *priorityJobQueue) {
+	var nextJob *job
+	if o.status == "delayed" {
+		q.statusQueues["delayed"].forEachJob(func(job *job) {
+			if nextJob == nil || job.readyAt.Before(nextJob.readyAt) {
+				nextJob = job
+			}
+		})
+	} else {
+		nextJob, _ = q.statusQueues[o.status].peekNextJob()
+	}
+
+	if nextJob == nil {
+		o.response <- &priorityQueueOperationReponse{success: false}
+		return
+	}
+	o.response <- &priorityQueueOperationReponse{success: true, jobData: internalJobToData(nextJob)}
+}
+
+// getJobData returns a copy of the data for the given job, or nil if the queue has been stopped.
+// The copy is taken inside the queue's operation loop so it is consistent with other operations.
+func (p *priorityJobQueue) getJobData(job *job) *GoJobData {
+	op := &priorityQueueGet{
+		jobToGet: job,
+		response: make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return nil
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.jobData
+}
+
+// A priorityQueueGet encapsulates an operation to get the data for a job
+type priorityQueueGet struct {
+	jobToGet *job
+	response chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to get the data for a job
+func (o *priorityQueueGet) doOperation(q *priorityJobQueue) {
+	o.response <- &priorityQueueOperationReponse{success: true, jobData: internalJobToData(o.jobToGet)}
+}
+
+// isReservedBy returns whether the given job is reserved by the given owner.
+func (p *priorityJobQueue) isReservedBy(job *job, owner uint64) bool {
+	op := &priorityQueueCheckOwner{
+		jobToCheck: job,
+		owner:      owner,
+		response:   make(chan *priorityQueueOperationReponse),
+	}
+	if !p.send(op) {
+		return false
+	}
+
+	// Wait for response before returning
+	opResponse := <-op.response
+	return opResponse.success
+}
+
+// A priorityQueueCheckOwner encapsulates an operation to check who has reserved a job
+type priorityQueueCheckOwner struct {
+	jobToCheck *job
+	owner      uint64
+	response   chan *priorityQueueOperationReponse
+}
+
+// doOperation does the operation to check who has reserved a job
+func (o *priorityQueueCheckOwner) doOperation(q *priorityJobQueue) {
+	o.response <- &priorityQueueOperationReponse{success: o.jobToCheck.checkOwner(o.owner) == nil}
+}
@@ -1,11 +1,14 @@
 package queue
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestPriorityQueuing(t *testing.T) {
-	queue := newPriorityJobQueue()
+	queue := newPriorityJobQueue(realClock{}, NewNullStore(), newHookHolder())
 
-	_, ok := queue.reserveJob()
+	_, ok := queue.reserveJob(1)
 	if ok {
 		t.Error("Expected nil when trying to reserve job from new empty queue")
 	}
@@ -18,21 +21,53 @@ func TestPriorityQueuing(t *testing.T) {
 
 	expectedJobs := [6]uint64{2, 4, 1, 5, 6, 3}
 	for _, expectedID := range expectedJobs {
-		nextJob, ok := queue.reserveJob()
+		nextJob, ok := queue.reserveJob(1)
 		if !ok {
 			t.Errorf("Failed to reserve job, expected job %v", expectedID)
 		}
-		if nextJob.id != expectedID {
-			t.Errorf("Reserved job %v, expected %v", nextJob.id, expectedID)
+		if nextJob.Id != expectedID {
+			t.Errorf("Reserved job %v, expected %v", nextJob.Id, expectedID)
 		}
 
-		if nextJob.status != "reserved" {
-			t.Errorf("Job %v status %v when it should be 'reserved'", nextJob.id, nextJob.status)
+		if nextJob.Status != "reserved" {
+			t.Errorf("Job %v status %v when it should be 'reserved'", nextJob.Id, nextJob.Status)
 		}
 	}
 
-	_, ok = queue.reserveJob()
+	_, ok = queue.reserveJob(1)
 	if ok {
 		t.Error("Expected nil when trying to reserve job from empty queue")
 	}
 }
+
+func TestDelayedQueuing(t *testing.T) {
+	clock := newFakeClock()
+	queue := newPriorityJobQueue(clock, NewNullStore(), newHookHolder())
+
+	// Jobs should become ready in order of their delay regardless of priority
+	jobDelays := [3]uint32{20, 0, 10}
+	for i, delay := range jobDelays {
+		newJob := newJob(uint64(i+1), "queue1", uint32(i), 60, []byte{'1', '2', '3'})
+		if delay > 0 {
+			newJob.delay(clock.now(), delay)
+		}
+		queue.addJob(newJob)
+	}
+
+	expectedJobs := [3]uint64{2, 3, 1}
+	for _, expectedID := range expectedJobs {
+		nextJob, ok := queue.reserveJob(1)
+		if !ok {
+			t.Fatalf("Failed to reserve job, expected job %v", expectedID)
+		}
+		if nextJob.Id != expectedID {
+			t.Errorf("Reserved job %v, expected %v", nextJob.Id, expectedID)
+		}
+
+		_, ok = queue.reserveJob(1)
+		if ok {
+			t.Errorf("Reserved job before its delay passed")
+		}
+		clock.advance(10 * time.Second)
+	}
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"container/heap"
+	"time"
+)
+
+// jobTimers is a min-heap of jobs ordered by the time at which they next need attention
+// from their priorityJobQueue, e.g. when a reservation expires.
+type jobTimers []*job
+
+func (t jobTimers) Len() int {
+	return len(t)
+}
+
+func (t jobTimers) Less(i, j int) bool {
+	return t[i].deadline().Before(t[j].deadline())
+}
+
+func (t jobTimers) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+	t[i].timerIndex = i
+	t[j].timerIndex = j
+}
+
+func (t *jobTimers) Push(x interface{}) {
+	job := x.(*job)
+	job.timerIndex = len(*t)
+	*t = append(*t, job)
+}
+
+func (t *jobTimers) Pop() interface{} {
+	old := *t
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.timerIndex = -1
+	*t = old[:n-1]
+	return job
+}
+
+// startTimer starts tracking the deadline of the given job.
+func (p *priorityJobQueue) startTimer(job *job) {
+	heap.Push(&p.timers, job)
+}
+
+// resetTimer updates the position of the job after its deadline has changed.
+func (p *priorityJobQueue) resetTimer(job *job) {
+	if job.timerIndex >= 0 {
+		heap.Fix(&p.timers, job.timerIndex)
+	}
+}
+
+// stopTimer stops tracking the deadline of the given job.
+func (p *priorityJobQueue) stopTimer(job *job) {
+	if job.timerIndex >= 0 {
+		heap.Remove(&p.timers, job.timerIndex)
+	}
+}
+
+// reapJobs releases all reserved jobs whose reservation has expired back to the ready queue
+// and moves delayed jobs whose delay has passed to the ready queue.
+func (p *priorityJobQueue) reapJobs() {
+	now := p.clock.now()
+	for len(p.timers) > 0 && !p.timers[0].deadline().After(now) {
+		job := heap.Pop(&p.timers).(*job)
+		if job.reservationExpired(now) || job.delayExpired(now) {
+			if job.reserved() {
+				p.timedOut++
+				p.hooks.get().ReservationTimedOut(job.queueName)
+			}
+			p.getStatusQueue(job).removeJob(job)
+			p.makeReady(job)
+		}
+	}
+}
+
+// wakeUp returns a channel which fires when the earliest job deadline passes.
+// Returns nil if there are no jobs with deadlines.
+func (p *priorityJobQueue) wakeUp() <-chan time.Time {
+	if len(p.timers) == 0 {
+		p.stopWakeUp()
+		return nil
+	}
+
+	deadline := p.timers[0].deadline()
+	if p.wakeUpTimer != nil && p.wakeUpAt.Equal(deadline) {
+		return p.wakeUpTimer.channel()
+	}
+
+	p.stopWakeUp()
+	p.wakeUpAt = deadline
+	p.wakeUpTimer = p.clock.newTimer(deadline.Sub(p.clock.now()))
+	return p.wakeUpTimer.channel()
+}
+
+// stopWakeUp stops the wake up timer if there is one.
+func (p *priorityJobQueue) stopWakeUp() {
+	if p.wakeUpTimer != nil {
+		p.wakeUpTimer.stop()
+		p.wakeUpTimer = nil
+	}
+}
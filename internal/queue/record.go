@@ -0,0 +1,213 @@
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Types of jobRecord.
+const (
+	recordPut    byte = 1
+	recordUpdate byte = 2
+	recordDelete byte = 3
+)
+
+// A jobRecord is a persisted change to a job.
+// Put records hold all of a job's state, update records only its id, status, priority and deadline
+// and delete records only its id.
+type jobRecord struct {
+	recordType byte
+
+	id       uint64
+	queue    string
+	priority uint32
+	timeout  uint32
+	status   string
+	// deadline is when a reservation expires or a delayed job becomes ready in Unix nanoseconds, or 0 if there is none.
+	deadline int64
+	data     []byte
+}
+
+// putRecord returns a record of a new job.
+func putRecord(job *StoredJob) *jobRecord {
+	record := updateRecord(job.Id, job.Status, job.Priority, job.Deadline)
+	record.recordType = recordPut
+	record.queue = job.Queue
+	record.timeout = job.Timeout
+	record.data = job.Data
+	return record
+}
+
+// updateRecord returns a record of an update to a job.
+func updateRecord(id uint64, status string, priority uint32, deadline time.Time) *jobRecord {
+	record := &jobRecord{
+		recordType: recordUpdate,
+		id:         id,
+		status:     status,
+		priority:   priority,
+	}
+	if !deadline.IsZero() {
+		record.deadline = deadline.UnixNano()
+	}
+	return record
+}
+
+// deleteRecord returns a record of a job being deleted.
+func deleteRecord(id uint64) *jobRecord {
+	return &jobRecord{recordType: recordDelete, id: id}
+}
+
+// storedJob returns the job held in a put record.
+func (r *jobRecord) storedJob() *StoredJob {
+	return &StoredJob{
+		Data:     r.data,
+		Deadline: r.deadlineTime(),
+		Id:       r.id,
+		Priority: r.priority,
+		Queue:    r.queue,
+		Status:   r.status,
+		Timeout:  r.timeout,
+	}
+}
+
+// deadlineTime returns the record's deadline as a time.
+func (r *jobRecord) deadlineTime() time.Time {
+	if r.deadline == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, r.deadline)
+}
+
+// encode encodes the record into a byte slice.
+func (r *jobRecord) encode() []byte {
+	buf := []byte{r.recordType}
+	buf = appendUint64(buf, r.id)
+	if r.recordType == recordDelete {
+		return buf
+	}
+
+	buf = appendString(buf, r.status)
+	buf = appendUint32(buf, r.priority)
+	buf = appendUint64(buf, uint64(r.deadline))
+	if r.recordType == recordUpdate {
+		return buf
+	}
+
+	buf = appendString(buf, r.queue)
+	buf = appendUint32(buf, r.timeout)
+	buf = appendBytes(buf, r.data)
+	return buf
+}
+
+// decodeJobRecord decodes a record encoded by jobRecord.encode.
+// Returns an error if the record is malformed.
+func decodeJobRecord(buf []byte) (*jobRecord, error) {
+	decoder := &recordDecoder{buf: buf}
+	record := &jobRecord{recordType: decoder.byte()}
+	record.id = decoder.uint64()
+
+	switch record.recordType {
+	case recordDelete:
+	case recordUpdate, recordPut:
+		record.status = decoder.string()
+		record.priority = decoder.uint32()
+		record.deadline = int64(decoder.uint64())
+		if record.recordType == recordPut {
+			record.queue = decoder.string()
+			record.timeout = decoder.uint32()
+			record.data = decoder.bytes()
+		}
+	default:
+		return nil, fmt.Errorf("Unknown job record type %v", record.recordType)
+	}
+
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+	if len(decoder.buf) != 0 {
+		return nil, fmt.Errorf("Job record for job %v has %v unexpected bytes", record.id, len(decoder.buf))
+	}
+
+	return record, nil
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	var encoded [4]byte
+	binary.LittleEndian.PutUint32(encoded[:], value)
+	return append(buf, encoded[:]...)
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], value)
+	return append(buf, encoded[:]...)
+}
+
+func appendBytes(buf []byte, value []byte) []byte {
+	buf = appendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+func appendString(buf []byte, value string) []byte {
+	return appendBytes(buf, []byte(value))
+}
+
+// A recordDecoder decodes values from a byte slice.
+// Once decoding fails err is set and all further values are zero.
+type recordDecoder struct {
+	buf []byte
+	err error
+}
+
+// next returns the next n bytes of the buffer.
+func (d *recordDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = fmt.Errorf("Job record truncated")
+		return nil
+	}
+
+	value := d.buf[:n]
+	d.buf = d.buf[n:]
+	return value
+}
+
+func (d *recordDecoder) byte() byte {
+	value := d.next(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (d *recordDecoder) uint32() uint32 {
+	value := d.next(4)
+	if value == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(value)
+}
+
+func (d *recordDecoder) uint64() uint64 {
+	value := d.next(8)
+	if value == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(value)
+}
+
+func (d *recordDecoder) bytes() []byte {
+	length := d.uint32()
+	value := d.next(int(length))
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+func (d *recordDecoder) string() string {
+	return string(d.bytes())
+}
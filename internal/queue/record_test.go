@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJobRecordEncoding(t *testing.T) {
+	job := newJob(5, "queue1", 2, 60, []byte{'1', '2', '3'})
+	job.reserve(time.Unix(100, 0), 1)
+
+	storedJob := newStoredJob(job)
+	records := []*jobRecord{
+		putRecord(storedJob),
+		updateRecord(storedJob.Id, storedJob.Status, storedJob.Priority, storedJob.Deadline),
+		deleteRecord(storedJob.Id),
+	}
+	for _, record := range records {
+		recordType := record.recordType
+		decoded, err := decodeJobRecord(record.encode())
+		if err != nil {
+			t.Fatalf("Failed to decode record type %v: %v", recordType, err.Error())
+		}
+
+		expected := &jobRecord{recordType: recordType, id: 5}
+		if recordType != recordDelete {
+			expected.status = "reserved"
+			expected.priority = 2
+			expected.deadline = time.Unix(160, 0).UnixNano()
+		}
+		if recordType == recordPut {
+			expected.queue = "queue1"
+			expected.timeout = 60
+			expected.data = []byte{'1', '2', '3'}
+		}
+
+		if !cmp.Equal(expected, decoded, cmp.AllowUnexported(jobRecord{})) {
+			t.Errorf("Decoded record differs from encoded record: %v", cmp.Diff(expected, decoded, cmp.AllowUnexported(jobRecord{})))
+		}
+	}
+
+	encoded := putRecord(storedJob).encode()
+	_, err := decodeJobRecord(encoded[:len(encoded)-1])
+	if err == nil {
+		t.Error("Decoded truncated record")
+	}
+}
@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// snapshotFileName is the name of the snapshot in the data directory.
+	snapshotFileName = "goqueue.snapshot"
+	// tmpSnapshotFileName is the name a snapshot is written to before it's complete.
+	tmpSnapshotFileName = "goqueue.snapshot.tmp"
+)
+
+// snapshotMagic identifies a snapshot file and its format version.
+var snapshotMagic = []byte("GQSNAP01")
+
+// writeSnapshot atomically writes a snapshot of the given jobs to the data directory.
+// The snapshot records that it covers every log record up to and including lsn.
+// The fault function is called after each step so tests can simulate a crash.
+func writeSnapshot(dir string, jobs *jobTable, lsn uint64, fault func(string) error) error {
+	tmpPath := filepath.Join(dir, tmpSnapshotFileName)
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = writeSnapshotFile(file, jobs, lsn)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fault("wrote snapshot")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, filepath.Join(dir, snapshotFileName))
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	return fault("renamed snapshot")
+}
+
+// writeSnapshotFile writes the snapshot to the given file.
+// The snapshot is a header of <magic><lsn><last job ID><job count> followed by a put record for each job.
+func writeSnapshotFile(file *os.File, jobs *jobTable, lsn uint64) error {
+	writer := bufio.NewWriter(file)
+
+	header := append([]byte{}, snapshotMagic...)
+	header = appendUint64(header, lsn)
+	header = appendUint64(header, jobs.lastJobID)
+	header = appendUint64(header, uint64(len(jobs.jobs)))
+	_, err := writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs.sortedJobs() {
+		_, err = writer.Write(frameRecord(lsn, putRecord(job)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// readSnapshot reads the snapshot in the data directory into the given jobs.
+// Returns the LSN of the last log record the snapshot covers, or 0 if there is no snapshot.
+// Returns an error if the snapshot is incomplete or corrupt.
+func readSnapshot(dir string, jobs *jobTable) (uint64, error) {
+	path := filepath.Join(dir, snapshotFileName)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(snapshotMagic)+24)
+	_, err = io.ReadFull(reader, header)
+	if err != nil || !bytes.Equal(header[:len(snapshotMagic)], snapshotMagic) {
+		return 0, fmt.Errorf("Snapshot %v has an invalid header", path)
+	}
+
+	header = header[len(snapshotMagic):]
+	lsn := binary.LittleEndian.Uint64(header[0:8])
+	jobs.lastJobID = binary.LittleEndian.Uint64(header[8:16])
+	count := binary.LittleEndian.Uint64(header[16:24])
+
+	for i := uint64(0); i < count; i++ {
+		_, record, err := readRecord(reader)
+		if err != nil {
+			return 0, fmt.Errorf("Snapshot %v is corrupt: %v", path, err.Error())
+		}
+		jobs.apply(record.jobRecord)
+	}
+
+	return lsn, nil
+}
+
+// syncDir syncs a directory so that files created or renamed in it are persisted.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
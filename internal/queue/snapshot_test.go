@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshotCompaction(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	goJobQueue := openTestQueue(t, dataDir, realClock{})
+	makeTestChanges(goJobQueue)
+
+	wal := goJobQueue.store.(*LogStore)
+	err := wal.compact()
+	if err != nil {
+		t.Fatalf("Failed to compact log: " + err.Error())
+	}
+
+	segments, _ := wal.segments()
+	if !cmp.Equal(segments, []uint64{2}) {
+		t.Errorf("Expected only segment 2 after compaction, got %v", segments)
+	}
+	_, err = os.Stat(filepath.Join(dataDir, snapshotFileName))
+	if err != nil {
+		t.Errorf("Snapshot not written: " + err.Error())
+	}
+
+	// Changes after the snapshot should be recovered from the log
+	makeTestChanges(goJobQueue)
+	expected := allJobData(goJobQueue)
+	goJobQueue.Close()
+
+	goJobQueue = openTestQueue(t, dataDir, realClock{})
+	defer goJobQueue.Close()
+	if recovered := allJobData(goJobQueue); !cmp.Equal(expected, recovered) {
+		t.Errorf("Recovered jobs differ from jobs before restart: %v", cmp.Diff(expected, recovered))
+	}
+}
+
+func TestSnapshotCrashRecovery(t *testing.T) {
+	steps := []string{"rotated log", "wrote snapshot", "renamed snapshot", "removed log"}
+	for _, step := range steps {
+		dataDir := createDataDir(t)
+		defer os.RemoveAll(dataDir)
+
+		goJobQueue := openTestQueue(t, dataDir, realClock{})
+		makeTestChanges(goJobQueue)
+
+		// Leave an extra log segment behind from an earlier failed compaction
+		wal := goJobQueue.store.(*LogStore)
+		wal.fault = func(string) error {
+			return fmt.Errorf("Failed compaction")
+		}
+		wal.compact()
+		makeTestChanges(goJobQueue)
+
+		// Crash at the step, making more changes after the log has been rotated
+		wal.fault = func(currentStep string) error {
+			if currentStep == step {
+				makeTestChanges(goJobQueue)
+				return fmt.Errorf("Crash at %v", step)
+			}
+			return nil
+		}
+		err := wal.compact()
+		if err == nil {
+			t.Errorf("Compaction did not crash at %v", step)
+		}
+		expected := allJobData(goJobQueue)
+		crashQueue(goJobQueue)
+
+		goJobQueue = openTestQueue(t, dataDir, realClock{})
+		if recovered := allJobData(goJobQueue); !cmp.Equal(expected, recovered) {
+			t.Errorf("Recovered jobs differ after crash at %v: %v", step, cmp.Diff(expected, recovered))
+		}
+
+		// Compacting after recovery should leave a single log segment
+		wal = goJobQueue.store.(*LogStore)
+		err = wal.compact()
+		if err != nil {
+			t.Errorf("Failed to compact after crash at %v: %v", step, err.Error())
+		}
+		segments, _ := wal.segments()
+		if len(segments) != 1 {
+			t.Errorf("Expected 1 log segment after compaction, got %v", segments)
+		}
+		goJobQueue.Close()
+	}
+}
+
+func TestSnapshotCorruptTmpFile(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	goJobQueue := openTestQueue(t, dataDir, realClock{})
+	makeTestChanges(goJobQueue)
+	expected := allJobData(goJobQueue)
+	goJobQueue.Close()
+
+	// A snapshot which was still being written when the server crashed should be ignored
+	tmpPath := filepath.Join(dataDir, tmpSnapshotFileName)
+	err := ioutil.WriteFile(tmpPath, snapshotMagic[:4], 0644)
+	if err != nil {
+		t.Fatalf("Failed to write temporary snapshot: " + err.Error())
+	}
+
+	goJobQueue = openTestQueue(t, dataDir, realClock{})
+	defer goJobQueue.Close()
+	if recovered := allJobData(goJobQueue); !cmp.Equal(expected, recovered) {
+		t.Errorf("Recovered jobs differ from jobs before restart: %v", cmp.Diff(expected, recovered))
+	}
+}
+
+func TestSnapshotLogSize(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	store, err := OpenLogStore(LogStoreConfig{Dir: dataDir, SyncPolicy: SyncNever, SnapshotLogSize: 512})
+	if err != nil {
+		t.Fatalf("Failed to open log store: " + err.Error())
+	}
+	goJobQueue, err := NewGoJobQueueWithStore(store)
+	if err != nil {
+		t.Fatalf("Failed to open queue: " + err.Error())
+	}
+	defer goJobQueue.Close()
+
+	for i := 0; i < 20; i++ {
+		goJobQueue.AddJob(&GoJobData{Data: []byte("some job data"), Priority: 1, Queue: "queue1", Timeout: 60})
+	}
+
+	snapshotPath := filepath.Join(dataDir, snapshotFileName)
+	for i := 0; i < 1000; i++ {
+		if _, err = os.Stat(snapshotPath); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Snapshot not written after log grew past snapshot size")
+}
+
+// makeTestChanges is a helper function which adds, reserves, buries and deletes jobs
+func makeTestChanges(goJobQueue *GoJobQueue) {
+	ids := make([]uint64, 0, 4)
+	for i := 0; i < 4; i++ {
+		jobData := &GoJobData{Data: []byte{byte(i)}, Priority: uint32(i), Queue: "queue1", Timeout: 60}
+		goJobQueue.AddJob(jobData)
+		ids = append(ids, jobData.Id)
+	}
+
+	goJobQueue.DeleteJob(ids[0])
+	reserved, _ := goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.BuryJob(reserved.Id, 1, 5)
+	goJobQueue.ReserveJob("queue1", 1)
+}
+
+// allJobData is a helper function which returns the data for every job in the queue
+func allJobData(goJobQueue *GoJobQueue) map[uint64]*GoJobData {
+	goJobQueue.jobsMutex.Lock()
+	ids := make([]uint64, 0, len(goJobQueue.jobs))
+	for id := range goJobQueue.jobs {
+		ids = append(ids, id)
+	}
+	goJobQueue.jobsMutex.Unlock()
+
+	jobs := make(map[uint64]*GoJobData)
+	for _, id := range ids {
+		jobs[id], _ = goJobQueue.GetJobData(id)
+	}
+	return jobs
+}
+
+// crashQueue is a helper function which stops a queue's write-ahead log without syncing or cleaning up
+func crashQueue(goJobQueue *GoJobQueue) {
+	wal := goJobQueue.store.(*LogStore)
+	close(wal.stop)
+	wal.done.Wait()
+	wal.file.Close()
+}
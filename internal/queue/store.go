@@ -0,0 +1,68 @@
+package queue
+
+import "time"
+
+// A Store is a journal a GoJobQueue persists its jobs to.
+// The queue holds every job and serves all reads from memory. It writes each change to a job through to its
+// store and only reads the store back to load the jobs when it's created, so the choice of store decides
+// whether jobs survive a restart and what each change costs. The default NullStore persists nothing.
+type Store interface {
+	// PutJob stores a new job.
+	PutJob(job *StoredJob) error
+	// UpdateJob updates the status, priority and deadline of a stored job.
+	UpdateJob(id uint64, status string, priority uint32, deadline time.Time) error
+	// DeleteJob deletes a stored job.
+	DeleteJob(id uint64) error
+	// Jobs calls fn for each stored job in ID order. It's used to load the jobs when a queue is created.
+	// Iteration stops if fn returns an error, which is returned.
+	Jobs(fn func(*StoredJob) error) error
+	// LastJobID returns the highest ID of any job stored, including jobs which have been deleted.
+	LastJobID() uint64
+	// Close closes the store, making sure all changes are persisted.
+	Close() error
+}
+
+// A StoredJob is the state of a job persisted in a Store.
+// Deadline is when the reservation of a reserved job expires or when a delayed job becomes ready.
+type StoredJob struct {
+	Data     []byte
+	Deadline time.Time
+	Id       uint64
+	Priority uint32
+	Queue    string
+	Status   string
+	Timeout  uint32
+}
+
+// newStoredJob returns the state of the given job to store.
+func newStoredJob(job *job) *StoredJob {
+	storedJob := &StoredJob{
+		Data:     job.data,
+		Id:       job.id,
+		Priority: job.priority,
+		Queue:    job.queueName,
+		Status:   job.status,
+		Timeout:  job.reservationTimeout,
+	}
+
+	if job.status == "reserved" || job.status == "delayed" {
+		storedJob.Deadline = job.deadline()
+	}
+
+	return storedJob
+}
+
+// toJob creates an internal job from its stored state.
+func (s *StoredJob) toJob() *job {
+	job := newJob(s.Id, s.Queue, s.Priority, s.Timeout, s.Data)
+	job.status = s.Status
+
+	switch s.Status {
+	case "reserved":
+		job.reserveExpires = s.Deadline
+	case "delayed":
+		job.readyAt = s.Deadline
+	}
+
+	return job
+}
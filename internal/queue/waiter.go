@@ -0,0 +1,73 @@
+package queue
+
+import "sync"
+
+// A reserveWaiter is a client waiting for a job to become ready so it can reserve it.
+// Waiters are handed jobs in the order they started waiting.
+type reserveWaiter struct {
+	owner uint64
+
+	// claimed is set once a job has been handed to the waiter or the waiter has given up.
+	mutex   sync.Mutex
+	claimed bool
+
+	// response receives the reserved job once the waiter has been claimed by a queue
+	response chan *GoJobData
+}
+
+// newReserveWaiter creates a waiter which reserves jobs on behalf of the given owner.
+func newReserveWaiter(owner uint64) *reserveWaiter {
+	return &reserveWaiter{
+		owner:    owner,
+		response: make(chan *GoJobData, 1),
+	}
+}
+
+// claim claims the waiter so that no one else can hand it a job.
+// Returns false if the waiter has already been claimed.
+func (w *reserveWaiter) claim() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.claimed {
+		return false
+	}
+	w.claimed = true
+	return true
+}
+
+// addWaiter adds the waiter to the end of the queue's waiters.
+func (p *priorityJobQueue) addWaiter(waiter *reserveWaiter) {
+	p.waiters = append(p.waiters, waiter)
+}
+
+// removeWaiter removes the waiter from the queue's waiters if it is there.
+func (p *priorityJobQueue) removeWaiter(waiter *reserveWaiter) {
+	for i, w := range p.waiters {
+		if w == waiter {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// handToWaiter reserves the given ready job for the oldest waiter and sends it to them.
+// Returns false if there are no waiters left who can take the job.
+func (p *priorityJobQueue) handToWaiter(job *job) bool {
+	for len(p.waiters) > 0 {
+		waiter := p.waiters[0]
+		p.waiters[0] = nil
+		p.waiters = p.waiters[1:]
+
+		if !waiter.claim() {
+			// Waiter has given up waiting
+			continue
+		}
+
+		p.reserve(job, waiter.owner)
+		waiter.response <- internalJobToData(job)
+		return true
+	}
+
+	return false
+}
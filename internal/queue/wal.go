@@ -0,0 +1,570 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cswilson90/goqueue/internal/logging"
+)
+
+// SyncPolicy controls when a LogStore or FileStore is synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the log after every change so no acknowledged change is lost.
+	SyncAlways SyncPolicy = iota
+	// SyncEvery syncs the log periodically so changes made since the last sync can be lost.
+	SyncEvery
+	// SyncNever leaves syncing the log to the operating system.
+	SyncNever
+)
+
+const (
+	// walFilePrefix and walFileSuffix surround the sequence number of each log segment's file name.
+	walFilePrefix = "goqueue-"
+	walFileSuffix = ".wal"
+
+	// frameHeaderSize is the size of the <length><crc><lsn> header before each record.
+	frameHeaderSize = 16
+	// maxRecordHeaderSize is the size of every field of a put record except the job data
+	// when the status and queue name are as long as they can be.
+	maxRecordHeaderSize = 1 + 8 + 4 + len("reserved") + 4 + 8 + 4 + MaxQueueNameLength + 4 + 4
+	// maxRecordSize is the largest record the log will read, a put record of a job with the most data allowed.
+	// Anything larger is assumed to be corruption.
+	maxRecordSize = MaxJobSize + maxRecordHeaderSize
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A LogStore is a Store which appends a record of every change to segment files of a write-ahead log
+// in a data directory and keeps the current state of every job in memory.
+//
+// Each record is framed as <length><crc><lsn><record> where the LSN (log sequence number) increases
+// with every record. This lets torn writes at the end of a segment be detected on replay.
+//
+// The log is compacted using the state held in memory: a new segment is started,
+// a snapshot of all jobs is written and then the old segments, which the snapshot covers, are removed.
+// Recovery loads the snapshot and replays the segments skipping records the snapshot already covers,
+// so a crash at any point during compaction loses nothing.
+type LogStore struct {
+	dir string
+
+	// mutex protects everything below it
+	mutex   sync.Mutex
+	file    *os.File
+	segment uint64
+	size    int64
+	lsn     uint64
+	jobs    *jobTable
+	policy  SyncPolicy
+	dirty   bool
+	// failed is set if a record couldn't be written or removed so the end of the log is unknown
+	failed error
+
+	// compactMutex ensures only one compaction runs at a time
+	compactMutex    sync.Mutex
+	snapshotLogSize int64
+	compactNow      chan struct{}
+
+	stop chan struct{}
+	done sync.WaitGroup
+
+	// fault is called at each step of compaction so tests can simulate crashes
+	fault func(step string) error
+}
+
+// LogStoreConfig configures a LogStore.
+type LogStoreConfig struct {
+	// Dir is the directory the log and snapshots are stored in.
+	Dir string
+	// SyncPolicy controls when the log is synced to disk.
+	SyncPolicy SyncPolicy
+	// SyncInterval is how often the log is synced with the SyncEvery policy.
+	SyncInterval time.Duration
+	// SnapshotInterval is how often a snapshot is written and the log compacted, or 0 to never do so on a timer.
+	SnapshotInterval time.Duration
+	// SnapshotLogSize is the size in bytes the current log segment can reach before a snapshot is written
+	// and the log compacted, or 0 for no limit.
+	SnapshotLogSize int64
+}
+
+// OpenLogStore opens the log in the configured directory, recovering all jobs in it.
+// A partially written record at the end of the log is removed.
+func OpenLogStore(config LogStoreConfig) (*LogStore, error) {
+	if config.SyncPolicy == SyncEvery && config.SyncInterval <= 0 {
+		return nil, fmt.Errorf("Invalid write-ahead log sync interval %v", config.SyncInterval)
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LogStore{
+		dir:             config.Dir,
+		jobs:            newJobTable(),
+		policy:          config.SyncPolicy,
+		snapshotLogSize: config.SnapshotLogSize,
+		compactNow:      make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		fault:           func(string) error { return nil },
+	}
+
+	err = s.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	var syncInterval time.Duration
+	if config.SyncPolicy == SyncEvery {
+		syncInterval = config.SyncInterval
+	}
+	s.done.Add(1)
+	go s.runBackgroundTasks(syncInterval, config.SnapshotInterval)
+
+	return s, nil
+}
+
+// recover loads the snapshot and replays all log segments then opens the last segment for appending.
+func (s *LogStore) recover() error {
+	err := os.Remove(filepath.Join(s.dir, tmpSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	snapshotLSN, err := readSnapshot(s.dir, s.jobs)
+	if err != nil {
+		return err
+	}
+	s.lsn = snapshotLSN
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var end int64
+	for i, segment := range segments {
+		end, err = replaySegment(s.segmentPath(segment), i == len(segments)-1, func(lsn uint64, record *jobRecord) {
+			if lsn <= snapshotLSN {
+				// Already covered by the snapshot
+				return
+			}
+			s.jobs.apply(record)
+			s.lsn = lsn
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(segments) == 0 {
+		return s.openSegment(1)
+	}
+
+	// Append to the last segment after its last complete record
+	s.segment = segments[len(segments)-1]
+	s.file, err = os.OpenFile(s.segmentPath(s.segment), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = truncateFile(s.file, end)
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	s.size = end
+
+	return nil
+}
+
+// segments returns the sequence numbers of the log segments in the data directory in order.
+func (s *LogStore) segments() ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, walFilePrefix+"*"+walFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]uint64, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), walFilePrefix), walFileSuffix)
+		segment, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	return segments, nil
+}
+
+// segmentPath returns the path of the log segment with the given sequence number.
+func (s *LogStore) segmentPath(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%v%020d%v", walFilePrefix, segment, walFileSuffix))
+}
+
+// openSegment creates a new log segment with the given sequence number and starts appending to it.
+// The caller must hold the mutex if the log is in use.
+func (s *LogStore) openSegment(segment uint64) error {
+	file, err := os.OpenFile(s.segmentPath(segment), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = syncDir(s.dir)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.segment = segment
+	s.size = 0
+	s.dirty = false
+	return nil
+}
+
+// replaySegment reads all complete records from a log segment passing them to replay.
+// Only the last segment can end with a partially written record, which is skipped.
+// Returns the offset of the end of the last complete record or an error if any other record is corrupt.
+func replaySegment(path string, last bool, replay func(uint64, *jobRecord)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		size, record, err := readRecord(reader)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			if !last || !tornTail(reader, err) {
+				return 0, fmt.Errorf("Corrupt record at offset %v of %v: %v", offset, path, err.Error())
+			}
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("record truncated")
+			}
+			logging.Warnf("Discarding incomplete record at offset %v of %v: %v", offset, path, err.Error())
+			return offset, nil
+		}
+
+		replay(record.lsn, record.jobRecord)
+		offset += size
+	}
+}
+
+// tornTail returns whether the error from reading a record means the record is partially written
+// at the end of the file, so it was being written when the process stopped, rather than corrupt.
+func tornTail(reader *bufio.Reader, err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, err = reader.Peek(1)
+	return err == io.EOF
+}
+
+// A loggedRecord is a job record read from the log with its LSN.
+type loggedRecord struct {
+	*jobRecord
+	lsn uint64
+}
+
+// frameRecord frames an encoded record with its length, checksum and LSN.
+func frameRecord(lsn uint64, record *jobRecord) []byte {
+	payload := appendUint64(nil, lsn)
+	payload = append(payload, record.encode()...)
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(payload)-8))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	return append(frame, payload...)
+}
+
+// readRecord reads a framed record.
+// Returns the size of the frame read, io.EOF if there are no more records or an error
+// if the record is incomplete or corrupt.
+func readRecord(reader *bufio.Reader) (int64, *loggedRecord, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:4])
+	if int64(length) > int64(maxRecordSize) {
+		return 0, nil, fmt.Errorf("record length %v too large", length)
+	}
+
+	payload := make([]byte, 8+int(length))
+	_, err = io.ReadFull(reader, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return 0, nil, fmt.Errorf("checksum mismatch")
+	}
+
+	record, err := decodeJobRecord(payload[8:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int64(frameHeaderSize) + int64(length), &loggedRecord{
+		jobRecord: record,
+		lsn:       binary.LittleEndian.Uint64(payload[:8]),
+	}, nil
+}
+
+// PutJob stores a new job.
+func (s *LogStore) PutJob(job *StoredJob) error {
+	return s.record(putRecord(job))
+}
+
+// UpdateJob updates the status, priority and deadline of a stored job.
+func (s *LogStore) UpdateJob(id uint64, status string, priority uint32, deadline time.Time) error {
+	return s.record(updateRecord(id, status, priority, deadline))
+}
+
+// DeleteJob deletes a stored job.
+func (s *LogStore) DeleteJob(id uint64) error {
+	return s.record(deleteRecord(id))
+}
+
+// Jobs calls fn for each stored job in ID order.
+func (s *LogStore) Jobs(fn func(*StoredJob) error) error {
+	s.mutex.Lock()
+	jobs := s.jobs.sortedJobs()
+	s.mutex.Unlock()
+
+	for _, job := range jobs {
+		err := fn(job)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LastJobID returns the highest ID of any job stored, including jobs which have been deleted.
+func (s *LogStore) LastJobID() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jobs.lastJobID
+}
+
+// record appends a record to the log, syncing it to disk if the sync policy requires.
+// The change is only applied once the record is written and, with the SyncAlways policy, synced.
+// If the record can't be written whatever part of it was written is removed. If that fails, or the record
+// can't be synced so it's unknown whether it's on disk, the log is marked as failed and no more records
+// are written to it.
+func (s *LogStore) record(record *jobRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failed != nil {
+		return fmt.Errorf("Write-ahead log failed: %v", s.failed.Error())
+	}
+
+	frame := frameRecord(s.lsn+1, record)
+	if len(frame)-frameHeaderSize > maxRecordSize {
+		return fmt.Errorf("Record of %v bytes is too large for the write-ahead log", len(frame)-frameHeaderSize)
+	}
+	_, err := s.file.Write(frame)
+	if err != nil {
+		truncateErr := truncateFile(s.file, s.size)
+		if truncateErr != nil {
+			s.failed = truncateErr
+			logging.Errorf("Failed to remove partially written record from write-ahead log: %v", truncateErr.Error())
+		}
+		return err
+	}
+
+	if s.policy == SyncAlways {
+		err = s.file.Sync()
+		if err != nil {
+			s.failed = err
+			truncateFile(s.file, s.size)
+			logging.Errorf("Failed to sync write-ahead log: %v", err.Error())
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	s.lsn++
+	s.jobs.apply(record)
+	s.size += int64(len(frame))
+
+	if s.snapshotLogSize > 0 && s.size >= s.snapshotLogSize {
+		select {
+		case s.compactNow <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// truncateFile truncates the file to the given size and moves its offset to the new end.
+func truncateFile(file *os.File, size int64) error {
+	err := file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(size, io.SeekStart)
+	return err
+}
+
+// runBackgroundTasks syncs the log and compacts it at the given intervals until the log is closed.
+// Intervals of 0 disable the task. The log is also compacted whenever it grows too large.
+func (s *LogStore) runBackgroundTasks(syncInterval, snapshotInterval time.Duration) {
+	defer s.done.Done()
+
+	var syncTick, snapshotTick <-chan time.Time
+	if syncInterval > 0 {
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	if snapshotInterval > 0 {
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		snapshotTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-syncTick:
+			s.mutex.Lock()
+			err := s.sync()
+			s.mutex.Unlock()
+			if err != nil {
+				logging.Errorf("Failed to sync write-ahead log: %v", err.Error())
+			}
+		case <-snapshotTick:
+			s.logCompactionError(s.compact())
+		case <-s.compactNow:
+			s.logCompactionError(s.compact())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// logCompactionError logs an error from compacting the log.
+func (s *LogStore) logCompactionError(err error) {
+	if err != nil {
+		logging.Errorf("Failed to compact write-ahead log: %v", err.Error())
+	}
+}
+
+// sync syncs the log to disk if it has changed since it was last synced.
+// The caller must hold the mutex.
+func (s *LogStore) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.file.Sync()
+}
+
+// compact writes a snapshot of all jobs and removes the log segments it covers.
+func (s *LogStore) compact() error {
+	s.compactMutex.Lock()
+	defer s.compactMutex.Unlock()
+
+	// Start a new segment so the snapshot covers every record in the old ones.
+	// A failed log isn't rotated as its last segment may end with a partial record,
+	// which is only allowed at the end of the last segment.
+	s.mutex.Lock()
+	if s.failed != nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("Write-ahead log failed: %v", s.failed.Error())
+	}
+	oldFile := s.file
+	err := oldFile.Sync()
+	if err == nil {
+		err = s.openSegment(s.segment + 1)
+	}
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	jobs := s.jobs.copy()
+	lsn := s.lsn
+	segment := s.segment
+	s.mutex.Unlock()
+
+	oldFile.Close()
+	err = s.fault("rotated log")
+	if err != nil {
+		return err
+	}
+
+	err = writeSnapshot(s.dir, jobs, lsn, s.fault)
+	if err != nil {
+		return err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, oldSegment := range segments {
+		if oldSegment >= segment {
+			break
+		}
+
+		err = os.Remove(s.segmentPath(oldSegment))
+		if err != nil {
+			return err
+		}
+		err = s.fault("removed log")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close stops background tasks then syncs and closes the log.
+func (s *LogStore) Close() error {
+	close(s.stop)
+	s.done.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Records can't be written once the file is closed
+	s.failed = fmt.Errorf("store closed")
+
+	err := s.file.Sync()
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
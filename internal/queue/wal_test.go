@@ -0,0 +1,271 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// createDataDir is a helper function which creates a temporary data directory
+func createDataDir(t *testing.T) string {
+	dataDir, err := ioutil.TempDir("", "goqueue")
+	if err != nil {
+		t.Fatalf("Failed to create data directory: " + err.Error())
+	}
+	return dataDir
+}
+
+// openTestQueue is a helper function which opens a persistent queue in the given directory
+func openTestQueue(t *testing.T, dataDir string, clock clock) *GoJobQueue {
+	store, err := OpenLogStore(LogStoreConfig{Dir: dataDir, SyncPolicy: SyncAlways})
+	if err != nil {
+		t.Fatalf("Failed to open log store: " + err.Error())
+	}
+	goJobQueue, err := newGoJobQueueWithStore(store, clock)
+	if err != nil {
+		t.Fatalf("Failed to open queue: " + err.Error())
+	}
+	return goJobQueue
+}
+
+func TestWriteAheadLogRecovery(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	clock := newFakeClock()
+	goJobQueue := openTestQueue(t, dataDir, clock)
+
+	for i := 0; i < 5; i++ {
+		jobData := &GoJobData{Data: []byte{byte(i)}, Priority: uint32(i), Queue: "queue1", Timeout: 60}
+		if i == 4 {
+			jobData.Delay = 30
+		}
+		err := goJobQueue.AddJob(jobData)
+		if err != nil {
+			t.Fatalf("Failed to add job: " + err.Error())
+		}
+	}
+
+	// Job 1 is deleted, job 2 buried, job 3 reserved, job 4 left ready and job 5 delayed
+	goJobQueue.DeleteJob(1)
+	goJobQueue.ReserveJob("queue1", 1)
+	goJobQueue.BuryJob(2, 1, 10)
+	goJobQueue.ReserveJob("queue1", 1)
+	err := goJobQueue.Close()
+	if err != nil {
+		t.Errorf("Failed to close queue: " + err.Error())
+	}
+
+	goJobQueue = openTestQueue(t, dataDir, clock)
+	defer goJobQueue.Close()
+
+	if numJobs := goJobQueue.NumJobs(); numJobs != 4 {
+		t.Errorf("Expected 4 jobs after recovery, got %v", numJobs)
+	}
+
+	_, ok := goJobQueue.GetJobData(1)
+	if ok {
+		t.Error("Deleted job 1 recovered")
+	}
+
+	expectedStatus := map[uint64]string{2: "buried", 3: "reserved", 4: "ready", 5: "delayed"}
+	for id, status := range expectedStatus {
+		jobData, ok := goJobQueue.GetJobData(id)
+		if !ok {
+			t.Errorf("Job %v not recovered", id)
+			continue
+		}
+		if jobData.Status != status {
+			t.Errorf("Recovered job %v has status %v, expected %v", id, jobData.Status, status)
+		}
+		if !bytes.Equal(jobData.Data, []byte{byte(id - 1)}) {
+			t.Errorf("Recovered job %v has data %v", id, jobData.Data)
+		}
+	}
+
+	buried, _ := goJobQueue.GetJobData(2)
+	if buried.Priority != 10 {
+		t.Errorf("Recovered buried job has priority %v, expected 10", buried.Priority)
+	}
+
+	// Recovered reservations and delays should expire at their recorded times
+	clock.advance(30 * time.Second)
+	expectedJobs := [2]uint64{4, 5}
+	for _, expectedID := range expectedJobs {
+		nextJob, ok := goJobQueue.ReserveJob("queue1", 1)
+		if !ok || nextJob.Id != expectedID {
+			t.Errorf("Expected to reserve recovered job %v", expectedID)
+		}
+	}
+
+	clock.advance(30 * time.Second)
+	nextJob, ok := goJobQueue.ReserveJob("queue1", 1)
+	if !ok || nextJob.Id != 3 {
+		t.Errorf("Expected to reserve job 3 after its recovered reservation expired")
+	}
+
+	// IDs should continue from the last job
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	if jobData.Id != 6 {
+		t.Errorf("Expected new job to have ID 6, got %v", jobData.Id)
+	}
+}
+
+func TestWriteAheadLogTornRecord(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	goJobQueue := openTestQueue(t, dataDir, realClock{})
+	for i := 0; i < 2; i++ {
+		goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60})
+	}
+	goJobQueue.Close()
+
+	// Simulate a crash part way through writing a record
+	walPath := (&LogStore{dir: dataDir}).segmentPath(1)
+	walData, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read write-ahead log: " + err.Error())
+	}
+	err = ioutil.WriteFile(walPath, walData[:len(walData)-3], 0644)
+	if err != nil {
+		t.Fatalf("Failed to truncate write-ahead log: " + err.Error())
+	}
+
+	goJobQueue = openTestQueue(t, dataDir, realClock{})
+	if numJobs := goJobQueue.NumJobs(); numJobs != 1 {
+		t.Errorf("Expected 1 job recovered from torn log, got %v", numJobs)
+	}
+
+	// Records written after the torn record should be recovered
+	jobData := &GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	goJobQueue.AddJob(jobData)
+	goJobQueue.Close()
+
+	goJobQueue = openTestQueue(t, dataDir, realClock{})
+	defer goJobQueue.Close()
+	if numJobs := goJobQueue.NumJobs(); numJobs != 2 {
+		t.Errorf("Expected 2 jobs recovered, got %v", numJobs)
+	}
+	_, ok := goJobQueue.GetJobData(jobData.Id)
+	if !ok {
+		t.Errorf("Job %v added after recovering torn log not recovered", jobData.Id)
+	}
+}
+
+func TestWriteAheadLogCorruptRecord(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	goJobQueue := openTestQueue(t, dataDir, realClock{})
+	for i := 0; i < 2; i++ {
+		goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60})
+	}
+	goJobQueue.Close()
+
+	walPath := (&LogStore{dir: dataDir}).segmentPath(1)
+	walData, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read write-ahead log: " + err.Error())
+	}
+
+	// A corrupt record before the end of the last segment isn't a torn write so recovery must fail
+	corrupted := append([]byte(nil), walData...)
+	corrupted[frameHeaderSize] ^= 0xff
+	err = ioutil.WriteFile(walPath, corrupted, 0644)
+	if err != nil {
+		t.Fatalf("Failed to corrupt write-ahead log: " + err.Error())
+	}
+	_, err = OpenLogStore(LogStoreConfig{Dir: dataDir, SyncPolicy: SyncAlways})
+	if err == nil {
+		t.Errorf("Opened write-ahead log with a corrupt record in the middle of a segment")
+	}
+
+	// A partial record is only allowed at the end of the last segment
+	err = ioutil.WriteFile(walPath, walData[:len(walData)-3], 0644)
+	if err == nil {
+		err = ioutil.WriteFile((&LogStore{dir: dataDir}).segmentPath(2), walData, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Failed to write write-ahead log: " + err.Error())
+	}
+	_, err = OpenLogStore(LogStoreConfig{Dir: dataDir, SyncPolicy: SyncAlways})
+	if err == nil {
+		t.Errorf("Opened write-ahead log with a partial record at the end of a segment which isn't the last")
+	}
+}
+
+func TestWriteAheadLogSyncPolicies(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	_, err := OpenLogStore(LogStoreConfig{Dir: dataDir, SyncPolicy: SyncEvery})
+	if err == nil {
+		t.Error("Opened log store with SyncEvery policy and no interval")
+	}
+
+	configs := []LogStoreConfig{
+		{Dir: dataDir, SyncPolicy: SyncEvery, SyncInterval: time.Millisecond},
+		{Dir: dataDir, SyncPolicy: SyncNever},
+	}
+	for i, config := range configs {
+		store, err := OpenLogStore(config)
+		if err != nil {
+			t.Fatalf("Failed to open log store: " + err.Error())
+		}
+		goJobQueue, _ := NewGoJobQueueWithStore(store)
+
+		goJobQueue.AddJob(&GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60})
+		time.Sleep(5 * time.Millisecond)
+
+		err = goJobQueue.Close()
+		if err != nil {
+			t.Errorf("Failed to close queue: " + err.Error())
+		}
+
+		store, _ = OpenLogStore(config)
+		goJobQueue, _ = NewGoJobQueueWithStore(store)
+		if numJobs := goJobQueue.NumJobs(); numJobs != i+1 {
+			t.Errorf("Expected %v jobs recovered, got %v", i+1, numJobs)
+		}
+		goJobQueue.Close()
+	}
+}
+
+func TestWriteAheadLogFailedWrite(t *testing.T) {
+	dataDir := createDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	store, err := OpenLogStore(LogStoreConfig{Dir: dataDir, SyncPolicy: SyncAlways})
+	if err != nil {
+		t.Fatalf("Failed to open log store: " + err.Error())
+	}
+	err = store.PutJob(&StoredJob{Data: []byte{'1'}, Id: 1, Queue: "queue1", Status: "ready"})
+	if err != nil {
+		t.Fatalf("Failed to store job: " + err.Error())
+	}
+
+	// Neither the record nor the truncate can be written to a closed file so the log must stop accepting records
+	file := store.file
+	file.Close()
+	err = store.PutJob(&StoredJob{Data: []byte{'2'}, Id: 2, Queue: "queue1", Status: "ready"})
+	if err == nil {
+		t.Fatalf("Stored job in closed write-ahead log")
+	}
+	if store.lsn != 1 {
+		t.Errorf("Expected LSN 1 after failed write, got %v", store.lsn)
+	}
+
+	store.file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to reopen write-ahead log: " + err.Error())
+	}
+	err = store.PutJob(&StoredJob{Data: []byte{'3'}, Id: 3, Queue: "queue1", Status: "ready"})
+	if err == nil {
+		t.Errorf("Stored job in failed write-ahead log")
+	}
+	store.Close()
+}
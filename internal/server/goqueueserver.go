@@ -2,191 +2,1308 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cswilson90/goqueue/internal/config"
 	"github.com/cswilson90/goqueue/internal/data"
+	"github.com/cswilson90/goqueue/internal/logging"
+	"github.com/cswilson90/goqueue/internal/metrics"
 	"github.com/cswilson90/goqueue/internal/queue"
 )
 
+// fileStoreName is the name of the file store's file in the data directory.
+const fileStoreName = "goqueue.jobs"
+
+// minAcceptBackoff and maxAcceptBackoff bound how long the server waits before accepting again
+// after a temporary error accepting a connection.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
 // A GoJobServer is a server which handles requests to a GoJobQueue.
 type GoJobServer struct {
 	server net.Listener
 
 	queue *queue.GoJobQueue
+
+	config *config.Config
+
+	// lastConnectionID is the ID given to the most recent connection
+	lastConnectionID uint64
+
+	// numConnections is the number of clients currently connected
+	numConnections int64
+
+	stats *serverStats
+
+	// metricsServer serves Prometheus metrics over HTTP if it is configured
+	metricsServer *http.Server
+
+	// shutdownCtx is cancelled when the server starts shutting down so blocked commands can give up
+	shutdownCtx    context.Context
+	cancelShutdown context.CancelFunc
+
+	// mutex protects connections and shuttingDown
+	mutex        sync.Mutex
+	connections  map[*connection]struct{}
+	shuttingDown bool
+	// handlers tracks the goroutines handling connections
+	handlers sync.WaitGroup
+}
+
+// minPruneReservations is the fewest reservations a connection holds before it checks which have expired.
+const minPruneReservations = 64
+
+// maxReserveAnyQueues is the most queues a single RESERVEANY command can reserve from.
+const maxReserveAnyQueues = 100
+
+// maxBatchJobsLimit and maxBatchSizeLimit are the most jobs and the largest total job data in bytes
+// which can be added in one batch whatever the config allows.
+const (
+	maxBatchJobsLimit = 10000
+	maxBatchSizeLimit = queue.MaxJobSize
+)
+
+// maxQueuedCommands is the number of commands read from a connection which can be waiting to be handled
+// before the server stops reading more.
+const maxQueuedCommands = 1024
+
+// A connection is a single client connection to the server.
+// The connection ID identifies the client as the owner of the jobs it reserves.
+// The version is the protocol version negotiated with the client.
+type connection struct {
+	net.Conn
+	id      uint64
+	version uint32
+	stats   *serverStats
+
+	// framed is true once the client has switched the connection to framed mode.
+	// It's only used by the goroutine reading commands.
+	framed bool
+
+	// mutex protects running, closing and reserved
+	mutex sync.Mutex
+	// running holds the commands read but not yet finished in the order they were read
+	running []*runningCommand
+	// closing is true once the server wants the connection closed after the commands it has read
+	closing bool
+	// reserved holds the IDs of jobs reserved by the connection. Reservations which expire aren't removed
+	// straight away so it's pruned whenever it grows to pruneAt.
+	reserved map[uint64]struct{}
+	pruneAt  int
+}
+
+// A commandFunc handles a command which has been read from a connection.
+// The context is cancelled if the client cancels the command or the connection closes.
+type commandFunc func(ctx context.Context)
+
+// A runningCommand is a command read from a connection which hasn't finished.
+// The request ID is the one the client gave the command in framed mode.
+type runningCommand struct {
+	requestID uint32
+	cancel    context.CancelFunc
+}
+
+// A queuedCommand is a command waiting to be handled.
+type queuedCommand struct {
+	ctx     context.Context
+	running *runningCommand
+	handle  commandFunc
+}
+
+// requestIDKey is the context key of the request ID of a command read in framed mode.
+type requestIDKey struct{}
+
+// startCommand marks the connection as handling a command and returns the command's context.
+// In framed mode the context holds the request ID so the response can be given it.
+// Returns false if the connection is closing so the command shouldn't be handled.
+func (c *connection) startCommand(connCtx context.Context, requestID uint32) (context.Context, *runningCommand, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(connCtx)
+	if c.framed {
+		ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+	}
+	running := &runningCommand{requestID: requestID, cancel: cancel}
+	c.running = append(c.running, running)
+	return ctx, running, true
+}
+
+// finishCommand marks a command as finished.
+// Once a closing connection has no commands left it stops waiting for its next command.
+func (c *connection) finishCommand(command *runningCommand) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	command.cancel()
+	for i, running := range c.running {
+		if running == command {
+			c.running = append(c.running[:i], c.running[i+1:]...)
+			break
+		}
+	}
+	if c.closing && len(c.running) == 0 {
+		c.SetReadDeadline(time.Now())
+	}
+}
+
+// cancelCommands cancels every command read from the connection which hasn't finished.
+func (c *connection) cancelCommands() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, running := range c.running {
+		running.cancel()
+	}
+}
+
+// cancelRequest cancels the unfinished command read in framed mode with the given request ID.
+func (c *connection) cancelRequest(requestID uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, running := range c.running {
+		if running.requestID == requestID {
+			running.cancel()
+		}
+	}
+}
+
+// respond writes the response to a command back to the client.
+// In framed mode the response starts with the request ID of the command it answers.
+// Each response is written in a single write so the responses of concurrent commands don't interleave.
+func (c *connection) respond(ctx context.Context, response []byte) {
+	requestID, ok := ctx.Value(requestIDKey{}).(uint32)
+	if ok {
+		response = append(data.PackUint32(requestID), response...)
+	}
+	c.Write(response)
+}
+
+// addReservation records that the connection has reserved the job with the given ID.
+// Returns true if the reservations have grown enough that they should be pruned.
+func (c *connection) addReservation(jobID uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.reserved[jobID] = struct{}{}
+	if len(c.reserved) < c.pruneAt {
+		return false
+	}
+	// Stop other reservations starting a prune while this one runs
+	c.pruneAt = math.MaxInt32
+	return true
 }
 
-// NewGoJobServer creates a new GoJobServer which listens on the given hostname and port.
+// prunedReservations records that the reservations have been pruned.
+// The next prune is due once they have doubled.
+func (c *connection) prunedReservations() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pruneAt = 2 * len(c.reserved)
+	if c.pruneAt < minPruneReservations {
+		c.pruneAt = minPruneReservations
+	}
+}
+
+// removeReservation records that the connection no longer holds the job with the given ID.
+func (c *connection) removeReservation(jobID uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.reserved, jobID)
+}
+
+// reservations returns the IDs of the jobs reserved by the connection.
+func (c *connection) reservations() []uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	jobIDs := make([]uint64, 0, len(c.reserved))
+	for jobID := range c.reserved {
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs
+}
+
+// closeWhenIdle makes the connection close once the commands it has read have finished.
+// An idle connection stops waiting for its next command straight away.
+func (c *connection) closeWhenIdle() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closing = true
+	if len(c.running) == 0 {
+		c.SetReadDeadline(time.Now())
+	}
+}
+
+// NewGoJobServer creates a new GoJobServer which listens on the given hostname and port
+// and holds jobs in memory.
 func NewGoJobServer(host string, port string) (*GoJobServer, error) {
-	address := host + ":" + port
+	serverConfig := config.Default()
+	serverConfig.Host = host
+	serverConfig.Port = port
 
-	listener, err := net.Listen("tcp", address)
+	return NewGoJobServerWithConfig(serverConfig)
+}
+
+// NewGoJobServerWithConfig creates a new GoJobServer configured by the given config.
+// Jobs already in a persistent store are loaded before the server starts listening.
+// Returns an error if the config is invalid, the store can't be opened or the server can't listen.
+func NewGoJobServerWithConfig(serverConfig *config.Config) (*GoJobServer, error) {
+	err := serverConfig.Validate()
 	if err != nil {
 		return nil, err
 	}
 
+	store, err := openStore(serverConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %v store: %v", serverConfig.Store, err.Error())
+	}
+
+	goJobQueue, err := queue.NewGoJobQueueWithStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(serverConfig.Host, serverConfig.Port))
+	if err != nil {
+		goJobQueue.Close()
+		return nil, err
+	}
+
+	var metricsServer *http.Server
+	if serverConfig.MetricsAddress != "" {
+		metricsServer, err = serveMetrics(serverConfig.MetricsAddress, goJobQueue)
+		if err != nil {
+			listener.Close()
+			goJobQueue.Close()
+			return nil, fmt.Errorf("Failed to serve metrics: %v", err.Error())
+		}
+	}
+
 	server := &GoJobServer{
-		server: listener,
-		queue:  queue.NewGoJobQueue(),
+		server:      listener,
+		queue:       goJobQueue,
+		config:      serverConfig,
+		connections: make(map[*connection]struct{}),
+		stats:       newServerStats(),
+
+		metricsServer: metricsServer,
 	}
+	server.shutdownCtx, server.cancelShutdown = context.WithCancel(context.Background())
 	return server, nil
 }
 
+// openStore opens the store named in the config.
+func openStore(serverConfig *config.Config) (queue.Store, error) {
+	syncPolicy := map[string]queue.SyncPolicy{
+		config.SyncAlways: queue.SyncAlways,
+		config.SyncEvery:  queue.SyncEvery,
+		config.SyncNever:  queue.SyncNever,
+	}[serverConfig.SyncPolicy]
+	syncInterval := time.Duration(serverConfig.SyncInterval)
+
+	switch serverConfig.Store {
+	case config.StoreLog:
+		return queue.OpenLogStore(queue.LogStoreConfig{
+			Dir:              serverConfig.DataDir,
+			SyncPolicy:       syncPolicy,
+			SyncInterval:     syncInterval,
+			SnapshotInterval: time.Duration(serverConfig.SnapshotInterval),
+			SnapshotLogSize:  serverConfig.SnapshotLogSize,
+		})
+	case config.StoreFile:
+		err := os.MkdirAll(serverConfig.DataDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return queue.OpenFileStore(filepath.Join(serverConfig.DataDir, fileStoreName), syncPolicy, syncInterval)
+	default:
+		return queue.NewNullStore(), nil
+	}
+}
+
+// serveMetrics starts an HTTP server on the given address serving Prometheus metrics about the queue at /metrics.
+func serveMetrics(address string, goJobQueue *queue.GoJobQueue) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.New(goJobQueue))
+	metricsServer := &http.Server{Handler: mux}
+
+	go func() {
+		err := metricsServer.Serve(listener)
+		if err != http.ErrServerClosed {
+			logging.Errorf("Metrics server stopped: %v", err.Error())
+		}
+	}()
+
+	return metricsServer, nil
+}
+
+// Address returns the address the server is listening on.
+func (s *GoJobServer) Address() string {
+	return s.server.Addr().String()
+}
+
 // Run runs the GoJobServer and serves requests.
-// The function will block forever waiting for requests so should be run as a goroutine.
-func (s *GoJobServer) Run() {
+// The function blocks waiting for requests until the server is shut down so should be run as a goroutine.
+// Temporary errors accepting connections are retried after a backoff. Returns nil once the server is shut down
+// or the error which stopped it accepting connections, in which case the server should be shut down.
+func (s *GoJobServer) Run() error {
+	var backoff time.Duration
 	for {
 		conn, err := s.server.Accept()
 		if err != nil {
-			// Connection has been closed
-			return
+			s.mutex.Lock()
+			shuttingDown := s.shuttingDown
+			s.mutex.Unlock()
+			if shuttingDown {
+				return nil
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				backoff *= 2
+				if backoff < minAcceptBackoff {
+					backoff = minAcceptBackoff
+				}
+				if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				logging.Warnf("Failed to accept connection, retrying in %v: %v", backoff, err.Error())
+				time.Sleep(backoff)
+				continue
+			}
+
+			return err
+		}
+		backoff = 0
+
+		numConnections := atomic.AddInt64(&s.numConnections, 1)
+		if s.config.MaxConnections > 0 && numConnections > int64(s.config.MaxConnections) {
+			logging.Warnf("Refusing connection from %v: %v clients already connected", conn.RemoteAddr(), s.config.MaxConnections)
+			conn.Write(append(data.PackString("ERROR"), data.PackString("Too many connections")...))
+			s.stats.recordError()
+			conn.Close()
+			atomic.AddInt64(&s.numConnections, -1)
+			continue
 		}
 
-		go s.handleConnection(conn)
+		s.mutex.Lock()
+		if s.shuttingDown {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		newConn := &connection{
+			Conn:     &countingConn{Conn: conn, stats: s.stats},
+			id:       atomic.AddUint64(&s.lastConnectionID, 1),
+			version:  1,
+			stats:    s.stats,
+			reserved: make(map[uint64]struct{}),
+			pruneAt:  minPruneReservations,
+		}
+		s.connections[newConn] = struct{}{}
+		s.handlers.Add(1)
+		s.mutex.Unlock()
+
+		go s.handleConnection(newConn)
 	}
 }
 
-// Exit stops the server and
-func (s *GoJobServer) Exit() {
+// Shutdown gracefully shuts the server down.
+// It stops accepting connections, closes idle connections and lets commands being handled finish.
+// Blocked reserves are answered with a shutdown response. Once every connection is closed all reserved jobs
+// are released back to the ready queue and the queue's store is closed so every change is persisted.
+// If the context is done before the connections have closed they are closed immediately and the context's error
+// is returned, otherwise any error closing the store is returned.
+func (s *GoJobServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		return fmt.Errorf("Server is already shutting down")
+	}
+	s.shuttingDown = true
 	s.server.Close()
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	s.cancelShutdown()
+	for conn := range s.connections {
+		conn.closeWhenIdle()
+	}
+	s.mutex.Unlock()
+
+	handlersDone := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(handlersDone)
+	}()
+
+	var ctxErr error
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+		s.mutex.Lock()
+		for conn := range s.connections {
+			conn.Close()
+		}
+		s.mutex.Unlock()
+		<-handlersDone
+	}
+
+	released := s.queue.ReleaseReservedJobs()
+	if released > 0 {
+		logging.Infof("Released %v reserved jobs", released)
+	}
+
+	err := s.queue.Close()
+	if ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// Exit stops the server immediately, closing all connections without waiting for commands to finish.
+func (s *GoJobServer) Exit() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
 }
 
 // handleConnection handles a single connection to a client.
-func (s *GoJobServer) handleConnection(conn net.Conn) {
-	defer conn.Close()
+// Commands are read as soon as they arrive so a client can cancel earlier ones, but are handled one at a time
+// in the order they were read so the responses are written in order. In framed mode each command is handled
+// as soon as it's read and its response is written when it finishes.
+func (s *GoJobServer) handleConnection(conn *connection) {
+	logging.Debugf("Connection %v opened from %v", conn.id, conn.RemoteAddr())
+
+	connCtx, cancelConn := context.WithCancel(s.shutdownCtx)
+	// handlers tracks the goroutines handling the connection's commands
+	var handlers sync.WaitGroup
+	commands := make(chan queuedCommand, maxQueuedCommands)
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		for command := range commands {
+			command.handle(command.ctx)
+			conn.finishCommand(command.running)
+		}
+	}()
+	// inFlight limits the number of commands handled at once in framed mode
+	inFlight := make(chan struct{}, maxQueuedCommands)
+
+	defer func() {
+		// Commands still waiting are cancelled as there's no one left to answer
+		cancelConn()
+		if commands != nil {
+			close(commands)
+		}
+		handlers.Wait()
+
+		conn.Close()
+		atomic.AddInt64(&s.numConnections, -1)
+		if s.config.DisconnectPolicy == config.DisconnectRelease {
+			s.releaseReservations(conn)
+		}
+
+		s.mutex.Lock()
+		delete(s.connections, conn)
+		s.mutex.Unlock()
+		s.handlers.Done()
+
+		logging.Debugf("Connection %v closed", conn.id)
+	}()
 
+	// The reader must last as long as the connection as it may buffer pipelined commands
+	cmdReader := bufio.NewReader(conn)
 	for {
-		cmdReader := bufio.NewReader(conn)
+		var requestID uint32
+		var err error
+		if conn.framed {
+			requestID, err = data.ParseUint32(cmdReader)
+		}
 
-		cmdString, err := data.ParseCommand(cmdReader)
+		var cmdString string
+		if err == nil {
+			cmdString, err = data.ParseCommand(cmdReader)
+		}
 		if err != nil {
-			if err != io.EOF {
-				log.Println("Error: " + err.Error())
+			if err != io.EOF && s.shutdownCtx.Err() == nil {
+				logging.Errorf("%v", err.Error())
 			}
 			return
 		}
 
+		// Cancel before starting the CANCEL command so it doesn't cancel itself
+		if cmdString == "CANCEL" && !conn.framed {
+			conn.cancelCommands()
+		}
+
+		ctx, running, ok := conn.startCommand(connCtx, requestID)
+		if !ok {
+			return
+		}
+
+		logging.Debugf("Connection %v sent %v", conn.id, cmdString)
+		s.stats.recordCommand(cmdString)
+
+		if cmdString == "FRAMED" && !conn.framed {
+			// Commands read before switching are answered first so their responses aren't framed
+			close(commands)
+			handlers.Wait()
+			commands = nil
+
+			conn.respond(ctx, data.PackString("OK"))
+			conn.framed = true
+			conn.finishCommand(running)
+			continue
+		}
+
+		var command commandFunc
 		switch cmdString {
 		case "ADD":
-			s.handleAdd(conn, cmdReader)
+			command = s.handleAdd(conn, cmdReader)
+		case "ADDBATCH":
+			command = s.handleAddBatch(conn, cmdReader)
+		case "BURY":
+			command = s.handleBury(conn, cmdReader)
+		case "CANCEL":
+			command = s.handleCancel(conn, cmdReader)
 		case "CONNECT":
-			conn.Write(data.PackString("OK"))
+			command = okCommand(conn)
 		case "DELETE":
-			s.handleDelete(conn, cmdReader)
+			command = s.handleDelete(conn, cmdReader)
+		case "FRAMED":
+			command = errorCommand(conn, "Connection is already in framed mode")
+		case "KICK":
+			command = s.handleKick(conn, cmdReader)
+		case "LISTQUEUES":
+			command = s.handleListQueues(conn)
+		case "PEEK":
+			command = s.handlePeek(conn, cmdReader)
+		case "PEEKBURIED":
+			command = s.handlePeekStatus(conn, cmdReader, cmdString, "buried")
+		case "PEEKDELAYED":
+			command = s.handlePeekStatus(conn, cmdReader, cmdString, "delayed")
+		case "PEEKREADY":
+			command = s.handlePeekStatus(conn, cmdReader, cmdString, "ready")
+		case "RELEASE":
+			command = s.handleRelease(conn, cmdReader)
 		case "RESERVE":
-			s.handleReserve(conn, cmdReader)
+			command = s.handleReserve(conn, cmdReader)
+		case "RESERVEANY":
+			command = s.handleReserveAny(conn, cmdReader)
+		case "RESERVEBATCH":
+			command = s.handleReserveBatch(conn, cmdReader)
+		case "STATS":
+			command = s.handleStats(conn)
+		case "STATSQUEUE":
+			command = s.handleStatsQueue(conn, cmdReader)
+		case "TOUCH":
+			command = s.handleTouch(conn, cmdReader)
+		case "VERSION":
+			command = s.handleVersion(conn, cmdReader)
 		default:
-			errorResponse(conn, "Unknown Command "+cmdString)
+			command = errorCommand(conn, "Unknown Command "+cmdString)
+		}
+
+		if !conn.framed {
+			commands <- queuedCommand{ctx: ctx, running: running, handle: command}
+			continue
 		}
+
+		inFlight <- struct{}{}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			command(ctx)
+			conn.finishCommand(running)
+			<-inFlight
+		}()
 	}
 }
 
+// addReservation records that the connection has reserved the job with the given ID.
+// Reservations which have since expired or been taken over by another client are pruned once there are enough of them.
+func (s *GoJobServer) addReservation(conn *connection, jobID uint64) {
+	if !conn.addReservation(jobID) {
+		return
+	}
+
+	for _, reservedID := range conn.reservations() {
+		if !s.queue.IsReservedBy(reservedID, conn.id) {
+			conn.removeReservation(reservedID)
+		}
+	}
+	conn.prunedReservations()
+}
+
+// releaseReservations releases the jobs still reserved by a connection back to their queues.
+// Jobs whose reservation has expired and been taken by another connection are left alone.
+func (s *GoJobServer) releaseReservations(conn *connection) {
+	for _, jobID := range conn.reservations() {
+		job, ok := s.queue.GetJobData(jobID)
+		if !ok {
+			continue
+		}
+
+		err := s.queue.ReleaseJob(jobID, conn.id, job.Priority, 0)
+		if err == nil {
+			logging.Debugf("Released job %v reserved by closed connection %v", jobID, conn.id)
+		}
+	}
+}
+
+// maxJobSize returns the largest job data in bytes which can be added.
+func (s *GoJobServer) maxJobSize() uint32 {
+	if s.config.MaxJobSize > 0 && s.config.MaxJobSize < queue.MaxJobSize {
+		return s.config.MaxJobSize
+	}
+	return queue.MaxJobSize
+}
+
+// maxBatchJobs returns the most jobs which can be added in one batch.
+func (s *GoJobServer) maxBatchJobs() uint32 {
+	if s.config.MaxBatchJobs > 0 && s.config.MaxBatchJobs < maxBatchJobsLimit {
+		return s.config.MaxBatchJobs
+	}
+	return maxBatchJobsLimit
+}
+
+// maxBatchSize returns the largest total job data in bytes which can be added in one batch.
+func (s *GoJobServer) maxBatchSize() uint32 {
+	if s.config.MaxBatchSize > 0 && s.config.MaxBatchSize < maxBatchSizeLimit {
+		return s.config.MaxBatchSize
+	}
+	return maxBatchSizeLimit
+}
+
 // handleAdd handles an Add command from the client.
-func (s *GoJobServer) handleAdd(conn net.Conn, cmdReader *bufio.Reader) {
-	// ADD<\0><queue><priority><ttp><data>
+func (s *GoJobServer) handleAdd(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// Version 1: ADD<\0><queue><priority><ttp><data>
+	// Version 2: ADD<\0><queue><priority><ttp><delay><data>
 	queueName, err := data.ParseString(cmdReader)
 	if err != nil {
-		errorResponse(conn, "Malfromed ADD command: failed to parse queue name")
-		return
+		return errorCommand(conn, "Malfromed ADD command: failed to parse queue name")
 	}
 
 	priority, err := data.ParseUint32(cmdReader)
 	if err != nil {
-		errorResponse(conn, "Malformed ADD command: failed to parse priority")
-		return
+		return errorCommand(conn, "Malformed ADD command: failed to parse priority")
 	}
 
 	ttp, err := data.ParseUint32(cmdReader)
 	if err != nil {
-		errorResponse(conn, "Malformed ADD command: failed to parse ttp")
-		return
+		return errorCommand(conn, "Malformed ADD command: failed to parse ttp")
 	}
 
-	jobData, err := data.ParseJobData(cmdReader)
+	var delay uint32
+	if conn.version >= 2 {
+		delay, err = data.ParseUint32(cmdReader)
+		if err != nil {
+			return errorCommand(conn, "Malformed ADD command: failed to parse delay")
+		}
+	}
+
+	jobData, err := data.ParseJobDataLimited(cmdReader, s.maxJobSize())
+	if tooLarge, ok := err.(*data.JobTooLargeError); ok {
+		return errorCommand(conn, tooLarge.Error())
+	}
 	if err != nil {
-		errorResponse(conn, "Malformed ADD command: failed to parse job data")
-		return
+		return errorCommand(conn, "Malformed ADD command: failed to parse job data")
 	}
 
-	jobObject := &queue.GoJobData{
-		Data:     jobData,
-		Priority: priority,
-		Queue:    queueName,
-		Timeout:  ttp,
+	return func(ctx context.Context) {
+		if ttp == 0 {
+			ttp = s.config.DefaultTTP
+		}
+
+		jobObject := &queue.GoJobData{
+			Data:     jobData,
+			Delay:    delay,
+			Priority: priority,
+			Queue:    queueName,
+			Timeout:  ttp,
+		}
+
+		err := s.queue.AddJob(jobObject)
+		if err != nil {
+			logging.Errorf("%v", err.Error())
+			errorResponse(ctx, conn, fmt.Sprintf("Error adding new job to queue %v", queueName))
+			return
+		}
+
+		conn.respond(ctx, append(data.PackString("ADDED"), data.PackUint64(jobObject.Id)...))
 	}
+}
 
-	err = s.queue.AddJob(jobObject)
+// handleAddBatch handles an Add Batch command from the client.
+// Either all of the jobs are added or none are.
+func (s *GoJobServer) handleAddBatch(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// ADDBATCH<\0><count>[<queue><priority><ttp><delay><data>]...
+	count, err := data.ParseUint32(cmdReader)
 	if err != nil {
-		log.Println("Error: " + err.Error())
-		errorResponse(conn, fmt.Sprintf("Error adding new job to queue %v", queueName))
-		return
+		return errorCommand(conn, "Malformed ADDBATCH command: failed to parse job count")
+	}
+
+	// rejected is the reason the batch is rejected. The rest of the batch is still read, discarding
+	// the job data, so the following commands are read correctly.
+	var rejected error
+	if count > s.maxBatchJobs() {
+		rejected = fmt.Errorf("Batch of %v jobs is more than the maximum of %v", count, s.maxBatchJobs())
+	}
+
+	var jobs []*queue.GoJobData
+	remainingSize := s.maxBatchSize()
+	for i := uint32(0); i < count; i++ {
+		queueName, err := data.ParseString(cmdReader)
+		if err != nil {
+			return errorCommand(conn, fmt.Sprintf("Malformed ADDBATCH command: failed to parse queue name of job %v", i))
+		}
+
+		priority, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return errorCommand(conn, fmt.Sprintf("Malformed ADDBATCH command: failed to parse priority of job %v", i))
+		}
+
+		ttp, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return errorCommand(conn, fmt.Sprintf("Malformed ADDBATCH command: failed to parse ttp of job %v", i))
+		}
+
+		delay, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return errorCommand(conn, fmt.Sprintf("Malformed ADDBATCH command: failed to parse delay of job %v", i))
+		}
+
+		maxSize := s.maxJobSize()
+		if remainingSize < maxSize {
+			maxSize = remainingSize
+		}
+		if rejected != nil {
+			maxSize = 0
+		}
+
+		jobData, err := data.ParseJobDataLimited(cmdReader, maxSize)
+		if tooLarge, ok := err.(*data.JobTooLargeError); ok {
+			if rejected == nil && tooLarge.Size > s.maxJobSize() {
+				rejected = fmt.Errorf("Data of job %v is too large: %v", i, err.Error())
+			} else if rejected == nil {
+				rejected = fmt.Errorf("Batch data is larger than the maximum of %v bytes", s.maxBatchSize())
+			}
+			continue
+		}
+		if err != nil {
+			return errorCommand(conn, fmt.Sprintf("Malformed ADDBATCH command: failed to parse data of job %v", i))
+		}
+		if rejected != nil {
+			continue
+		}
+		remainingSize -= uint32(len(jobData))
+
+		if ttp == 0 {
+			ttp = s.config.DefaultTTP
+		}
+
+		jobs = append(jobs, &queue.GoJobData{
+			Data:     jobData,
+			Delay:    delay,
+			Priority: priority,
+			Queue:    queueName,
+			Timeout:  ttp,
+		})
+	}
+
+	if rejected != nil {
+		return errorCommand(conn, rejected.Error())
+	}
+
+	return func(ctx context.Context) {
+		// AddJobs checks every job before adding any and says which was rejected
+		err := s.queue.AddJobs(jobs)
+		if err != nil {
+			logging.Errorf("%v", err.Error())
+			errorResponse(ctx, conn, fmt.Sprintf("Error adding batch of new jobs: %v", err.Error()))
+			return
+		}
+
+		response := append(data.PackString("ADDED"), data.PackUint32(uint32(len(jobs)))...)
+		for _, job := range jobs {
+			response = append(response, data.PackUint64(job.Id)...)
+		}
+		conn.respond(ctx, response)
+	}
+}
+
+// handleBury handles a Bury command from the client.
+func (s *GoJobServer) handleBury(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// BURY<\0><id><priority>
+	jobID, err := data.ParseUint64(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed BURY command: failed to parse job ID")
 	}
 
-	conn.Write(append(data.PackString("ADDED"), data.PackUint64(jobObject.Id)...))
+	priority, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed BURY command: failed to parse priority")
+	}
+
+	return func(ctx context.Context) {
+		err := s.queue.BuryJob(jobID, conn.id, priority)
+		if err != nil {
+			errorResponse(ctx, conn, fmt.Sprintf("Failed to bury job %v: %v", jobID, err.Error()))
+			return
+		}
+		conn.removeReservation(jobID)
+
+		conn.respond(ctx, data.PackString("OK"))
+	}
+}
+
+// handleCancel handles a Cancel command from the client.
+// Outside framed mode the commands read before the cancel have already been cancelled.
+// In framed mode the cancel gives the request ID of the command to cancel.
+func (s *GoJobServer) handleCancel(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// CANCEL<\0>
+	// Framed: CANCEL<\0><requestid>
+	if conn.framed {
+		requestID, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			return errorCommand(conn, "Malformed CANCEL command: failed to parse request ID")
+		}
+		conn.cancelRequest(requestID)
+	}
+
+	return okCommand(conn)
 }
 
 // handleDelete handles an Add command from the client.
-func (s *GoJobServer) handleDelete(conn net.Conn, cmdReader *bufio.Reader) {
+func (s *GoJobServer) handleDelete(conn *connection, cmdReader *bufio.Reader) commandFunc {
 	// DELETE<\0><id>
 	jobID, err := data.ParseUint64(cmdReader)
 	if err != nil {
-		errorResponse(conn, "Malformed DELETE command: failed to parse job ID")
+		return errorCommand(conn, "Malformed DELETE command: failed to parse job ID")
+	}
+
+	return func(ctx context.Context) {
+		err := s.queue.DeleteJob(jobID)
+		if err != nil {
+			errorResponse(ctx, conn, fmt.Sprintf("Job %v already deleted", jobID))
+			return
+		}
+		conn.removeReservation(jobID)
+
+		conn.respond(ctx, data.PackString("OK"))
+	}
+}
+
+// handleKick handles a Kick command from the client.
+func (s *GoJobServer) handleKick(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// KICK<\0><queue><count>
+	queueName, err := data.ParseString(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed KICK command: failed to parse queue name")
+	}
+
+	count, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed KICK command: failed to parse count")
+	}
+
+	return func(ctx context.Context) {
+		kicked := s.queue.KickJobs(queueName, count)
+		conn.respond(ctx, append(data.PackString("KICKED"), data.PackUint32(kicked)...))
+	}
+}
+
+// handleListQueues handles a List Queues command from the client.
+func (s *GoJobServer) handleListQueues(conn *connection) commandFunc {
+	// LISTQUEUES<\0>
+	return func(ctx context.Context) {
+		queueNames := s.queue.QueueNames()
+
+		response := append(data.PackString("QUEUES"), data.PackUint32(uint32(len(queueNames)))...)
+		for _, queueName := range queueNames {
+			response = append(response, data.PackString(queueName)...)
+		}
+		conn.respond(ctx, response)
+	}
+}
+
+// handlePeek handles a Peek command from the client.
+func (s *GoJobServer) handlePeek(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// PEEK<\0><id>
+	jobID, err := data.ParseUint64(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed PEEK command: failed to parse job ID")
+	}
+
+	return func(ctx context.Context) {
+		job, ok := s.queue.GetJobData(jobID)
+		peekResponse(ctx, conn, job, ok)
+	}
+}
+
+// handlePeekStatus handles a Peek Ready, Peek Delayed or Peek Buried command from the client.
+func (s *GoJobServer) handlePeekStatus(conn *connection, cmdReader *bufio.Reader, command string, status string) commandFunc {
+	// PEEKREADY<\0><queue>, PEEKDELAYED<\0><queue> or PEEKBURIED<\0><queue>
+	queueName, err := data.ParseString(cmdReader)
+	if err != nil {
+		return errorCommand(conn, fmt.Sprintf("Malformed %v command: failed to parse queue name", command))
+	}
+
+	return func(ctx context.Context) {
+		job, ok := s.queue.PeekNextJob(queueName, status)
+		peekResponse(ctx, conn, job, ok)
+	}
+}
+
+// peekResponse writes the response to a peek command back to the client.
+func peekResponse(ctx context.Context, conn *connection, job *queue.GoJobData, found bool) {
+	if !found {
+		conn.respond(ctx, data.PackString("NOTFOUND"))
 		return
 	}
 
-	err = s.queue.DeleteJob(jobID)
+	packedJob, err := data.PackJob(job, conn.version)
 	if err != nil {
-		errorResponse(conn, fmt.Sprintf("Job %v already deleted", jobID))
+		logging.Errorf("%v", err.Error())
+		errorResponse(ctx, conn, "Failed to peek job: internal error")
 		return
 	}
+	conn.respond(ctx, append(data.PackString("FOUND"), packedJob...))
+}
+
+// handleRelease handles a Release command from the client.
+func (s *GoJobServer) handleRelease(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// RELEASE<\0><id><priority><delay>
+	jobID, err := data.ParseUint64(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RELEASE command: failed to parse job ID")
+	}
+
+	priority, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RELEASE command: failed to parse priority")
+	}
+
+	delay, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RELEASE command: failed to parse delay")
+	}
 
-	conn.Write(data.PackString("OK"))
+	return func(ctx context.Context) {
+		err := s.queue.ReleaseJob(jobID, conn.id, priority, delay)
+		if err != nil {
+			errorResponse(ctx, conn, fmt.Sprintf("Failed to release job %v: %v", jobID, err.Error()))
+			return
+		}
+		conn.removeReservation(jobID)
+
+		conn.respond(ctx, data.PackString("OK"))
+	}
 }
 
-// handleReserve handles an Add command from the client.
-func (s *GoJobServer) handleReserve(conn net.Conn, cmdReader *bufio.Reader) {
+// handleReserve handles a Reserve command from the client.
+func (s *GoJobServer) handleReserve(conn *connection, cmdReader *bufio.Reader) commandFunc {
 	// RESERVE<\0><queue><timeout>
 	queueName, err := data.ParseString(cmdReader)
 	if err != nil {
-		errorResponse(conn, "Malfromed RESERVE command: failed to parse queue name")
-		return
+		return errorCommand(conn, "Malfromed RESERVE command: failed to parse queue name")
 	}
 
 	timeout, err := data.ParseUint32(cmdReader)
 	if err != nil {
-		errorResponse(conn, "Malformed ADD command: failed to parse timeout")
-		return
+		return errorCommand(conn, "Malformed RESERVE command: failed to parse timeout")
 	}
 
-	// Keep trying to reserve a job until we hit a timeout (if there is one)
-	start := time.Now()
-	for {
-		job, ok := s.queue.ReserveJob(queueName)
-		if ok {
-			packedJob, err := data.PackJob(job)
-			if err != nil {
-				log.Println("Error: " + err.Error())
-				errorResponse(conn, "Failed to reserve job: internal error")
-				return
-			}
-			conn.Write(append(data.PackString("RESERVED"), packedJob...))
+	return func(ctx context.Context) {
+		s.reserveJob(ctx, conn, []string{queueName}, timeout)
+	}
+}
+
+// handleReserveAny handles a Reserve Any command from the client.
+func (s *GoJobServer) handleReserveAny(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// RESERVEANY<\0><count><queue>...<timeout>
+	count, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RESERVEANY command: failed to parse queue count")
+	}
+
+	// Every name is read so the next command is found but only up to the maximum are kept
+	var queueNames []string
+	for i := uint32(0); i < count; i++ {
+		queueName, err := data.ParseString(cmdReader)
+		if err != nil {
+			return errorCommand(conn, "Malformed RESERVEANY command: failed to parse queue name")
+		}
+		if len(queueNames) < maxReserveAnyQueues {
+			queueNames = append(queueNames, queueName)
+		}
+	}
+
+	timeout, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RESERVEANY command: failed to parse timeout")
+	}
+
+	if count > maxReserveAnyQueues {
+		return errorCommand(conn, fmt.Sprintf("Can't reserve a job from more than %v queues", maxReserveAnyQueues))
+	}
+
+	return func(ctx context.Context) {
+		if len(queueNames) == 0 {
+			errorResponse(ctx, conn, "Can't reserve a job from no queues")
+			return
+		}
+
+		s.reserveJob(ctx, conn, queueNames, timeout)
+	}
+}
+
+// handleReserveBatch handles a Reserve Batch command from the client.
+func (s *GoJobServer) handleReserveBatch(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// RESERVEBATCH<\0><queue><max><timeout>
+	queueName, err := data.ParseString(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RESERVEBATCH command: failed to parse queue name")
+	}
+
+	max, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RESERVEBATCH command: failed to parse max")
+	}
+
+	timeout, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed RESERVEBATCH command: failed to parse timeout")
+	}
+
+	return func(ctx context.Context) {
+		if max == 0 {
+			errorResponse(ctx, conn, "Can't reserve a batch of 0 jobs")
+			return
+		}
+
+		// A command cancelled before it starts mustn't reserve jobs which are ready
+		if ctx.Err() != nil {
+			s.reserveFailed(ctx, conn)
+			return
+		}
+
+		waitCtx, cancel := reserveContext(ctx, timeout)
+		defer cancel()
+
+		jobs, err := s.queue.ReserveJobsWait(waitCtx, queueName, conn.id, int(max))
+		if err != nil {
+			s.reserveFailed(ctx, conn)
 			return
 		}
 
-		if timeout != 0 {
-			elapsed := time.Now().Sub(start)
-			if elapsed.Seconds() >= float64(timeout) {
-				conn.Write(data.PackString("TIMEOUT"))
+		response := append(data.PackString("RESERVED"), data.PackUint32(uint32(len(jobs)))...)
+		for _, job := range jobs {
+			s.addReservation(conn, job.Id)
+
+			packedJob, err := data.PackJob(job, conn.version)
+			if err != nil {
+				logging.Errorf("%v", err.Error())
+				errorResponse(ctx, conn, "Failed to reserve jobs: internal error")
 				return
 			}
+			response = append(response, packedJob...)
 		}
+		conn.respond(ctx, response)
+	}
+}
+
+// reserveJob reserves a job from any of the named queues for the connection and writes the response.
+// If no job is ready it waits for one until the timeout expires, the command is cancelled or the server shuts down.
+func (s *GoJobServer) reserveJob(ctx context.Context, conn *connection, queueNames []string, timeout uint32) {
+	// A command cancelled before it starts mustn't reserve a job which is ready
+	if ctx.Err() != nil {
+		s.reserveFailed(ctx, conn)
+		return
+	}
+
+	waitCtx, cancel := reserveContext(ctx, timeout)
+	defer cancel()
+
+	// Wait for a job to be handed to this connection or the timeout to expire
+	job, err := s.queue.ReserveJobWaitAny(waitCtx, queueNames, conn.id)
+	if err != nil {
+		s.reserveFailed(ctx, conn)
+		return
+	}
+	s.addReservation(conn, job.Id)
+
+	packedJob, err := data.PackJob(job, conn.version)
+	if err != nil {
+		logging.Errorf("%v", err.Error())
+		errorResponse(ctx, conn, "Failed to reserve job: internal error")
+		return
+	}
+	conn.respond(ctx, append(data.PackString("RESERVED"), packedJob...))
+}
+
+// reserveContext returns a context for waiting for a reserve command's jobs which expires after the timeout.
+// A timeout of 0 waits until the command is cancelled.
+func reserveContext(ctx context.Context, timeout uint32) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+}
+
+// reserveFailed writes the response to a reserve command which didn't get a job.
+// The command's context tells whether the server is shutting down or the client cancelled the command,
+// otherwise the reserve timed out.
+func (s *GoJobServer) reserveFailed(ctx context.Context, conn *connection) {
+	switch {
+	case s.shutdownCtx.Err() != nil:
+		conn.respond(ctx, data.PackString("SHUTDOWN"))
+	case ctx.Err() != nil:
+		conn.respond(ctx, data.PackString("CANCELLED"))
+	default:
+		conn.respond(ctx, data.PackString("TIMEOUT"))
+	}
+}
+
+// handleStats handles a Stats command from the client.
+func (s *GoJobServer) handleStats(conn *connection) commandFunc {
+	// STATS<\0>
+	return func(ctx context.Context) {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+
+		stats := []data.Stat{
+			{Name: "uptime-seconds", Value: uint64(time.Since(s.stats.started) / time.Second)},
+			{Name: "connections-current", Value: uint64(atomic.LoadInt64(&s.numConnections))},
+			{Name: "connections-total", Value: atomic.LoadUint64(&s.lastConnectionID)},
+		}
+		for _, command := range commandNames {
+			stats = append(stats, data.Stat{Name: commandStatName(command), Value: atomic.LoadUint64(s.stats.commands[command])})
+		}
+		stats = append(stats,
+			data.Stat{Name: "errors", Value: atomic.LoadUint64(&s.stats.errors)},
+			data.Stat{Name: "bytes-in", Value: atomic.LoadUint64(&s.stats.bytesIn)},
+			data.Stat{Name: "bytes-out", Value: atomic.LoadUint64(&s.stats.bytesOut)},
+			data.Stat{Name: "last-job-id", Value: s.queue.LastJobID()},
+			data.Stat{Name: "memory-heap-bytes", Value: memStats.HeapAlloc},
+			data.Stat{Name: "memory-sys-bytes", Value: memStats.Sys},
+		)
+
+		conn.respond(ctx, append(data.PackString("STATS"), data.PackStats(stats)...))
+	}
+}
+
+// handleStatsQueue handles a Stats Queue command from the client.
+func (s *GoJobServer) handleStatsQueue(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// STATSQUEUE<\0><queue>
+	queueName, err := data.ParseString(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed STATSQUEUE command: failed to parse queue name")
+	}
+
+	return func(ctx context.Context) {
+		stats := s.queue.QueueStats(queueName)
+		conn.respond(ctx, append(data.PackString("STATS"), data.PackStats([]data.Stat{
+			{Name: "ready", Value: stats.Ready},
+			{Name: "reserved", Value: stats.Reserved},
+			{Name: "delayed", Value: stats.Delayed},
+			{Name: "buried", Value: stats.Buried},
+			{Name: "added", Value: stats.Added},
+			{Name: "deleted", Value: stats.Deleted},
+			{Name: "timed-out", Value: stats.TimedOut},
+			{Name: "oldest-ready-age-ms", Value: uint64(stats.OldestReadyAge / time.Millisecond)},
+			{Name: "waiting", Value: stats.Waiting},
+		})...))
+	}
+}
+
+// handleTouch handles a Touch command from the client.
+func (s *GoJobServer) handleTouch(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// TOUCH<\0><id>
+	jobID, err := data.ParseUint64(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed TOUCH command: failed to parse job ID")
+	}
+
+	return func(ctx context.Context) {
+		err := s.queue.TouchJob(jobID, conn.id)
+		if err != nil {
+			errorResponse(ctx, conn, fmt.Sprintf("Failed to touch job %v: %v", jobID, err.Error()))
+			return
+		}
+
+		conn.respond(ctx, data.PackString("OK"))
+	}
+}
+
+// handleVersion handles a Version command from the client.
+// The server uses the lower of the client's version and its own for the rest of the connection.
+// The version is set as soon as the command is read so later commands are parsed with it.
+func (s *GoJobServer) handleVersion(conn *connection, cmdReader *bufio.Reader) commandFunc {
+	// VERSION<\0><version>
+	version, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		return errorCommand(conn, "Malformed VERSION command: failed to parse version")
+	}
+
+	if version == 0 {
+		return errorCommand(conn, "Unsupported protocol version 0")
+	}
+
+	if version > data.ProtocolVersion {
+		version = data.ProtocolVersion
+	}
+	conn.version = version
+
+	return func(ctx context.Context) {
+		conn.respond(ctx, append(data.PackString("VERSION"), data.PackUint32(version)...))
+	}
+}
+
+// okCommand returns a command which responds OK.
+func okCommand(conn *connection) commandFunc {
+	return func(ctx context.Context) {
+		conn.respond(ctx, data.PackString("OK"))
+	}
+}
+
+// errorCommand returns a command which responds with the given error.
+// Commands which fail to parse still respond in order with the commands read before them.
+func errorCommand(conn *connection, response string) commandFunc {
+	return func(ctx context.Context) {
+		errorResponse(ctx, conn, response)
 	}
 }
 
 // errorResponse writes an error response back to the client.
-func errorResponse(conn net.Conn, response string) {
-	conn.Write(append(data.PackString("ERROR"), data.PackString(response)...))
+func errorResponse(ctx context.Context, conn *connection, response string) {
+	conn.stats.recordError()
+	conn.respond(ctx, append(data.PackString("ERROR"), data.PackString(response)...))
 }
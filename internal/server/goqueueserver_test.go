@@ -2,10 +2,19 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cswilson90/goqueue/internal/config"
 	"github.com/cswilson90/goqueue/internal/data"
+	"github.com/cswilson90/goqueue/internal/queue"
 )
 
 const (
@@ -56,6 +65,27 @@ func TestConnect(t *testing.T) {
 	}
 }
 
+func TestPipelinedCommands(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	// Commands sent in one write should all be answered in order
+	request := data.PackString("CONNECT")
+	request = append(request, data.PackString("LISTQUEUES")...)
+	request = append(request, data.PackString("CONNECT")...)
+	client.Write(request)
+
+	expectResponse(t, cmdReader, "OK")
+	expectResponse(t, cmdReader, "QUEUES")
+	data.ParseUint32(cmdReader)
+	expectResponse(t, cmdReader, "OK")
+}
+
 func TestAddReserveAndDelete(t *testing.T) {
 	server := createServer(t)
 	go server.Run()
@@ -108,7 +138,7 @@ func TestAddReserveAndDelete(t *testing.T) {
 	if response != "RESERVED" {
 		t.Errorf("Expected response RESERVED, got %v", response)
 	}
-	job, err := data.ParseJob(cmdReader)
+	job, err := data.ParseJob(cmdReader, 1)
 	if err != nil {
 		t.Errorf("Error parsing reserved job: " + err.Error())
 	}
@@ -131,3 +161,618 @@ func TestAddReserveAndDelete(t *testing.T) {
 		t.Errorf("Expected response 'OK' got '" + returnString + "'")
 	}
 }
+
+func TestTouch(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client1 := createClient(t)
+	defer client1.Close()
+	reader1 := bufio.NewReader(client1)
+
+	client2 := createClient(t)
+	defer client2.Close()
+	reader2 := bufio.NewReader(client2)
+
+	jobID := addTestJob(t, client1, reader1, "queue1")
+
+	// Can't touch a job which isn't reserved
+	client1.Write(append(data.PackString("TOUCH"), data.PackUint64(jobID)...))
+	expectResponse(t, reader1, "ERROR")
+	data.ParseString(reader1)
+
+	reserveTestJob(t, client1, reader1, "queue1")
+
+	// Can't touch a job reserved by another client
+	client2.Write(append(data.PackString("TOUCH"), data.PackUint64(jobID)...))
+	expectResponse(t, reader2, "ERROR")
+	data.ParseString(reader2)
+
+	client1.Write(append(data.PackString("TOUCH"), data.PackUint64(jobID)...))
+	expectResponse(t, reader1, "OK")
+}
+
+func TestRelease(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	jobID := addTestJob(t, client, cmdReader, "queue1")
+	reserveTestJob(t, client, cmdReader, "queue1")
+
+	request := data.PackString("RELEASE")
+	request = append(request, data.PackUint64(jobID)...)
+	request = append(request, data.PackUint32(2)...)
+	request = append(request, data.PackUint32(0)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "OK")
+
+	// Job should be ready to reserve again with its new priority
+	job := reserveTestJob(t, client, cmdReader, "queue1")
+	if job.Id != jobID || job.Priority != 2 {
+		t.Errorf("Expected to reserve job %v with priority 2, got job %v with priority %v", jobID, job.Id, job.Priority)
+	}
+}
+
+func TestVersionAndDelayedAdd(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	// Server should negotiate down to its own version
+	client.Write(append(data.PackString("VERSION"), data.PackUint32(data.ProtocolVersion+1)...))
+	expectResponse(t, cmdReader, "VERSION")
+	version, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		t.Errorf("Failed to parse VERSION response: " + err.Error())
+	}
+	if version != data.ProtocolVersion {
+		t.Errorf("Expected version %v, got %v", data.ProtocolVersion, version)
+	}
+
+	// Add a delayed job
+	request := data.PackString("ADD")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(1)...)
+	request = append(request, data.PackUint32(60)...)
+	request = append(request, data.PackUint32(60)...)
+	packedJobData, _ := data.PackJobData([]byte{'1', '2', '3'})
+	request = append(request, packedJobData...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "ADDED")
+	data.ParseUint64(cmdReader)
+
+	// Delayed job can't be reserved yet
+	request = data.PackString("RESERVE")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "TIMEOUT")
+
+	// Jobs include their queue name from version 3
+	request = data.PackString("ADD")
+	request = append(request, data.PackString("queue2")...)
+	request = append(request, data.PackUint32(1)...)
+	request = append(request, data.PackUint32(60)...)
+	request = append(request, data.PackUint32(0)...)
+	request = append(request, packedJobData...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "ADDED")
+	data.ParseUint64(cmdReader)
+
+	request = data.PackString("RESERVE")
+	request = append(request, data.PackString("queue2")...)
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "RESERVED")
+	job, err := data.ParseJob(cmdReader, version)
+	if err != nil {
+		t.Fatalf("Error parsing reserved job: " + err.Error())
+	}
+	if job.Queue != "queue2" {
+		t.Errorf("Expected reserved job to be from queue2, got %q", job.Queue)
+	}
+}
+
+func TestBuryAndKick(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	jobID := addTestJob(t, client, cmdReader, "queue1")
+	reserveTestJob(t, client, cmdReader, "queue1")
+
+	request := data.PackString("BURY")
+	request = append(request, data.PackUint64(jobID)...)
+	request = append(request, data.PackUint32(2)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "OK")
+
+	request = data.PackString("KICK")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(5)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "KICKED")
+	kicked, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		t.Errorf("Failed to parse number of kicked jobs: " + err.Error())
+	}
+	if kicked != 1 {
+		t.Errorf("Expected 1 job to be kicked, got %v", kicked)
+	}
+
+	job := reserveTestJob(t, client, cmdReader, "queue1")
+	if job.Id != jobID || job.Priority != 2 {
+		t.Errorf("Expected to reserve job %v with priority 2, got job %v with priority %v", jobID, job.Id, job.Priority)
+	}
+}
+
+func TestBlockingReserve(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	reserver := createClient(t)
+	defer reserver.Close()
+	reserveReader := bufio.NewReader(reserver)
+
+	adder := createClient(t)
+	defer adder.Close()
+	addReader := bufio.NewReader(adder)
+
+	request := data.PackString("RESERVE")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(0)...)
+	reserver.Write(request)
+
+	// Job should be handed to the blocked reserver when it's added
+	time.Sleep(10 * time.Millisecond)
+	jobID := addTestJob(t, adder, addReader, "queue1")
+
+	expectResponse(t, reserveReader, "RESERVED")
+	job, err := data.ParseJob(reserveReader, 1)
+	if err != nil {
+		t.Errorf("Error parsing reserved job: " + err.Error())
+	}
+	if job.Id != jobID {
+		t.Errorf("Expected reserved job to have ID %v got %v", jobID, job.Id)
+	}
+}
+
+func TestReserveAnyQueueLimit(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	// Reserving from too many queues is rejected without losing track of the commands after it
+	request := append(data.PackString("RESERVEANY"), data.PackUint32(maxReserveAnyQueues+1)...)
+	for i := 0; i <= maxReserveAnyQueues; i++ {
+		request = append(request, data.PackString(fmt.Sprintf("queue%v", i))...)
+	}
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "ERROR")
+	data.ParseString(cmdReader)
+
+	jobID := addTestJob(t, client, cmdReader, "queue1")
+	job := reserveTestJob(t, client, cmdReader, "queue1")
+	if job.Id != jobID {
+		t.Errorf("Expected to reserve job %v after rejected RESERVEANY, got %v", jobID, job.Id)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	request := data.PackString("RESERVE")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(0)...)
+	client.Write(request)
+
+	// Cancelling should answer the blocked reserve before the cancel itself
+	time.Sleep(10 * time.Millisecond)
+	client.Write(data.PackString("CANCEL"))
+	expectResponse(t, cmdReader, "CANCELLED")
+	expectResponse(t, cmdReader, "OK")
+
+	// The connection should still be usable and the cancelled reserve mustn't have taken the job
+	jobID := addTestJob(t, client, cmdReader, "queue1")
+	job := reserveTestJob(t, client, cmdReader, "queue1")
+	if job.Id != jobID {
+		t.Errorf("Expected reserved job to have ID %v got %v", jobID, job.Id)
+	}
+
+	// Commands sent after a cancel aren't cancelled by it
+	request = data.PackString("CANCEL")
+	request = append(request, data.PackString("RESERVE")...)
+	request = append(request, data.PackString("queue2")...)
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "OK")
+	expectResponse(t, cmdReader, "TIMEOUT")
+}
+
+func TestFramed(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	client.Write(data.PackString("FRAMED"))
+	expectResponse(t, cmdReader, "OK")
+
+	// A blocked reserve shouldn't stop later commands being answered
+	request := data.PackUint32(1)
+	request = append(request, data.PackString("RESERVE")...)
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(0)...)
+	request = append(request, data.PackUint32(2)...)
+	request = append(request, data.PackString("LISTQUEUES")...)
+	client.Write(request)
+
+	expectRequestID(t, cmdReader, 2)
+	expectResponse(t, cmdReader, "QUEUES")
+	count, _ := data.ParseUint32(cmdReader)
+	for i := uint32(0); i < count; i++ {
+		data.ParseString(cmdReader)
+	}
+
+	// Cancelling the reserve by its request ID should answer both in either order
+	request = data.PackUint32(3)
+	request = append(request, data.PackString("CANCEL")...)
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+
+	responses := make(map[uint32]string)
+	for i := 0; i < 2; i++ {
+		requestID, err := data.ParseUint32(cmdReader)
+		if err != nil {
+			t.Fatalf("Failed to get request ID from server: " + err.Error())
+		}
+		response, err := data.ParseCommand(cmdReader)
+		if err != nil {
+			t.Fatalf("Failed to get response from server: " + err.Error())
+		}
+		responses[requestID] = response
+	}
+	if responses[1] != "CANCELLED" || responses[3] != "OK" {
+		t.Errorf("Expected cancelled reserve and OK cancel got %v", responses)
+	}
+
+	// Errors should be framed too
+	client.Write(append(data.PackUint32(4), data.PackString("FRAMED")...))
+	expectRequestID(t, cmdReader, 4)
+	expectResponse(t, cmdReader, "ERROR")
+}
+
+// expectRequestID is a helper function which checks the request ID of the next framed response from the server
+func expectRequestID(t *testing.T, cmdReader *bufio.Reader, expected uint32) {
+	requestID, err := data.ParseUint32(cmdReader)
+	if err != nil {
+		t.Fatalf("Failed to get request ID from server: " + err.Error())
+	}
+	if requestID != expected {
+		t.Fatalf("Expected request ID %v got %v", expected, requestID)
+	}
+}
+
+// addTestJob is a helper function which adds a job to the given queue and returns its ID
+func addTestJob(t *testing.T, client net.Conn, cmdReader *bufio.Reader, queueName string) uint64 {
+	request := data.PackString("ADD")
+	request = append(request, data.PackString(queueName)...)
+	request = append(request, data.PackUint32(1)...)
+	request = append(request, data.PackUint32(60)...)
+	packedJobData, _ := data.PackJobData([]byte{'1', '2', '3'})
+	request = append(request, packedJobData...)
+	client.Write(request)
+
+	expectResponse(t, cmdReader, "ADDED")
+	jobID, err := data.ParseUint64(cmdReader)
+	if err != nil {
+		t.Errorf("Failed to get job ID of added job")
+	}
+	return jobID
+}
+
+// reserveTestJob is a helper function which reserves a job from the given queue
+func reserveTestJob(t *testing.T, client net.Conn, cmdReader *bufio.Reader, queueName string) *queue.GoJobData {
+	request := data.PackString("RESERVE")
+	request = append(request, data.PackString(queueName)...)
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+
+	expectResponse(t, cmdReader, "RESERVED")
+	job, err := data.ParseJob(cmdReader, 1)
+	if err != nil {
+		t.Errorf("Error parsing reserved job: " + err.Error())
+	}
+	return job
+}
+
+// expectResponse is a helper function which checks the next response from the server
+func expectResponse(t *testing.T, cmdReader *bufio.Reader, expected string) {
+	response, err := data.ParseCommand(cmdReader)
+	if err != nil {
+		t.Fatalf("Failed to get response from server: " + err.Error())
+	}
+	if response != expected {
+		t.Fatalf("Expected response '%v' got '%v'", expected, response)
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	serverConfig := config.Default()
+	serverConfig.Port = connPort
+	serverConfig.MaxConnections = 1
+	serverConfig.MaxJobSize = 2
+	serverConfig.MaxBatchJobs = 2
+	serverConfig.MaxBatchSize = 3
+	serverConfig.DefaultTTP = 30
+
+	server, err := NewGoJobServerWithConfig(serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to create test server: " + err.Error())
+	}
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+
+	// Job data larger than the maximum size is rejected
+	request := data.PackString("ADD")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(1)...)
+	request = append(request, data.PackUint32(0)...)
+	tooLarge, _ := data.PackJobData([]byte{'1', '2', '3'})
+	client.Write(append(request, tooLarge...))
+	expectResponse(t, cmdReader, "ERROR")
+	data.ParseString(cmdReader)
+
+	batchRequest := func(queueName string, jobs ...[]byte) []byte {
+		batch := append(data.PackString("ADDBATCH"), data.PackUint32(uint32(len(jobs)))...)
+		for _, jobData := range jobs {
+			batch = append(batch, data.PackString(queueName)...)
+			batch = append(batch, data.PackUint32(1)...)
+			batch = append(batch, data.PackUint32(0)...)
+			batch = append(batch, data.PackUint32(0)...)
+			packedJobData, _ := data.PackJobData(jobData)
+			batch = append(batch, packedJobData...)
+		}
+		return batch
+	}
+
+	// Batches with a job which is too large, too many jobs or too much data in total are rejected
+	// without losing track of the commands after them
+	rejectedBatches := [][]byte{
+		batchRequest("queue1", []byte{'1', '2', '3'}, []byte{'1'}),
+		batchRequest("queue1", []byte{'1'}, []byte{'2'}, []byte{'3'}),
+		batchRequest("queue1", []byte{'1', '2'}, []byte{'3', '4'}),
+		batchRequest("", []byte{'1'}),
+	}
+	for _, batch := range rejectedBatches {
+		client.Write(batch)
+		expectResponse(t, cmdReader, "ERROR")
+		data.ParseString(cmdReader)
+	}
+
+	// Jobs added with a TTP of 0 get the default TTP
+	packedJobData, _ := data.PackJobData([]byte{'1', '2'})
+	client.Write(append(request, packedJobData...))
+	expectResponse(t, cmdReader, "ADDED")
+	data.ParseUint64(cmdReader)
+
+	job := reserveTestJob(t, client, cmdReader, "queue1")
+	if job.Timeout != 30 {
+		t.Errorf("Expected job to have default TTP 30, got %v", job.Timeout)
+	}
+
+	// Connections over the limit are refused
+	client2 := createClient(t)
+	defer client2.Close()
+	reader2 := bufio.NewReader(client2)
+	expectResponse(t, reader2, "ERROR")
+	data.ParseString(reader2)
+	_, err = reader2.ReadByte()
+	if err == nil {
+		t.Error("Expected connection over the limit to be closed")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "goqueue")
+	if err != nil {
+		t.Fatalf("Failed to create data directory: " + err.Error())
+	}
+	defer os.RemoveAll(dataDir)
+
+	serverConfig := config.Default()
+	serverConfig.Port = connPort
+	serverConfig.Store = config.StoreLog
+	serverConfig.DataDir = dataDir
+	server, err := NewGoJobServerWithConfig(serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to create test server: " + err.Error())
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run()
+	}()
+
+	client1 := createClient(t)
+	defer client1.Close()
+	reader1 := bufio.NewReader(client1)
+	jobID := addTestJob(t, client1, reader1, "queue1")
+	reserveTestJob(t, client1, reader1, "queue1")
+
+	// Block a reserve on an empty queue
+	client2 := createClient(t)
+	defer client2.Close()
+	reader2 := bufio.NewReader(client2)
+	client2.Write(append(data.PackString("RESERVE"), append(data.PackString("queue2"), data.PackUint32(0)...)...))
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Failed to shut down server: " + err.Error())
+	}
+	err = <-runErr
+	if err != nil {
+		t.Errorf("Expected server to stop running without an error, got: " + err.Error())
+	}
+
+	expectResponse(t, reader2, "SHUTDOWN")
+	_, err = reader1.ReadByte()
+	if err == nil {
+		t.Error("Expected idle connection to be closed")
+	}
+
+	_, err = net.Dial(connType, connHost+":"+connPort)
+	if err == nil {
+		t.Error("Connected to server after it shut down")
+	}
+
+	// The reserved job should have been released and persisted
+	store, err := queue.OpenLogStore(queue.LogStoreConfig{Dir: dataDir})
+	if err != nil {
+		t.Fatalf("Failed to open log store: " + err.Error())
+	}
+	defer store.Close()
+	store.Jobs(func(job *queue.StoredJob) error {
+		if job.Id != jobID || job.Status != "ready" {
+			t.Errorf("Expected job %v to be ready after shutdown, got job %v %v", jobID, job.Id, job.Status)
+		}
+		return nil
+	})
+}
+
+func TestDisconnectReleasesReservations(t *testing.T) {
+	server := createServer(t)
+	go server.Run()
+	defer server.Exit()
+
+	worker := createClient(t)
+	workerReader := bufio.NewReader(worker)
+	jobID := addTestJob(t, worker, workerReader, "queue1")
+	reserveTestJob(t, worker, workerReader, "queue1")
+
+	// Kill the worker part way through the job
+	worker.Close()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+	job := reserveTestJob(t, client, cmdReader, "queue1")
+	if job.Id != jobID {
+		t.Errorf("Expected to reserve released job %v, got %v", jobID, job.Id)
+	}
+}
+
+func TestDisconnectLeavesReservationsToExpire(t *testing.T) {
+	serverConfig := config.Default()
+	serverConfig.Port = connPort
+	serverConfig.DisconnectPolicy = config.DisconnectExpire
+	server, err := NewGoJobServerWithConfig(serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to create test server: " + err.Error())
+	}
+	go server.Run()
+	defer server.Exit()
+
+	worker := createClient(t)
+	workerReader := bufio.NewReader(worker)
+	jobID := addTestJob(t, worker, workerReader, "queue1")
+	reserveTestJob(t, worker, workerReader, "queue1")
+	worker.Close()
+
+	client := createClient(t)
+	defer client.Close()
+	cmdReader := bufio.NewReader(client)
+	request := data.PackString("RESERVE")
+	request = append(request, data.PackString("queue1")...)
+	request = append(request, data.PackUint32(1)...)
+	client.Write(request)
+	expectResponse(t, cmdReader, "TIMEOUT")
+
+	job, _ := server.queue.GetJobData(jobID)
+	if job.Status != "reserved" {
+		t.Errorf("Expected job %v to stay reserved, got %v", jobID, job.Status)
+	}
+}
+
+func TestPruneReservations(t *testing.T) {
+	server := createServer(t)
+	defer server.Exit()
+
+	conn := &connection{id: 1, reserved: make(map[uint64]struct{}), pruneAt: minPruneReservations}
+	jobData := &queue.GoJobData{Data: []byte{'1'}, Priority: 1, Queue: "queue1", Timeout: 60}
+	server.queue.AddJob(jobData)
+	server.queue.ReserveJob("queue1", conn.id)
+	server.addReservation(conn, jobData.Id)
+
+	// Jobs which no longer exist are pruned once there are enough reservations, leaving the job still reserved
+	for i := uint64(1); i < minPruneReservations; i++ {
+		server.addReservation(conn, jobData.Id+i)
+	}
+	reservations := conn.reservations()
+	if len(reservations) != 1 || reservations[0] != jobData.Id {
+		t.Errorf("Expected only job %v to be left reserved, got %v", jobData.Id, reservations)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	serverConfig := config.Default()
+	serverConfig.Port = connPort
+	serverConfig.MetricsAddress = connHost + ":11224"
+	server, err := NewGoJobServerWithConfig(serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to create test server: " + err.Error())
+	}
+	go server.Run()
+	defer server.Exit()
+
+	client := createClient(t)
+	defer client.Close()
+	addTestJob(t, client, bufio.NewReader(client), "queue1")
+
+	response, err := http.Get("http://" + serverConfig.MetricsAddress + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: " + err.Error())
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+
+	expected := `goqueue_jobs_added_total{queue="queue1"} 1`
+	if !strings.Contains(string(body), expected) {
+		t.Errorf("Expected metrics to contain %v, got:\n%v", expected, string(body))
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// commandNames are the commands counted in the server's stats.
+var commandNames = []string{
+	"ADD",
+	"ADDBATCH",
+	"BURY",
+	"CANCEL",
+	"CONNECT",
+	"DELETE",
+	"FRAMED",
+	"KICK",
+	"LISTQUEUES",
+	"PEEK",
+	"PEEKBURIED",
+	"PEEKDELAYED",
+	"PEEKREADY",
+	"RELEASE",
+	"RESERVE",
+	"RESERVEANY",
+	"RESERVEBATCH",
+	"STATS",
+	"STATSQUEUE",
+	"TOUCH",
+	"VERSION",
+}
+
+// serverStats counts what the server has done since it started.
+// All counters are updated atomically.
+type serverStats struct {
+	started time.Time
+
+	// commands counts each command handled by name.
+	// The map isn't changed after it's created so it can be read without a lock.
+	commands map[string]*uint64
+
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// newServerStats creates stats for a server starting now.
+func newServerStats() *serverStats {
+	stats := &serverStats{
+		started:  time.Now(),
+		commands: make(map[string]*uint64, len(commandNames)),
+	}
+	for _, name := range commandNames {
+		stats.commands[name] = new(uint64)
+	}
+	return stats
+}
+
+// recordCommand counts a command being handled. Unknown commands aren't counted.
+func (s *serverStats) recordCommand(name string) {
+	count, ok := s.commands[name]
+	if ok {
+		atomic.AddUint64(count, 1)
+	}
+}
+
+// recordError counts an error response.
+func (s *serverStats) recordError() {
+	atomic.AddUint64(&s.errors, 1)
+}
+
+// commandStatName returns the name of the stat counting the given command e.g. "cmd-add".
+func commandStatName(command string) string {
+	return "cmd-" + strings.ToLower(command)
+}
+
+// A countingConn is a network connection which counts the bytes read from and written to it.
+type countingConn struct {
+	net.Conn
+	stats *serverStats
+}
+
+// Read reads from the connection, counting the bytes read.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.bytesIn, uint64(n))
+	return n, err
+}
+
+// Write writes to the connection, counting the bytes written.
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.bytesOut, uint64(n))
+	return n, err
+}